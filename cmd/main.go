@@ -17,6 +17,7 @@ import (
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
@@ -37,11 +38,16 @@ func init() {
 	//+kubebuilder:scaffold:scheme
 }
 
-func run(k8sConfig *rest.Config, metricsAddr string, enableLeaderElection bool, probeAddr string, opts zap.Options, ctx context.Context) error {
+func run(k8sConfig *rest.Config, metricsAddr string, enableLeaderElection bool, probeAddr string, webhookAddr string, defaultServiceAccount string, opts zap.Options, ctx context.Context) error {
 
 	// Apply logger
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	// Bundles must never be applied with the controller's own permissions
+	if defaultServiceAccount == "" {
+		return fmt.Errorf("a default service account is required")
+	}
+
 	// Create the manager
 	mgr, err := ctrl.NewManager(k8sConfig, ctrl.Options{
 		Scheme:                        scheme,
@@ -56,13 +62,29 @@ func run(k8sConfig *rest.Config, metricsAddr string, enableLeaderElection bool,
 		return fmt.Errorf("unable to start manager: %w", err)
 	}
 
-	// Setup GitRepository reconciler
-	if err := (&internal.GitRepositoryReconciler{WorkDir: "/data"}).SetupWithManager(mgr); err != nil {
+	// Setup GitRepository reconciler, triggered by webhook receivers via the events channel
+	events := make(chan event.GenericEvent)
+	if err := (&internal.GitRepositoryReconciler{WorkDir: "/data", Events: events}).SetupWithManager(mgr); err != nil {
 		return fmt.Errorf("unable to create controller '%s': %w", "GitRepository", err)
 	}
-	if err := (&internal.KubectlBundleReconciler{}).SetupWithManager(mgr); err != nil {
+	if err := (&internal.ReceiverReconciler{Addr: webhookAddr, Events: events}).SetupWithManager(mgr); err != nil {
+		return fmt.Errorf("unable to create controller '%s': %w", "Receiver", err)
+	}
+	if err := (&internal.CommandRunReconciler{}).SetupWithManager(mgr); err != nil {
+		return fmt.Errorf("unable to create controller '%s': %w", "CommandRun", err)
+	}
+	if err := (&internal.KubectlBundleReconciler{DefaultServiceAccount: defaultServiceAccount}).SetupWithManager(mgr); err != nil {
 		return fmt.Errorf("unable to create controller '%s': %w", "KubectlBundle", err)
 	}
+	if err := (&internal.KustomizeBundleReconciler{DefaultServiceAccount: defaultServiceAccount}).SetupWithManager(mgr); err != nil {
+		return fmt.Errorf("unable to create controller '%s': %w", "KustomizeBundle", err)
+	}
+	if err := (&internal.KudeBundleReconciler{DefaultServiceAccount: defaultServiceAccount}).SetupWithManager(mgr); err != nil {
+		return fmt.Errorf("unable to create controller '%s': %w", "KudeBundle", err)
+	}
+	if err := (&internal.HelmBundleReconciler{DefaultServiceAccount: defaultServiceAccount}).SetupWithManager(mgr); err != nil {
+		return fmt.Errorf("unable to create controller '%s': %w", "HelmBundle", err)
+	}
 	//+kubebuilder:scaffold:builder
 
 	// Add health probes
@@ -88,8 +110,13 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var webhookAddr string
+	var defaultServiceAccount string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	flag.StringVar(&webhookAddr, "webhook-bind-address", ":9292", "The address the webhook receiver endpoint binds to.")
+	flag.StringVar(&defaultServiceAccount, "default-service-account", "default",
+		"The service account (in each bundle's namespace) to impersonate for bundles that do not specify one.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
@@ -101,7 +128,7 @@ func main() {
 	flag.Parse()
 
 	// Run
-	if err := run(ctrl.GetConfigOrDie(), metricsAddr, enableLeaderElection, probeAddr, opts, ctrl.SetupSignalHandler()); err != nil {
+	if err := run(ctrl.GetConfigOrDie(), metricsAddr, enableLeaderElection, probeAddr, webhookAddr, defaultServiceAccount, opts, ctrl.SetupSignalHandler()); err != nil {
 		setupLog.Error(err, "Operator failed")
 		os.Exit(1)
 	}
@@ -26,13 +26,17 @@ func TestRun(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to allocate a random local address for health host: %v", err)
 	}
+	webhookHost, err := harness.FindFreeLocalAddr()
+	if err != nil {
+		t.Fatalf("Failed to allocate a random local address for webhook host: %v", err)
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	t.Cleanup(func() {
 		t.Log("Stopping manager")
 		cancel()
 	})
 	go func() {
-		if err := run(k8sConfig, metricsHost, false, healthHost, opts, ctx); err != nil {
+		if err := run(k8sConfig, metricsHost, false, healthHost, webhookHost, "default", opts, ctx); err != nil {
 			t.Errorf("Failed to run manager: %v", err)
 		}
 	}()
@@ -48,4 +52,8 @@ func TestRun(t *testing.T) {
 	resp, err := http.Get("http://" + healthHost + "/healthz"); assert.NoErrorf(t, err, "Failed to get healthz") {
 		assert.Equal(t, http.StatusOK, resp.StatusCode)
 	}
+	if //goland:noinspection HttpUrlsUsage
+	resp, err := http.Post("http://"+webhookHost+"/hook/default/unknown", "application/json", nil); assert.NoErrorf(t, err, "Failed to post webhook") {
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
 }
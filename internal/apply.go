@@ -0,0 +1,562 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
+
+	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+)
+
+const (
+	fieldManager = "kude-controller" // Field manager used for server-side apply
+
+	applyActionCreated    = "created"    // Object did not exist, and was created
+	applyActionConfigured = "configured" // Object existed, and was changed
+	applyActionUnchanged  = "unchanged"  // Object existed, and was not changed
+	applyActionPruned     = "pruned"     // Object was removed from the bundle, and was deleted
+	applyActionFailed     = "failed"     // Object could not be applied (or pruned)
+
+	annotationPrune         = "kude.kfirs.com/prune" // Annotation controlling whether an object may be pruned
+	annotationPruneDisabled = "disabled"             // Value of the prune annotation that prevents pruning
+
+	applyModeApply  = "Apply"  // Objects are applied to the cluster
+	applyModeDryRun = "DryRun" // Objects are applied using a server-side dry-run, leaving the cluster as-is
+	applyModeDiff   = "Diff"   // Like "DryRun", also recording the changes to the fields of each object
+
+	maskedValue = "***" // Replaces values that must not be reported, such as Secret data
+)
+
+// serverManagedFields are the metadata fields maintained by the server, ignored when diffing objects.
+var serverManagedFields = []string{"managedFields", "resourceVersion", "uid", "creationTimestamp", "generation"}
+
+// fieldNamePattern matches field names that can be used as-is in field paths.
+var fieldNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// resolveManifestFiles returns the files matching the given patterns, which are relative to the given directory, and
+// may be files, directories (whose YAML & JSON files are matched) or glob patterns.
+func resolveManifestFiles(dir string, patterns []string) ([]string, error) {
+	// Resolve symlinks before verifying that files are inside the repository, so they cannot lead outside it
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve directory '%s': %w", dir, err)
+	}
+	confine := func(path string) error {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return fmt.Errorf("failed to resolve '%s': %w", path, err)
+		} else if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("file '%s' is outside the repository", path)
+		}
+		return nil
+	}
+
+	var files []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid file pattern '%s': %w", pattern, err)
+		} else if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match '%s'", pattern)
+		}
+		for _, match := range matches {
+			if err := confine(match); err != nil {
+				return nil, err
+			}
+			if info, err := os.Stat(match); err != nil {
+				return nil, fmt.Errorf("failed to stat '%s': %w", match, err)
+			} else if !info.IsDir() {
+				files = append(files, match)
+			} else if entries, err := os.ReadDir(match); err != nil {
+				return nil, fmt.Errorf("failed to read directory '%s': %w", match, err)
+			} else {
+				for _, entry := range entries {
+					switch filepath.Ext(entry.Name()) {
+					case ".yaml", ".yml", ".json":
+						if entry.IsDir() {
+							continue
+						} else if err := confine(filepath.Join(match, entry.Name())); err != nil {
+							return nil, err
+						}
+						files = append(files, filepath.Join(match, entry.Name()))
+					}
+				}
+			}
+		}
+	}
+	return files, nil
+}
+
+// readManifests reads all Kubernetes objects from the files matching the given patterns (see resolveManifestFiles).
+// Files are decrypted using the given decryptor, and then variables are substituted in them using the given
+// substitution (if any).
+func readManifests(dir string, patterns []string, d *decryptor, s *substitution) ([]*unstructured.Unstructured, error) {
+	files, err := resolveManifestFiles(dir, patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []*unstructured.Unstructured
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read '%s': %w", file, err)
+		}
+		if data, err = d.decrypt(data); err != nil {
+			return nil, fmt.Errorf("failed to decrypt '%s': %w", file, err)
+		}
+		if s != nil {
+			if data, err = s.apply(data); err != nil {
+				return nil, fmt.Errorf("failed to substitute variables in '%s': %w", file, err)
+			}
+		}
+		fileObjects, err := decodeManifests(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse '%s': %w", file, err)
+		}
+		objects = append(objects, fileObjects...)
+	}
+	return objects, nil
+}
+
+// digestManifests returns a digest of the paths & contents of the files matching the given patterns (see
+// resolveManifestFiles), as well as of the given variables to substitute in them; files yielding the same digest result
+// in the same objects.
+func digestManifests(dir string, patterns []string, variables map[string]string) (string, error) {
+	files, err := resolveManifestFiles(dir, patterns)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read '%s': %w", file, err)
+		}
+		rel, _ := filepath.Rel(dir, file)
+		_, _ = fmt.Fprintf(h, "file:%s:%d:", rel, len(data))
+		_, _ = h.Write(data)
+	}
+	names := make([]string, 0, len(variables))
+	for name := range variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		_, _ = fmt.Fprintf(h, "var:%s:%d:%s", name, len(variables[name]), variables[name])
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// decodeManifests decodes all Kubernetes objects from the given YAML (possibly multi-document) or JSON stream. List
+// objects (e.g. "v1/List") are flattened into their items.
+func decodeManifests(r io.Reader) ([]*unstructured.Unstructured, error) {
+	var objects []*unstructured.Unstructured
+	decoder := yaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		u := &unstructured.Unstructured{}
+		if err := decoder.Decode(&u.Object); errors.Is(err, io.EOF) {
+			return objects, nil
+		} else if err != nil {
+			return nil, err
+		} else if len(u.Object) == 0 {
+			continue
+		}
+
+		if u.IsList() {
+			if err := u.EachListItem(func(item runtime.Object) error {
+				objects = append(objects, item.(*unstructured.Unstructured))
+				return nil
+			}); err != nil {
+				return nil, err
+			}
+		} else {
+			objects = append(objects, u)
+		}
+	}
+}
+
+// applyObjects applies the given objects using server-side apply, and returns the outcome for each object. Namespaced
+// objects without a namespace are applied to the given default namespace. Namespaces and custom resource definitions
+// are applied first, so that objects depending on them in the same bundle can be applied in the same pass. In "DryRun"
+// & "Diff" modes, objects are applied using a server-side dry-run, and "Diff" mode also records the changes to each
+// object's fields.
+func applyObjects(ctx context.Context, c client.Client, namespace string, objects []*unstructured.Unstructured, mode string) []v1alpha1.ObjectResult {
+	sort.SliceStable(objects, func(i, j int) bool {
+		return applyPriority(objects[i]) < applyPriority(objects[j])
+	})
+	results := make([]v1alpha1.ObjectResult, len(objects))
+	for i, obj := range objects {
+		results[i] = applyObject(ctx, c, namespace, obj, mode)
+	}
+	return results
+}
+
+func applyPriority(obj *unstructured.Unstructured) int {
+	switch obj.GroupVersionKind().GroupKind().String() {
+	case "Namespace", "CustomResourceDefinition.apiextensions.k8s.io":
+		return 0
+	default:
+		return 1
+	}
+}
+
+// applyObject applies a single object using server-side apply (or a dry-run of it, per the given mode), and returns its
+// outcome.
+func applyObject(ctx context.Context, c client.Client, namespace string, obj *unstructured.Unstructured, mode string) v1alpha1.ObjectResult {
+	gvk := obj.GroupVersionKind()
+	result := v1alpha1.ObjectResult{
+		APIVersion: obj.GetAPIVersion(),
+		Kind:       obj.GetKind(),
+		Namespace:  obj.GetNamespace(),
+		Name:       obj.GetName(),
+	}
+	fail := func(err error) v1alpha1.ObjectResult {
+		result.Action = applyActionFailed
+		result.Error = err.Error()
+		return result
+	}
+	if gvk.Kind == "" || gvk.Version == "" {
+		return fail(errors.New("object has no apiVersion or kind"))
+	} else if obj.GetName() == "" {
+		return fail(errors.New("object has no name"))
+	}
+
+	// Set the namespace according to the object's scope
+	if err := setObjectNamespace(c, namespace, obj); err != nil {
+		return fail(err)
+	}
+	result.Namespace = obj.GetNamespace()
+
+	// Fetch the current state of the object, to tell whether it is created, configured or unchanged
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(gvk)
+	action := applyActionConfigured
+	if err := c.Get(ctx, client.ObjectKeyFromObject(obj), existing); apierrors.IsNotFound(err) {
+		action = applyActionCreated
+	} else if err != nil {
+		return fail(fmt.Errorf("failed to get object: %w", err))
+	}
+
+	obj.SetResourceVersion("")
+	obj.SetManagedFields(nil)
+	if mode == applyModeApply {
+		if err := c.Patch(ctx, obj, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership); err != nil {
+			return fail(fmt.Errorf("failed to apply object: %w", err))
+		} else if action == applyActionConfigured && obj.GetResourceVersion() == existing.GetResourceVersion() {
+			action = applyActionUnchanged
+		}
+		result.Action = action
+		return result
+	}
+
+	// Dry-runs leave the resource version as-is, so the live & desired state are compared instead
+	if err := c.Patch(ctx, obj, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership, client.DryRunAll); err != nil {
+		return fail(fmt.Errorf("failed to dry-run object: %w", err))
+	}
+	if action == applyActionCreated {
+		existing = nil
+	}
+	diff := diffObject(existing, obj)
+	if action == applyActionConfigured && len(diff) == 0 {
+		action = applyActionUnchanged
+	}
+	if mode == applyModeDiff {
+		result.Diff = diff
+	}
+	result.Action = action
+	return result
+}
+
+// diffObject returns the changes to the fields of an object, from its given live state (nil if it does not exist) to
+// its given desired state. Fields maintained by the server are ignored, and the data of Secrets is masked.
+func diffObject(live, desired *unstructured.Unstructured) []v1alpha1.FieldDiff {
+	liveObject, desiredObject := map[string]interface{}{}, desired.DeepCopy().Object
+	if live != nil {
+		liveObject = live.DeepCopy().Object
+	}
+	for _, field := range serverManagedFields {
+		unstructured.RemoveNestedField(liveObject, "metadata", field)
+		unstructured.RemoveNestedField(desiredObject, "metadata", field)
+	}
+	if desired.GroupVersionKind().GroupKind() == (schema.GroupKind{Kind: "Secret"}) {
+		for _, field := range []string{"data", "stringData"} {
+			maskSecretData(liveObject, desiredObject, field)
+		}
+	}
+
+	var diffs []v1alpha1.FieldDiff
+	diffValues("", liveObject, desiredObject, &diffs)
+	return diffs
+}
+
+// maskSecretData masks the values of the given data field of a Secret's live & desired state, while still telling
+// apart values that changed.
+func maskSecretData(live, desired map[string]interface{}, field string) {
+	liveData, liveFound, _ := unstructured.NestedMap(live, field)
+	desiredData, desiredFound, _ := unstructured.NestedMap(desired, field)
+	for key, value := range liveData {
+		if desiredValue, ok := desiredData[key]; !ok {
+			liveData[key] = maskedValue
+		} else if equality.Semantic.DeepEqual(value, desiredValue) {
+			liveData[key], desiredData[key] = maskedValue, maskedValue
+		} else {
+			liveData[key], desiredData[key] = maskedValue+" (before)", maskedValue+" (after)"
+		}
+	}
+	for key := range desiredData {
+		if _, ok := liveData[key]; !ok {
+			desiredData[key] = maskedValue
+		}
+	}
+	if liveFound {
+		_ = unstructured.SetNestedMap(live, liveData, field)
+	}
+	if desiredFound {
+		_ = unstructured.SetNestedMap(desired, desiredData, field)
+	}
+}
+
+// diffValues appends the changes from the given live value to the given desired value, both at the given path, to the
+// given diffs. Maps, as well as lists of the same length, are compared element by element.
+func diffValues(path string, live, desired interface{}, diffs *[]v1alpha1.FieldDiff) {
+	liveMap, liveIsMap := live.(map[string]interface{})
+	desiredMap, desiredIsMap := desired.(map[string]interface{})
+	if liveIsMap && desiredIsMap {
+		var keys []string
+		for key := range liveMap {
+			keys = append(keys, key)
+		}
+		for key := range desiredMap {
+			if _, ok := liveMap[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			element := "." + key
+			if !fieldNamePattern.MatchString(key) {
+				element = fmt.Sprintf("[%q]", key)
+			}
+			diffValues(path+element, liveMap[key], desiredMap[key], diffs)
+		}
+		return
+	}
+
+	liveList, liveIsList := live.([]interface{})
+	desiredList, desiredIsList := desired.([]interface{})
+	if liveIsList && desiredIsList && len(liveList) == len(desiredList) {
+		for i := range liveList {
+			diffValues(fmt.Sprintf("%s[%d]", path, i), liveList[i], desiredList[i], diffs)
+		}
+		return
+	}
+
+	if !equality.Semantic.DeepEqual(live, desired) {
+		*diffs = append(*diffs, v1alpha1.FieldDiff{Path: path, Live: jsonValue(live), Desired: jsonValue(desired)})
+	}
+}
+
+// jsonValue returns the JSON representation of the given value, or an empty string if it's nil.
+func jsonValue(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// setObjectNamespace sets the namespace of the given object according to its scope: namespaced objects without a
+// namespace are assigned the given default namespace, and cluster-scoped objects have their namespace cleared.
+func setObjectNamespace(c client.Client, namespace string, obj *unstructured.Unstructured) error {
+	gvk := obj.GroupVersionKind()
+	mapping, err := c.RESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return fmt.Errorf("failed to resolve resource type: %w", err)
+	} else if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		if obj.GetNamespace() == "" {
+			obj.SetNamespace(namespace)
+		}
+	} else {
+		obj.SetNamespace("")
+	}
+	return nil
+}
+
+// detectDrift compares the live state of the given objects with their desired state, and returns the objects that
+// drifted (including objects that no longer exist). Desired state is computed by a server-side apply dry-run of each
+// object, so only fields set by the manifests are compared.
+func detectDrift(ctx context.Context, c client.Client, namespace string, objects []*unstructured.Unstructured) ([]v1alpha1.InventoryEntry, error) {
+	var drifted []v1alpha1.InventoryEntry
+	for _, obj := range objects {
+		desired := obj.DeepCopy()
+		if err := setObjectNamespace(c, namespace, desired); err != nil {
+			return nil, fmt.Errorf("failed to check %s '%s': %w", desired.GetKind(), desired.GetName(), err)
+		}
+		gvk := desired.GroupVersionKind()
+		entry := v1alpha1.InventoryEntry{
+			Group:     gvk.Group,
+			Version:   gvk.Version,
+			Kind:      gvk.Kind,
+			Namespace: desired.GetNamespace(),
+			Name:      desired.GetName(),
+		}
+
+		live := &unstructured.Unstructured{}
+		live.SetGroupVersionKind(gvk)
+		if err := c.Get(ctx, client.ObjectKeyFromObject(desired), live); apierrors.IsNotFound(err) {
+			drifted = append(drifted, entry)
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to get %s '%s': %w", desired.GetKind(), desired.GetName(), err)
+		}
+
+		desired.SetResourceVersion("")
+		desired.SetManagedFields(nil)
+		if err := c.Patch(ctx, desired, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership, client.DryRunAll); err != nil {
+			return nil, fmt.Errorf("failed to dry-run %s '%s': %w", desired.GetKind(), desired.GetName(), err)
+		}
+		unstructured.RemoveNestedField(live.Object, "metadata", "managedFields")
+		unstructured.RemoveNestedField(live.Object, "metadata", "resourceVersion")
+		unstructured.RemoveNestedField(desired.Object, "metadata", "managedFields")
+		unstructured.RemoveNestedField(desired.Object, "metadata", "resourceVersion")
+		if !equality.Semantic.DeepEqual(live.Object, desired.Object) {
+			drifted = append(drifted, entry)
+		}
+	}
+	return drifted, nil
+}
+
+// inventoryEntryFor returns the inventory entry identifying the object of the given result.
+func inventoryEntryFor(result v1alpha1.ObjectResult) v1alpha1.InventoryEntry {
+	gv, _ := schema.ParseGroupVersion(result.APIVersion)
+	return v1alpha1.InventoryEntry{
+		Group:     gv.Group,
+		Version:   gv.Version,
+		Kind:      result.Kind,
+		Namespace: result.Namespace,
+		Name:      result.Name,
+	}
+}
+
+// inventoryKey returns a key identifying the object of the given inventory entry regardless of its API version.
+func inventoryKey(entry v1alpha1.InventoryEntry) string {
+	return entry.Group + "/" + entry.Kind + "/" + entry.Namespace + "/" + entry.Name
+}
+
+// mergeInventory returns the union of the given inventories, preserving order & preferring later entries.
+func mergeInventory(inventories ...[]v1alpha1.InventoryEntry) []v1alpha1.InventoryEntry {
+	var merged []v1alpha1.InventoryEntry
+	indices := make(map[string]int)
+	for _, inventory := range inventories {
+		for _, entry := range inventory {
+			if i, ok := indices[inventoryKey(entry)]; ok {
+				merged[i] = entry
+			} else {
+				indices[inventoryKey(entry)] = len(merged)
+				merged = append(merged, entry)
+			}
+		}
+	}
+	return merged
+}
+
+// subtractInventory returns the entries of the given inventory that are not in the given other inventory.
+func subtractInventory(inventory, other []v1alpha1.InventoryEntry) []v1alpha1.InventoryEntry {
+	keys := make(map[string]bool, len(other))
+	for _, entry := range other {
+		keys[inventoryKey(entry)] = true
+	}
+	var result []v1alpha1.InventoryEntry
+	for _, entry := range inventory {
+		if !keys[inventoryKey(entry)] {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// pruneObjects deletes the objects of the given inventory entries, except those annotated to disable pruning, and
+// returns the outcome for each deleted (or failed) object. Objects that no longer exist are silently ignored. In "DryRun"
+// & "Diff" modes, objects are deleted using a server-side dry-run.
+func pruneObjects(ctx context.Context, c client.Client, entries []v1alpha1.InventoryEntry, mode string) []v1alpha1.ObjectResult {
+	opts := []client.DeleteOption{client.PropagationPolicy(metav1.DeletePropagationBackground)}
+	if mode != applyModeApply {
+		opts = append(opts, client.DryRunAll)
+	}
+	var results []v1alpha1.ObjectResult
+	for _, entry := range entries {
+		gvk := schema.GroupVersionKind{Group: entry.Group, Version: entry.Version, Kind: entry.Kind}
+		result := v1alpha1.ObjectResult{
+			APIVersion: gvk.GroupVersion().String(),
+			Kind:       entry.Kind,
+			Namespace:  entry.Namespace,
+			Name:       entry.Name,
+			Action:     applyActionPruned,
+		}
+
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(gvk)
+		if err := c.Get(ctx, client.ObjectKey{Namespace: entry.Namespace, Name: entry.Name}, obj); apierrors.IsNotFound(err) || meta.IsNoMatchError(err) {
+			continue
+		} else if err != nil {
+			result.Action = applyActionFailed
+			result.Error = fmt.Errorf("failed to get object: %w", err).Error()
+		} else if obj.GetAnnotations()[annotationPrune] == annotationPruneDisabled {
+			continue
+		} else if err := c.Delete(ctx, obj, opts...); client.IgnoreNotFound(err) != nil {
+			result.Action = applyActionFailed
+			result.Error = fmt.Errorf("failed to delete object: %w", err).Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// formatObjectResult formats the given object result as a single human-readable line.
+func formatObjectResult(result v1alpha1.ObjectResult) string {
+	name := result.Name
+	if result.Namespace != "" {
+		name = result.Namespace + "/" + name
+	}
+	line := fmt.Sprintf("%s %s %s", strings.ToLower(result.Kind), name, result.Action)
+	if result.Error != "" {
+		line += ": " + result.Error
+	}
+	return line
+}
+
+// formatFieldDiff formats the given field diff as a single human-readable, indented, line.
+func formatFieldDiff(diff v1alpha1.FieldDiff) string {
+	live, desired := diff.Live, diff.Desired
+	if live == "" {
+		live = "<none>"
+	}
+	if desired == "" {
+		desired = "<none>"
+	}
+	return fmt.Sprintf("  %s: %s -> %s", diff.Path, live, desired)
+}
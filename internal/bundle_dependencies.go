@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kstrings "k8s.io/utils/strings"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"strings"
+)
+
+const (
+	dependsOnIndexKey        = ".spec.dependsOn"    // Index of bundles by their dependencies, in "Kind/namespace/name" format
+	typeUpToDateDependency   = "UpToDate"           // Condition of dependencies that must be "True" for dependents to be applied
+	typeHealthyDependency    = "Healthy"            // Condition of dependencies that must be "True" when they check their health
+	reasonDependencyNotReady = "DependencyNotReady" // Reason of bundles waiting for their dependencies
+	reasonDependencyCycle    = "DependencyCycle"    // Reason of bundles that (transitively) depend on themselves
+)
+
+// bundleKinds lists the kinds of bundles that may depend on each other.
+var bundleKinds = []string{"KubectlBundle", "KustomizeBundle", "HelmBundle", "KudeBundle"}
+
+// newBundle creates an empty bundle of the given kind.
+func newBundle(kind string) (client.Object, error) {
+	switch kind {
+	case "KubectlBundle":
+		return &v1alpha1.KubectlBundle{}, nil
+	case "KustomizeBundle":
+		return &v1alpha1.KustomizeBundle{}, nil
+	case "HelmBundle":
+		return &v1alpha1.HelmBundle{}, nil
+	case "KudeBundle":
+		return &v1alpha1.KudeBundle{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported bundle kind '%s'", kind)
+	}
+}
+
+// bundleDependencyState is the state of a bundle relevant to its dependents.
+type bundleDependencyState struct {
+	dependsOn        []v1alpha1.BundleReference // Dependencies of the bundle
+	conditions       []metav1.Condition         // Conditions of the bundle
+	sourceRepository string                     // Source GitRepository of the bundle, if any
+	lastAppliedSHA   string                     // Commit SHA of the source repository last applied successfully
+}
+
+// getBundleDependencyState returns the state of the given bundle relevant to its dependents.
+func getBundleDependencyState(o client.Object) bundleDependencyState {
+	switch b := o.(type) {
+	case *v1alpha1.KubectlBundle:
+		return bundleDependencyState{b.Spec.DependsOn, b.Status.Conditions, b.Spec.SourceRepository, b.Status.LastAppliedSHA}
+	case *v1alpha1.KustomizeBundle:
+		return bundleDependencyState{b.Spec.DependsOn, b.Status.Conditions, b.Spec.SourceRepository, b.Status.LastAppliedSHA}
+	case *v1alpha1.HelmBundle:
+		return bundleDependencyState{b.Spec.DependsOn, b.Status.Conditions, b.Spec.SourceRepository, b.Status.LastAppliedSHA}
+	case *v1alpha1.KudeBundle:
+		return bundleDependencyState{b.Spec.DependsOn, b.Status.Conditions, b.Spec.SourceRepository, b.Status.LastAppliedSHA}
+	default:
+		return bundleDependencyState{}
+	}
+}
+
+// dependencyKey returns the key of the given dependency of a bundle of the given kind, in "Kind/namespace/name" format.
+func dependencyKey(kind string, ref v1alpha1.BundleReference) string {
+	if ref.Kind != "" {
+		kind = ref.Kind
+	}
+	return kind + "/" + ref.Name
+}
+
+// getBundle fetches the bundle with the given key, in "Kind/namespace/name" format.
+func getBundle(ctx context.Context, c client.Client, key string) (client.Object, error) {
+	tokens := strings.SplitN(key, "/", 3)
+	if len(tokens) != 3 {
+		return nil, fmt.Errorf("invalid bundle reference '%s'", key)
+	}
+	o, err := newBundle(tokens[0])
+	if err != nil {
+		return nil, err
+	} else if err := c.Get(ctx, types.NamespacedName{Namespace: tokens[1], Name: tokens[2]}, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// checkDependencies checks whether all dependencies of the given bundle of the given kind are up-to-date with their
+// current commit, and healthy if they check their objects' health. If not, the reason & message to report are returned.
+func checkDependencies(ctx context.Context, c client.Client, kind string, o client.Object) (string, string, error) {
+	dependsOn := getBundleDependencyState(o).dependsOn
+	if len(dependsOn) == 0 {
+		return "", "", nil
+	}
+
+	if cycle, err := findDependencyCycle(ctx, c, kind, o); err != nil {
+		return "", "", err
+	} else if cycle != nil {
+		return reasonDependencyCycle, "Dependency cycle detected: " + strings.Join(cycle, " -> "), nil
+	}
+
+	for _, ref := range dependsOn {
+		key := dependencyKey(kind, ref)
+		dependency, err := getBundle(ctx, c, key)
+		if apierrors.IsNotFound(err) {
+			return reasonDependencyNotReady, fmt.Sprintf("Dependency '%s' not found", key), nil
+		} else if err != nil {
+			return "", "", fmt.Errorf("failed to get dependency '%s': %w", key, err)
+		}
+
+		state := getBundleDependencyState(dependency)
+		if !meta.IsStatusConditionTrue(state.conditions, typeUpToDateDependency) {
+			return reasonDependencyNotReady, fmt.Sprintf("Dependency '%s' is not up-to-date", key), nil
+		} else if healthy := meta.FindStatusCondition(state.conditions, typeHealthyDependency); healthy != nil && healthy.Status != metav1.ConditionTrue && healthy.Reason != reasonHealthNotChecked {
+			return reasonDependencyNotReady, fmt.Sprintf("Dependency '%s' is not healthy", key), nil
+		} else if state.sourceRepository != "" {
+			var repo v1alpha1.GitRepository
+			gitRepoNamespace, gitRepoName := kstrings.SplitQualifiedName(state.sourceRepository)
+			if err := c.Get(ctx, types.NamespacedName{Namespace: gitRepoNamespace, Name: gitRepoName}, &repo); apierrors.IsNotFound(err) {
+				return reasonDependencyNotReady, fmt.Sprintf("Source repository of dependency '%s' not found", key), nil
+			} else if err != nil {
+				return "", "", fmt.Errorf("failed to get source repository of dependency '%s': %w", key, err)
+			} else if repo.Status.LastPulledSHA != state.lastAppliedSHA {
+				return reasonDependencyNotReady, fmt.Sprintf("Dependency '%s' is not up-to-date with its current commit", key), nil
+			}
+		}
+	}
+	return "", "", nil
+}
+
+// findDependencyCycle searches for a chain of dependencies leading from the given bundle back to itself, and returns
+// it (as bundle keys) if found. Missing dependencies are ignored.
+func findDependencyCycle(ctx context.Context, c client.Client, kind string, o client.Object) ([]string, error) {
+	self := kind + "/" + o.GetNamespace() + "/" + o.GetName()
+	visited := map[string]bool{self: true}
+
+	var visit func(kind string, o client.Object, path []string) ([]string, error)
+	visit = func(kind string, o client.Object, path []string) ([]string, error) {
+		for _, ref := range getBundleDependencyState(o).dependsOn {
+			key := dependencyKey(kind, ref)
+			chain := append(append([]string{}, path...), key)
+			if key == self {
+				return chain, nil
+			} else if visited[key] {
+				continue
+			}
+			visited[key] = true
+
+			dependency, err := getBundle(ctx, c, key)
+			if apierrors.IsNotFound(err) {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to get dependency '%s': %w", key, err)
+			}
+			if cycle, err := visit(strings.SplitN(key, "/", 2)[0], dependency, chain); err != nil || cycle != nil {
+				return cycle, err
+			}
+		}
+		return nil, nil
+	}
+	return visit(kind, o, []string{self})
+}
+
+// indexDependencies indexes bundles of the given kind by the keys of their dependencies.
+func indexDependencies(mgr ctrl.Manager, kind string) error {
+	o, err := newBundle(kind)
+	if err != nil {
+		return err
+	}
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), o, dependsOnIndexKey, func(rawObj client.Object) []string {
+		var keys []string
+		for _, ref := range getBundleDependencyState(rawObj).dependsOn {
+			keys = append(keys, dependencyKey(kind, ref))
+		}
+		return keys
+	}); err != nil {
+		return fmt.Errorf("failed to create index for dependencies: %w", err)
+	}
+	return nil
+}
+
+// watchDependencies makes the given controller reconcile bundles (of the given list type) whenever any of the bundles
+// they depend on changes.
+func watchDependencies(b *builder.Builder, c client.Client, list client.ObjectList) *builder.Builder {
+	for _, kind := range bundleKinds {
+		kind := kind
+		o, _ := newBundle(kind)
+		b = b.Watches(&source.Kind{Type: o}, handler.EnqueueRequestsFromMapFunc(func(dependency client.Object) []reconcile.Request {
+			key := kind + "/" + dependency.GetNamespace() + "/" + dependency.GetName()
+			dependents := list.DeepCopyObject().(client.ObjectList)
+			if err := c.List(context.TODO(), dependents, client.MatchingFields{dependsOnIndexKey: key}); err != nil {
+				ctrl.Log.Error(err, "Failed listing dependents of bundle", "bundle", key)
+				return []reconcile.Request{}
+			}
+
+			var requests []reconcile.Request
+			_ = meta.EachListItem(dependents, func(item runtime.Object) error {
+				dependent := item.(client.Object)
+				requests = append(requests, reconcile.Request{
+					NamespacedName: types.NamespacedName{
+						Name:      dependent.GetName(),
+						Namespace: dependent.GetNamespace(),
+					},
+				})
+				return nil
+			})
+			return requests
+		}))
+	}
+	return b
+}
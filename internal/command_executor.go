@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sync"
+	"time"
+)
+
+// errCommandExecutorStopped is returned when executing a command after the executor was stopped.
+var errCommandExecutorStopped = errors.New("command executor stopped")
+
+// commandExecutor executes commands in background goroutines, so that reconcilers don't block on long-running (or hung)
+// commands. Executions are tracked by the UID of their CommandRun, and their owner is enqueued once they finish. When
+// the manager shuts down, all in-flight commands are cancelled, and the executor waits for them to return.
+type commandExecutor struct {
+	events     chan event.GenericEvent          // Owners of finished executions, for their reconciler to pick up
+	lock       sync.Mutex                       // Guards executions & stopped
+	executions map[types.UID]context.CancelFunc // In-flight executions, by CommandRun UID
+	stopped    chan struct{}                    // Closed once the executor stops accepting new executions
+	wg         sync.WaitGroup                   // Tracks in-flight executions
+}
+
+// newCommandExecutor creates a new command executor; it must be added to the manager to be stopped on shutdown.
+func newCommandExecutor() *commandExecutor {
+	return &commandExecutor{
+		events:     make(chan event.GenericEvent),
+		executions: make(map[types.UID]context.CancelFunc),
+		stopped:    make(chan struct{}),
+	}
+}
+
+// Start blocks until the given context is done, then cancels all in-flight commands and waits for them to return.
+func (e *commandExecutor) Start(ctx context.Context) error {
+	<-ctx.Done()
+
+	e.lock.Lock()
+	close(e.stopped)
+	for _, cancel := range e.executions {
+		cancel()
+	}
+	e.lock.Unlock()
+
+	e.wg.Wait()
+	return nil
+}
+
+// Execute runs the given command in the background for the given run, cancelling its context once the given timeout
+// elapses (if positive). The given owner is enqueued once the command returns.
+func (e *commandExecutor) Execute(uid types.UID, owner client.Object, timeout time.Duration, command func(ctx context.Context)) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	select {
+	case <-e.stopped:
+		return errCommandExecutorStopped
+	default:
+	}
+	if _, ok := e.executions[uid]; ok {
+		return fmt.Errorf("run '%s' is already executing", uid)
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	e.executions[uid] = cancel
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		defer cancel()
+		command(ctx)
+
+		e.lock.Lock()
+		delete(e.executions, uid)
+		e.lock.Unlock()
+
+		select {
+		case e.events <- event.GenericEvent{Object: owner}:
+		case <-e.stopped:
+		}
+	}()
+	return nil
+}
+
+// IsExecuting checks whether a command is currently executing for the given run.
+func (e *commandExecutor) IsExecuting(uid types.UID) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, ok := e.executions[uid]
+	return ok
+}
+
+// Cancel cancels the command executing for the given run, if any, and returns whether one was executing.
+func (e *commandExecutor) Cancel(uid types.UID) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if cancel, ok := e.executions[uid]; ok {
+		cancel()
+		return true
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+func TestCommandExecutorTimeout(t *testing.T) {
+	executor := newCommandExecutor()
+	owner := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "owner"}}
+
+	errs := make(chan error, 1)
+	require.NoError(t, executor.Execute("run1", owner, 100*time.Millisecond, func(ctx context.Context) {
+		<-ctx.Done()
+		errs <- ctx.Err()
+	}), "execution failed")
+	assert.True(t, executor.IsExecuting("run1"), "run should be executing")
+	assert.Error(t, executor.Execute("run1", owner, 0, func(context.Context) {}), "duplicate execution should fail")
+
+	select {
+	case e := <-executor.events:
+		assert.Equal(t, owner, e.Object, "incorrect owner enqueued")
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "owner not enqueued")
+	}
+	assert.ErrorIs(t, <-errs, context.DeadlineExceeded, "command not timed out")
+	assert.False(t, executor.IsExecuting("run1"), "run should not be executing")
+}
+
+func TestCommandExecutorShutdown(t *testing.T) {
+	executor := newCommandExecutor()
+	owner := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "owner"}}
+
+	errs := make(chan error, 1)
+	require.NoError(t, executor.Execute("run1", owner, 0, func(ctx context.Context) {
+		<-ctx.Done()
+		time.Sleep(100 * time.Millisecond)
+		errs <- ctx.Err()
+	}), "execution failed")
+
+	// Shutting down should cancel in-flight commands, and wait for them to return
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, executor.Start(ctx), "executor failed")
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, context.Canceled, "command not cancelled")
+	default:
+		assert.Fail(t, "executor stopped before command returned")
+	}
+	assert.ErrorIs(t, executor.Execute("run2", owner, 0, func(context.Context) {}), errCommandExecutorStopped, "execution after shutdown should fail")
+}
@@ -0,0 +1,474 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	"math"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	typePendingCommandRun   = "Pending"   // Is the command run waiting to start?
+	typeRunningCommandRun   = "Running"   // Is the command running?
+	typeSucceededCommandRun = "Succeeded" // Did the command run finish successfully?
+	typeFailedCommandRun    = "Failed"    // Did the command run fail?
+
+	reasonTimedOutCommandRun    = "TimedOut"    // Reason of failed runs whose command exceeded the run's timeout
+	reasonInterruptedCommandRun = "Interrupted" // Reason of failed runs whose command was terminated before finishing
+
+	commandRunJobDefaultImage = "bitnami/kubectl:1.25" // Default image of the container running the command
+	commandRunJobFetchImage   = "alpine/git:2.36.2"    // Image of the init container fetching the repository
+	commandRunJobContainer    = "kubectl"              // Name of the container running the command
+	commandRunJobFetcher      = "fetch"                // Name of the init container fetching the repository
+	commandRunJobLogLines     = 200                    // Number of trailing log lines to store in the run's output
+
+	annotationCommandRunCreatedAt = "kude.kfirs.com/created-at"           // Annotation recording the precise creation time of runs
+	commandRunCreatedAtLayout     = "2006-01-02T15:04:05.000000000Z07:00" // Fixed-width (hence sortable) layout of the creation time annotation
+)
+
+// commandRunJobFetchScript clones the repository into the workspace & checks out the run's commit, authenticating with
+// the credentials mounted from the repository's secret, if any.
+const commandRunJobFetchScript = `set -eu
+if [ -f /credentials/identity ]; then
+  if [ ! -s /credentials/known_hosts ]; then
+    echo "repository secret has no 'known_hosts' key; it's required for verifying the SSH server's host key" >&2
+    exit 1
+  fi
+  cp /credentials/identity /tmp/identity && chmod 0400 /tmp/identity
+  export GIT_SSH_COMMAND="ssh -i /tmp/identity -o StrictHostKeyChecking=yes -o UserKnownHostsFile=/credentials/known_hosts"
+elif [ -f /credentials/bearerToken ]; then
+  git config --global http.extraHeader "Authorization: Bearer $(cat /credentials/bearerToken)"
+elif [ -f /credentials/password ]; then
+  git config --global credential.helper '!f() { echo "username=$(cat /credentials/username 2>/dev/null)"; echo "password=$(cat /credentials/password)"; }; f'
+fi
+if [ -f /credentials/caFile ]; then git config --global http.sslCAInfo /credentials/caFile; fi
+git clone --quiet --no-checkout "$REPOSITORY_URL" /workspace
+git -C /workspace checkout --quiet "$COMMIT_SHA"
+`
+
+// commandRunJobCommandScript runs the given kubectl command over the files matching the given patterns, failing if any
+// pattern matches no files. Patterns only undergo pathname expansion (not word splitting), and the matching files are
+// collected as positional parameters (after the patterns, which are then shifted out) so they're passed as-is.
+const commandRunJobCommandScript = `set -eu
+cd /workspace
+command="$1"; shift
+patterns=$#
+for pattern in "$@"; do
+  matched=0
+  IFS=''
+  for f in $pattern; do
+    if [ -e "$f" ] || [ -L "$f" ]; then set -- "$@" -f "$f"; matched=1; fi
+  done
+  unset IFS
+  if [ "$matched" -eq 0 ]; then echo "no files match '$pattern'" >&2; exit 1; fi
+done
+shift "$patterns"
+exec kubectl "$command" --server-side --force-conflicts --field-manager=` + fieldManager + ` --namespace="$NAMESPACE" "$@"
+`
+
+// CommandRunReconciler reconciles a CommandRun object, tracking its lifecycle, running it in a Kubernetes Job if
+// requested, and deleting it once its TTL expired
+type CommandRunReconciler struct {
+	Client    client.Client        // Kubernetes API client
+	Clientset kubernetes.Interface // Kubernetes clientset, used for fetching pod logs
+	Recorder  record.EventRecorder // Kubernetes event recorder
+	Scheme    *runtime.Scheme      // Scheme registry
+}
+
+//+kubebuilder:rbac:groups=kude.kfirs.com,resources=commandruns,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=kude.kfirs.com,resources=commandruns/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=pods/log,verbs=get
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+
+// Reconcile continuously aims to move the current state of [CommandRun] objects closer to their desired state.
+func (r *CommandRunReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var o v1alpha1.CommandRun
+	if err := r.Client.Get(ctx, req.NamespacedName, &o); err != nil {
+		// we'll ignore not-found errors, since they can't be fixed by an immediate
+		// requeue (we'll need to wait for a new notification), and we can get them
+		// on deleted requests.
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// Finished runs never change, and are only deleted once their TTL expires
+	if isCommandRunFinished(&o) {
+		return r.collectGarbage(ctx, &o)
+	}
+
+	// New runs are pending until started
+	if len(o.Status.Conditions) == 0 {
+		setCommandRunPhase(&o, typePendingCommandRun, "Created", "")
+		if err := r.Client.Status().Update(ctx, &o); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to update CommandRun status: %w", err)
+		}
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	// Runs executed in-process are started & finished by their bundle reconciler
+	if o.Spec.Job == nil {
+		return ctrl.Result{}, nil
+	}
+
+	// Create the run's job if it's missing
+	var job batchv1.Job
+	if err := r.Client.Get(ctx, req.NamespacedName, &job); apierrors.IsNotFound(err) {
+		job := newCommandRunJob(&o)
+		if err := ctrl.SetControllerReference(&o, job, r.Scheme); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to set owner of job: %w", err)
+		} else if err := r.Client.Create(ctx, job); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to create job: %w", err)
+		}
+		r.Recorder.Eventf(&o, v1.EventTypeNormal, "JobCreated", "Created job '%s'", job.Name)
+		return ctrl.Result{}, nil
+	} else if err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to get job: %w", err)
+	}
+
+	// Mirror the job's progress into the run
+	var jobCondition *batchv1.JobCondition
+	for i, c := range job.Status.Conditions {
+		if (c.Type == batchv1.JobComplete || c.Type == batchv1.JobFailed) && c.Status == v1.ConditionTrue {
+			jobCondition = &job.Status.Conditions[i]
+		}
+	}
+	if jobCondition == nil {
+		if job.Status.StartTime != nil && o.Status.StartTime == nil {
+			markCommandRunStarted(&o, job.Status.StartTime.Time)
+			if err := r.Client.Status().Update(ctx, &o); err != nil {
+				return ctrl.Result{}, fmt.Errorf("failed to update CommandRun status: %w", err)
+			}
+		}
+		return ctrl.Result{}, nil
+	}
+
+	// Mirror the job's outcome into the run, once it finished
+	pod, err := r.findJobPod(ctx, &job)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if jobCondition.Type == batchv1.JobComplete {
+		o.Status.ExitCode = 0
+	} else {
+		o.Status.ExitCode = 1
+		o.Status.Error = jobCondition.Message
+	}
+	if pod != nil {
+		container, exitCode := commandRunJobExitCode(pod)
+		if jobCondition.Type == batchv1.JobFailed && exitCode != 0 {
+			o.Status.ExitCode = exitCode
+		}
+		if output, err := r.fetchLogs(ctx, pod, container); err != nil {
+			o.Status.Error = strings.TrimSpace(o.Status.Error + "\n" + err.Error())
+		} else {
+			o.Status.Output = output
+		}
+	}
+	if o.Status.StartTime == nil && job.Status.StartTime != nil {
+		markCommandRunStarted(&o, job.Status.StartTime.Time)
+	}
+	completionTime := jobCondition.LastTransitionTime.Time
+	if job.Status.CompletionTime != nil {
+		completionTime = job.Status.CompletionTime.Time
+	} else if completionTime.IsZero() {
+		completionTime = time.Now()
+	}
+	reason := jobCondition.Reason
+	if reason == "DeadlineExceeded" {
+		reason = reasonTimedOutCommandRun
+	}
+	markCommandRunFinished(&o, reason, jobCondition.Message, completionTime)
+	if err := r.Client.Status().Update(ctx, &o); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to update CommandRun status: %w", err)
+	}
+	return ctrl.Result{Requeue: true}, nil
+}
+
+// collectGarbage deletes the given finished run once its TTL expired, unless it's the latest run of its owner (which
+// its owner relies on to tell whether it's up-to-date).
+func (r *CommandRunReconciler) collectGarbage(ctx context.Context, o *v1alpha1.CommandRun) (ctrl.Result, error) {
+	if o.Spec.TTLSecondsAfterFinished == nil || o.Status.CompletionTime == nil {
+		return ctrl.Result{}, nil
+	}
+	expiry := o.Status.CompletionTime.Add(time.Duration(*o.Spec.TTLSecondsAfterFinished) * time.Second)
+	if remaining := time.Until(expiry); remaining > 0 {
+		return ctrl.Result{RequeueAfter: remaining}, nil
+	}
+
+	if owner := metav1.GetControllerOf(o); owner != nil {
+		runs := &v1alpha1.CommandRunList{}
+		if err := r.Client.List(ctx, runs, client.InNamespace(o.Namespace)); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to list command runs: %w", err)
+		}
+		for _, run := range runs.Items {
+			if ref := metav1.GetControllerOf(&run); ref != nil && ref.UID == owner.UID && isCommandRunNewer(&run, o) {
+				return r.delete(ctx, o)
+			}
+		}
+		// This is the latest run of its owner; we'll be notified when a newer run is created by its owner
+		return ctrl.Result{}, nil
+	}
+	return r.delete(ctx, o)
+}
+
+// delete deletes the given run.
+func (r *CommandRunReconciler) delete(ctx context.Context, o *v1alpha1.CommandRun) (ctrl.Result, error) {
+	if err := r.Client.Delete(ctx, o, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(fmt.Errorf("failed to delete expired command run: %w", err))
+	}
+	return ctrl.Result{}, nil
+}
+
+// findJobPod returns the most recently created pod of the given job, if any.
+func (r *CommandRunReconciler) findJobPod(ctx context.Context, job *batchv1.Job) (*v1.Pod, error) {
+	pods := &v1.PodList{}
+	if err := r.Client.List(ctx, pods, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name}); err != nil {
+		return nil, fmt.Errorf("failed to list pods of job '%s': %w", job.Name, err)
+	} else if len(pods.Items) == 0 {
+		return nil, nil
+	}
+	sort.Slice(pods.Items, func(i, j int) bool {
+		return pods.Items[i].CreationTimestamp.Before(&pods.Items[j].CreationTimestamp)
+	})
+	return &pods.Items[len(pods.Items)-1], nil
+}
+
+// fetchLogs returns the trailing logs of the given container in the given pod.
+func (r *CommandRunReconciler) fetchLogs(ctx context.Context, pod *v1.Pod, container string) (string, error) {
+	logs, err := r.Clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &v1.PodLogOptions{
+		Container: container,
+		TailLines: pointer.Int64(commandRunJobLogLines),
+	}).DoRaw(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch logs of pod '%s': %w", pod.Name, err)
+	}
+	return string(logs), nil
+}
+
+// commandRunJobExitCode returns the container that determined the outcome of the given job pod, and its exit code; a
+// failing fetch init container takes precedence over the command container.
+func commandRunJobExitCode(pod *v1.Pod) (string, int) {
+	for _, s := range pod.Status.InitContainerStatuses {
+		if s.Name == commandRunJobFetcher && s.State.Terminated != nil && s.State.Terminated.ExitCode != 0 {
+			return s.Name, int(s.State.Terminated.ExitCode)
+		}
+	}
+	for _, s := range pod.Status.ContainerStatuses {
+		if s.Name == commandRunJobContainer && s.State.Terminated != nil {
+			return s.Name, int(s.State.Terminated.ExitCode)
+		}
+	}
+	return commandRunJobContainer, 0
+}
+
+// newCommandRunJob creates the Job executing the given run: an init container fetches the run's commit into a shared
+// workspace, and the main container runs the command against the files in it. The run's timeout is enforced as the
+// Job's active deadline.
+func newCommandRunJob(run *v1alpha1.CommandRun) *batchv1.Job {
+	image := run.Spec.Job.Image
+	if image == "" {
+		image = commandRunJobDefaultImage
+	}
+
+	var activeDeadlineSeconds *int64
+	if run.Spec.Timeout != nil && run.Spec.Timeout.Duration > 0 {
+		activeDeadlineSeconds = pointer.Int64(int64(math.Ceil(run.Spec.Timeout.Seconds())))
+	}
+
+	volumes := []v1.Volume{{Name: "workspace", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}}}
+	fetchMounts := []v1.VolumeMount{{Name: "workspace", MountPath: "/workspace"}}
+	if run.Spec.RepositorySecretRef != nil && run.Spec.RepositorySecretRef.Name != "" {
+		volumes = append(volumes, v1.Volume{
+			Name:         "credentials",
+			VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{SecretName: run.Spec.RepositorySecretRef.Name}},
+		})
+		fetchMounts = append(fetchMounts, v1.VolumeMount{Name: "credentials", MountPath: "/credentials", ReadOnly: true})
+	}
+	env := []v1.EnvVar{{Name: "NAMESPACE", Value: run.Namespace}}
+	mounts := []v1.VolumeMount{{Name: "workspace", MountPath: "/workspace", ReadOnly: true}}
+	if run.Spec.KubeConfig != nil {
+		volumes = append(volumes, v1.Volume{
+			Name:         "kubeconfig",
+			VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{SecretName: run.Spec.KubeConfig.SecretRef.Name}},
+		})
+		env = append(env, v1.EnvVar{Name: "KUBECONFIG", Value: "/kubeconfig/" + kubeConfigKey(run.Spec.KubeConfig)})
+		mounts = append(mounts, v1.VolumeMount{Name: "kubeconfig", MountPath: "/kubeconfig", ReadOnly: true})
+	}
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      run.Name,
+			Namespace: run.Namespace,
+			Labels:    run.Labels,
+		},
+		Spec: batchv1.JobSpec{
+			ActiveDeadlineSeconds: activeDeadlineSeconds,
+			BackoffLimit:          pointer.Int32(0), // Retries are handled by the bundle, with a new run
+			Template: v1.PodTemplateSpec{
+				Spec: v1.PodSpec{
+					RestartPolicy:      v1.RestartPolicyNever,
+					ServiceAccountName: run.Spec.Job.ServiceAccountName,
+					InitContainers: []v1.Container{{
+						Name:    commandRunJobFetcher,
+						Image:   commandRunJobFetchImage,
+						Command: []string{"sh", "-c", commandRunJobFetchScript},
+						Env: []v1.EnvVar{
+							{Name: "HOME", Value: "/tmp"},
+							{Name: "REPOSITORY_URL", Value: run.Spec.RepositoryURL},
+							{Name: "COMMIT_SHA", Value: run.Spec.CommitSHA},
+						},
+						Resources:    run.Spec.Job.Resources,
+						VolumeMounts: fetchMounts,
+					}},
+					Containers: []v1.Container{{
+						Name:         commandRunJobContainer,
+						Image:        image,
+						Command:      append([]string{"sh", "-c", commandRunJobCommandScript, "kubectl-run", run.Spec.Command}, run.Spec.Args...),
+						Env:          env,
+						Resources:    run.Spec.Job.Resources,
+						VolumeMounts: mounts,
+					}},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+}
+
+// isCommandRunNewer checks whether run a was created after run b. Creation timestamps only have a precision of seconds,
+// so runs created within the same second are ordered by the creation time recorded in their annotation, if any.
+func isCommandRunNewer(a, b *v1alpha1.CommandRun) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return b.CreationTimestamp.Before(&a.CreationTimestamp)
+	}
+	return a.Annotations[annotationCommandRunCreatedAt] > b.Annotations[annotationCommandRunCreatedAt]
+}
+
+// isCommandRunFinished checks whether the given run finished, successfully or not.
+func isCommandRunFinished(run *v1alpha1.CommandRun) bool {
+	return meta.IsStatusConditionTrue(run.Status.Conditions, typeSucceededCommandRun) || meta.IsStatusConditionTrue(run.Status.Conditions, typeFailedCommandRun)
+}
+
+// isCommandRunInterrupted checks whether the given run failed because its command was terminated before finishing.
+func isCommandRunInterrupted(run *v1alpha1.CommandRun) bool {
+	c := meta.FindStatusCondition(run.Status.Conditions, typeFailedCommandRun)
+	return c != nil && c.Status == metav1.ConditionTrue && c.Reason == reasonInterruptedCommandRun
+}
+
+// setCommandRunPhase sets the condition of the given lifecycle phase to "True", and the conditions of all other phases
+// to "False".
+func setCommandRunPhase(run *v1alpha1.CommandRun, phase, reason, message string) {
+	for _, conditionType := range []string{typePendingCommandRun, typeRunningCommandRun, typeSucceededCommandRun, typeFailedCommandRun} {
+		condition := metav1.Condition{Type: conditionType, Status: metav1.ConditionFalse, Reason: phase}
+		if conditionType == phase {
+			condition.Status = metav1.ConditionTrue
+			condition.Reason = reason
+			condition.Message = message
+		}
+		meta.SetStatusCondition(&run.Status.Conditions, condition)
+	}
+}
+
+// markCommandRunStarted moves the given run to the "Running" phase, recording the given start time.
+func markCommandRunStarted(run *v1alpha1.CommandRun, startTime time.Time) {
+	run.Status.StartTime = &metav1.Time{Time: startTime}
+	setCommandRunPhase(run, typeRunningCommandRun, "Started", "")
+}
+
+// markCommandRunFinished moves the given run to the "Succeeded" or "Failed" phase according to its exit code, recording
+// the given completion time & the run's duration.
+func markCommandRunFinished(run *v1alpha1.CommandRun, reason, message string, completionTime time.Time) {
+	if run.Status.StartTime == nil {
+		run.Status.StartTime = &metav1.Time{Time: completionTime}
+	}
+	run.Status.CompletionTime = &metav1.Time{Time: completionTime}
+	run.Status.Duration = &metav1.Duration{Duration: completionTime.Sub(run.Status.StartTime.Time)}
+
+	phase := typeSucceededCommandRun
+	if run.Status.ExitCode != 0 {
+		phase = typeFailedCommandRun
+	}
+	if reason == "" {
+		reason = phase
+	}
+	setCommandRunPhase(run, phase, reason, message)
+}
+
+// findSiblingsOfCommandRun returns the other runs created by the owner of the given run, so the previously latest run
+// can be garbage collected once a newer run is created.
+func (r *CommandRunReconciler) findSiblingsOfCommandRun(o client.Object) []reconcile.Request {
+	owner := metav1.GetControllerOf(o)
+	if owner == nil {
+		return []reconcile.Request{}
+	}
+
+	runs := &v1alpha1.CommandRunList{}
+	if err := r.Client.List(context.TODO(), runs, client.InNamespace(o.GetNamespace())); err != nil {
+		ctrl.Log.Error(err, "Failed listing command runs", "namespace", o.GetNamespace())
+		return []reconcile.Request{}
+	}
+
+	var requests []reconcile.Request
+	for _, run := range runs.Items {
+		if ref := metav1.GetControllerOf(&run); ref != nil && ref.UID == owner.UID && run.UID != o.GetUID() {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{
+					Name:      run.GetName(),
+					Namespace: run.GetNamespace(),
+				},
+			})
+		}
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *CommandRunReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.Client = mgr.GetClient()
+	r.Scheme = mgr.GetScheme()
+	r.Recorder = mgr.GetEventRecorderFor("commandrun")
+	if r.Clientset == nil {
+		clientset, err := kubernetes.NewForConfig(mgr.GetConfig())
+		if err != nil {
+			return fmt.Errorf("failed to create clientset: %w", err)
+		}
+		r.Clientset = clientset
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1alpha1.CommandRun{}).
+		Owns(&batchv1.Job{}).
+		Watches(
+			&source.Kind{Type: &v1alpha1.CommandRun{}},
+			handler.EnqueueRequestsFromMapFunc(r.findSiblingsOfCommandRun),
+			builder.WithPredicates(predicate.Funcs{
+				CreateFunc:  func(event.CreateEvent) bool { return true },
+				UpdateFunc:  func(event.UpdateEvent) bool { return false },
+				DeleteFunc:  func(event.DeleteEvent) bool { return false },
+				GenericFunc: func(event.GenericEvent) bool { return false },
+			}),
+		).
+		Complete(r)
+}
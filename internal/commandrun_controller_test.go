@@ -0,0 +1,247 @@
+package internal
+
+import (
+	"context"
+	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+	"github.com/arikkfir/kude-controller/test/gittest"
+	"github.com/arikkfir/kude-controller/test/harness"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/utils/pointer"
+	"os"
+	"reflect"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"testing"
+	"time"
+)
+
+func TestIgnoreMissingCommandRunResource(t *testing.T) {
+	reconciler := &CommandRunReconciler{}
+	_, _, _ = harness.SetupTestEnv(t, reconciler)
+
+	time.Sleep(5 * time.Second) // Give manager and cache time to start; needed since we're directly invoking controller
+	res, err := reconciler.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: types.NamespacedName{
+			Namespace: "ns1",
+			Name:      "r1",
+		},
+	})
+	assert.NoErrorf(t, err, "expected reconciliation for missing resource NOT to fail")
+	assert.Falsef(t, res.Requeue, "expected reconciliation for missing resource NOT to request requeuing, got: %+v", res)
+}
+
+func TestCommandRunJob(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("cm1.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\ndata:\n  key: value1\n"), "failed to commit file")
+	sha, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount}, &CommandRunReconciler{})
+	createBundleServiceAccount(t, k8sClient, "default")
+	ctx := context.Background()
+	repo := &v1alpha1.GitRepository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.GitRepository{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "repo1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.GitRepositorySpec{
+			URL:             repository.URL.String(),
+			Ref:             "refs/heads/main",
+			PollingInterval: "1s",
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, repo), "repository creation failed")
+	resources := corev1.ResourceRequirements{Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("64Mi")}}
+	bundle := &v1alpha1.KubectlBundle{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.KubectlBundle{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bundle1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.KubectlBundleSpec{
+			DriftDetectionInterval: "1h",
+			SourceRepository:       repo.Namespace + "/" + repo.Name,
+			Files:                  []string{"*.yaml"},
+			Timeout:                "90s",
+			Job: &v1alpha1.CommandRunJob{
+				Image:              "kubectl:test",
+				ServiceAccountName: "deployer",
+				Resources:          resources,
+			},
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, bundle), "bundle creation failed")
+
+	// A job should be created for the run, instead of applying the files in-process
+	var run *v1alpha1.CommandRun
+	var job batchv1.Job
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		run = findKubectlBundleRun(c, k8sClient, bundle, sha)
+		if run == nil {
+			return
+		}
+		assert.Equal(c, repository.URL.String(), run.Spec.RepositoryURL, "incorrect repository URL")
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(run), &job), "job lookup failed") {
+			assert.Equal(c, pointer.Int64(90), job.Spec.ActiveDeadlineSeconds, "incorrect active deadline")
+			spec := job.Spec.Template.Spec
+			assert.Equal(c, "deployer", spec.ServiceAccountName, "incorrect service account")
+			if assert.Len(c, spec.InitContainers, 1, "incorrect init containers") {
+				assert.Contains(c, spec.InitContainers[0].Env, corev1.EnvVar{Name: "COMMIT_SHA", Value: sha}, "incorrect commit SHA")
+			}
+			if assert.Len(c, spec.Containers, 1, "incorrect containers") {
+				assert.Equal(c, "kubectl:test", spec.Containers[0].Image, "incorrect image")
+				assert.Equal(c, resources, spec.Containers[0].Resources, "incorrect resources")
+				assert.Equal(c, []string{"apply", "*.yaml"}, spec.Containers[0].Command[len(spec.Containers[0].Command)-2:], "incorrect command")
+			}
+		}
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			cUpToDate := meta.FindStatusCondition(b.Status.Conditions, typeUpToDateKubectlBundle)
+			if assert.NotNil(c, cUpToDate, "uptodate condition not found") {
+				assert.Equal(c, "Running", cUpToDate.Reason, "incorrect reason")
+			}
+		}
+	}, 15*time.Second, 1*time.Second, "job not created correctly")
+	var cm corev1.ConfigMap
+	assert.True(t, apierrors.IsNotFound(k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "cm1"}, &cm)), "config map should not be applied in-process")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.CommandRun
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(run), &r), "run lookup failed") {
+			assert.True(c, meta.IsStatusConditionTrue(r.Status.Conditions, typePendingCommandRun), "run not pending")
+		}
+	}, 10*time.Second, 1*time.Second, "run not pending")
+
+	// Simulate the job starting (envtest does not run jobs)
+	startTime := metav1.NewTime(time.Now().Add(-5 * time.Second).Truncate(time.Second))
+	job.Status.StartTime = &startTime
+	require.NoErrorf(t, k8sClient.Status().Update(ctx, &job), "job status update failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.CommandRun
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(run), &r), "run lookup failed") {
+			assert.True(c, meta.IsStatusConditionTrue(r.Status.Conditions, typeRunningCommandRun), "run not running")
+			assert.False(c, meta.IsStatusConditionTrue(r.Status.Conditions, typePendingCommandRun), "run still pending")
+			if assert.NotNil(c, r.Status.StartTime, "start time not set") {
+				assert.True(c, startTime.Equal(r.Status.StartTime), "incorrect start time")
+			}
+		}
+	}, 10*time.Second, 1*time.Second, "run not running")
+
+	// Simulate the job's pod failing (envtest does not run pods)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: job.Name + "-pod", Namespace: job.Namespace, Labels: map[string]string{"job-name": job.Name}},
+		Spec:       *job.Spec.Template.Spec.DeepCopy(),
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, pod), "pod creation failed")
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+		Name:  commandRunJobContainer,
+		State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 3}},
+	}}
+	require.NoErrorf(t, k8sClient.Status().Update(ctx, pod), "pod status update failed")
+	job.Status.Conditions = append(job.Status.Conditions, batchv1.JobCondition{
+		Type:    batchv1.JobFailed,
+		Status:  corev1.ConditionTrue,
+		Reason:  "BackoffLimitExceeded",
+		Message: "Job has reached the specified backoff limit",
+	})
+	require.NoErrorf(t, k8sClient.Status().Update(ctx, &job), "job status update failed")
+
+	// The job's outcome should be mirrored into the run, and the bundle should be marked as failed
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.CommandRun
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(run), &r), "run lookup failed") {
+			assert.Equal(c, 3, r.Status.ExitCode, "incorrect exit code")
+			assert.Contains(c, r.Status.Error, "Job has reached the specified backoff limit", "incorrect error")
+			assert.NotNil(c, r.Status.CompletionTime, "completion time not set")
+			assert.NotNil(c, r.Status.Duration, "duration not set")
+			cFailed := meta.FindStatusCondition(r.Status.Conditions, typeFailedCommandRun)
+			if assert.NotNil(c, cFailed, "failed condition not found") {
+				assert.Equal(c, metav1.ConditionTrue, cFailed.Status, "incorrect status")
+				assert.Equal(c, "BackoffLimitExceeded", cFailed.Reason, "incorrect reason")
+			}
+		}
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			cUpToDate := meta.FindStatusCondition(b.Status.Conditions, typeUpToDateKubectlBundle)
+			if assert.NotNil(c, cUpToDate, "uptodate condition not found") {
+				assert.Equal(c, metav1.ConditionFalse, cUpToDate.Status, "incorrect status")
+				assert.Equal(c, "Failed", cUpToDate.Reason, "incorrect reason")
+			}
+		}
+	}, 15*time.Second, 1*time.Second, "job outcome not mirrored correctly")
+}
+
+func TestCommandRunLifecycleAndGarbageCollection(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("cm1.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\ndata:\n  key: value1\n"), "failed to commit file")
+	sha1, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount}, &CommandRunReconciler{})
+	createBundleServiceAccount(t, k8sClient, "default")
+	bundle := createKubectlBundleWithRepository(t, k8sClient, repository, false, "*.yaml")
+	ctx := context.Background()
+	require.NoErrorf(t, retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var b v1alpha1.KubectlBundle
+		if err := k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b); err != nil {
+			return err
+		}
+		b.Spec.RunsTTLSecondsAfterFinished = pointer.Int32(1)
+		return k8sClient.Update(ctx, &b)
+	}), "bundle update failed")
+
+	// Runs should go through their lifecycle, recording their timing
+	var run1 *v1alpha1.CommandRun
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		run1 = findKubectlBundleRun(c, k8sClient, bundle, sha1)
+		if run1 != nil {
+			assert.True(c, meta.IsStatusConditionTrue(run1.Status.Conditions, typeSucceededCommandRun), "run not succeeded")
+			for _, conditionType := range []string{typePendingCommandRun, typeRunningCommandRun, typeFailedCommandRun} {
+				assert.True(c, meta.IsStatusConditionFalse(run1.Status.Conditions, conditionType), "incorrect '%s' condition", conditionType)
+			}
+			assert.NotNil(c, run1.Status.StartTime, "start time not set")
+			assert.NotNil(c, run1.Status.CompletionTime, "completion time not set")
+			assert.NotNil(c, run1.Status.Duration, "duration not set")
+		}
+	}, 15*time.Second, 1*time.Second, "run lifecycle not recorded correctly")
+
+	// The latest run is retained even though its TTL expired
+	time.Sleep(3 * time.Second)
+	var r v1alpha1.CommandRun
+	require.NoErrorf(t, k8sClient.Get(ctx, client.ObjectKeyFromObject(run1), &r), "latest run should be retained")
+
+	// Once a newer run exists, the expired run should be deleted
+	require.NoErrorf(t, repository.CommitFile("cm1.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\ndata:\n  key: value2\n"), "failed to commit file")
+	sha2, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		assert.NotNil(c, findKubectlBundleRun(c, k8sClient, bundle, sha2), "new run not found")
+		var r v1alpha1.CommandRun
+		assert.True(c, apierrors.IsNotFound(k8sClient.Get(ctx, client.ObjectKeyFromObject(run1), &r)), "expired run not deleted")
+	}, 20*time.Second, 1*time.Second, "expired run not garbage collected")
+}
@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"filippo.io/age"
+	agearmor "filippo.io/age/armor"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgparmor "github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/aes"
+	"go.mozilla.org/sops/v3/keyservice"
+	sopsyaml "go.mozilla.org/sops/v3/stores/yaml"
+	"google.golang.org/grpc"
+	"io"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+	"time"
+)
+
+const (
+	reasonDecryptionFailed = "DecryptionFailed"                               // Reason of bundles whose decryption keys cannot be loaded
+	ageKeySuffix           = ".agekey"                                        // Suffix of decryption Secret keys holding age identities
+	pgpKeySuffix           = ".asc"                                           // Suffix of decryption Secret keys holding armored PGP private keys
+	redactedError          = "error redacted, since the object was decrypted" // Error reported for decrypted objects
+)
+
+// decryptor decrypts SOPS-encrypted manifests using in-memory age & PGP private keys, and tracks the objects it
+// decrypted so that their details are never reported. It also serves as the SOPS key service, decrypting the data keys
+// of encrypted files.
+type decryptor struct {
+	ageIdentities []age.Identity     // Age identities to decrypt with
+	pgpKeyRing    openpgp.EntityList // PGP private keys to decrypt with
+	namespace     string             // Namespace that decrypted objects without a namespace are applied to
+	decrypted     map[string]bool    // Objects decrypted so far, by inventory key (see inventoryKey)
+}
+
+// newDecryptor creates a decryptor using the private keys in the Secret referenced by the given decryption config (in
+// the given namespace), or returns nil when no decryption config is given, leaving files as-is.
+func newDecryptor(ctx context.Context, c client.Reader, namespace string, decryption *v1alpha1.Decryption) (*decryptor, error) {
+	if decryption == nil {
+		return nil, nil
+	}
+
+	var secret v1.Secret
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: decryption.SecretRef.Name}, &secret); err != nil {
+		return nil, fmt.Errorf("failed to get decryption secret '%s/%s': %w", namespace, decryption.SecretRef.Name, err)
+	}
+
+	d := &decryptor{namespace: namespace, decrypted: make(map[string]bool)}
+	for name, value := range secret.Data {
+		switch {
+		case strings.HasSuffix(name, ageKeySuffix):
+			identities, err := age.ParseIdentities(bytes.NewReader(value))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse age identities in key '%s' of secret '%s/%s': %w", name, namespace, secret.Name, err)
+			}
+			d.ageIdentities = append(d.ageIdentities, identities...)
+		case strings.HasSuffix(name, pgpKeySuffix):
+			entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(value))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse PGP keys in key '%s' of secret '%s/%s': %w", name, namespace, secret.Name, err)
+			}
+			d.pgpKeyRing = append(d.pgpKeyRing, entities...)
+		}
+	}
+	if len(d.ageIdentities) == 0 && len(d.pgpKeyRing) == 0 {
+		return nil, fmt.Errorf("no keys found in decryption secret '%s/%s' (expected keys ending with '%s' or '%s')", namespace, secret.Name, ageKeySuffix, pgpKeySuffix)
+	}
+	return d, nil
+}
+
+// decrypt decrypts the given data if it's a SOPS-encrypted YAML (or JSON) file, verifying its integrity; other data is
+// returned as-is.
+func (d *decryptor) decrypt(data []byte) ([]byte, error) {
+	if d == nil {
+		return data, nil
+	}
+
+	store := &sopsyaml.Store{}
+	tree, err := store.LoadEncryptedFile(data)
+	if errors.Is(err, sops.MetadataNotFound) {
+		return data, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to load encrypted file: %w", err)
+	}
+
+	key, err := tree.Metadata.GetDataKeyWithKeyServices([]keyservice.KeyServiceClient{d})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+	cipher := aes.NewCipher()
+	mac, err := tree.Decrypt(key, cipher)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt file: %w", err)
+	}
+	originalMac, err := cipher.Decrypt(tree.Metadata.MessageAuthenticationCode, key, tree.Metadata.LastModified.Format(time.RFC3339))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt MAC: %w", err)
+	} else if originalMac != mac {
+		return nil, fmt.Errorf("failed to verify data integrity")
+	}
+
+	plain, err := store.EmitPlainFile(tree.Branches)
+	if err != nil {
+		return nil, fmt.Errorf("failed to emit decrypted file: %w", err)
+	}
+	objects, err := decodeManifests(bytes.NewReader(plain))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse decrypted file: %w", err)
+	}
+	for _, obj := range objects {
+		// Objects without a namespace are applied to the bundle's namespace if namespaced, or as-is if cluster-scoped,
+		// and the namespace of cluster-scoped objects is ignored; since a kind is either namespaced or cluster-scoped,
+		// tracking these objects under both namespaces matches their results either way
+		entry := v1alpha1.InventoryEntry{Group: obj.GroupVersionKind().Group, Kind: obj.GetKind(), Namespace: obj.GetNamespace(), Name: obj.GetName()}
+		if entry.Namespace == "" {
+			entry.Namespace = d.namespace
+		}
+		d.decrypted[inventoryKey(entry)] = true
+		entry.Namespace = ""
+		d.decrypted[inventoryKey(entry)] = true
+	}
+	return plain, nil
+}
+
+// Encrypt fails, since the decryptor never encrypts data keys.
+func (d *decryptor) Encrypt(context.Context, *keyservice.EncryptRequest, ...grpc.CallOption) (*keyservice.EncryptResponse, error) {
+	return nil, fmt.Errorf("encryption is not supported")
+}
+
+// Decrypt decrypts the given SOPS data key, using the age identities or PGP private keys of the decryptor.
+func (d *decryptor) Decrypt(_ context.Context, req *keyservice.DecryptRequest, _ ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	var r io.Reader
+	switch req.Key.KeyType.(type) {
+	case *keyservice.Key_AgeKey:
+		if len(d.ageIdentities) == 0 {
+			return nil, fmt.Errorf("no age identities available")
+		}
+		var err error
+		if r, err = age.Decrypt(agearmor.NewReader(bytes.NewReader(req.Ciphertext)), d.ageIdentities...); err != nil {
+			return nil, fmt.Errorf("failed to decrypt with age: %w", err)
+		}
+	case *keyservice.Key_PgpKey:
+		if len(d.pgpKeyRing) == 0 {
+			return nil, fmt.Errorf("no PGP keys available")
+		}
+		block, err := pgparmor.Decode(bytes.NewReader(req.Ciphertext))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode PGP message: %w", err)
+		}
+		md, err := openpgp.ReadMessage(block.Body, d.pgpKeyRing, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt with PGP: %w", err)
+		}
+		r = md.UnverifiedBody
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", req.Key.KeyType)
+	}
+
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read decrypted data key: %w", err)
+	}
+	return &keyservice.DecryptResponse{Plaintext: plaintext}, nil
+}
+
+// redact removes the error details & the diffed values of the given results of decrypted objects, since they may
+// contain decrypted values.
+func (d *decryptor) redact(results []v1alpha1.ObjectResult) {
+	if d == nil {
+		return
+	}
+	for i := range results {
+		if !d.decrypted[inventoryKey(inventoryEntryFor(results[i]))] {
+			continue
+		}
+		if results[i].Error != "" {
+			results[i].Error = redactedError
+		}
+		for j := range results[i].Diff {
+			if results[i].Diff[j].Live != "" {
+				results[i].Diff[j].Live = jsonValue(maskedValue)
+			}
+			if results[i].Diff[j].Desired != "" {
+				results[i].Diff[j].Desired = jsonValue(maskedValue)
+			}
+		}
+	}
+}
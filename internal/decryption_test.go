@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/aes"
+	sopsage "go.mozilla.org/sops/v3/age"
+	"go.mozilla.org/sops/v3/keyservice"
+	sopsyaml "go.mozilla.org/sops/v3/stores/yaml"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sopsEncrypt encrypts the "data" & "stringData" values of the given YAML with SOPS, for the given age recipient.
+func sopsEncrypt(t *testing.T, plain string, recipient string) string {
+	store := &sopsyaml.Store{}
+	branches, err := store.LoadPlainFile([]byte(plain))
+	require.NoError(t, err, "failed to load plain file")
+	keys, err := sopsage.MasterKeysFromRecipients(recipient)
+	require.NoError(t, err, "failed to create age master keys")
+	var group sops.KeyGroup
+	for _, key := range keys {
+		group = append(group, key)
+	}
+	tree := sops.Tree{
+		Branches: branches,
+		Metadata: sops.Metadata{KeyGroups: []sops.KeyGroup{group}, EncryptedRegex: "^(data|stringData)$", Version: "3.7.3"},
+	}
+	dataKey, errs := tree.GenerateDataKeyWithKeyServices([]keyservice.KeyServiceClient{keyservice.NewLocalClient()})
+	require.Empty(t, errs, "failed to generate data key")
+
+	cipher := aes.NewCipher()
+	mac, err := tree.Encrypt(dataKey, cipher)
+	require.NoError(t, err, "failed to encrypt tree")
+	tree.Metadata.LastModified = time.Now().UTC()
+	tree.Metadata.MessageAuthenticationCode, err = cipher.Encrypt(mac, dataKey, tree.Metadata.LastModified.Format(time.RFC3339))
+	require.NoError(t, err, "failed to encrypt MAC")
+	encrypted, err := store.EmitEncryptedFile(tree)
+	require.NoError(t, err, "failed to emit encrypted file")
+	return string(encrypted)
+}
+
+func TestDecryptorAge(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err, "failed to generate age identity")
+	encrypted := sopsEncrypt(t, "apiVersion: v1\nkind: Secret\nmetadata:\n  name: secret1\nstringData:\n  password: s3cr3t\n", identity.Recipient().String())
+	require.NotContains(t, encrypted, "s3cr3t", "secret should be encrypted")
+
+	d := &decryptor{ageIdentities: []age.Identity{identity}, namespace: "default", decrypted: make(map[string]bool)}
+	decrypted, err := d.decrypt([]byte(encrypted))
+	require.NoError(t, err, "decryption failed")
+	objects, err := decodeManifests(bytes.NewReader(decrypted))
+	require.NoError(t, err, "failed to parse decrypted file")
+	if assert.Len(t, objects, 1, "incorrect objects") {
+		assert.Equal(t, map[string]interface{}{"password": "s3cr3t"}, objects[0].Object["stringData"], "incorrect decrypted data")
+	}
+
+	plain := []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\n")
+	result, err := d.decrypt(plain)
+	require.NoError(t, err, "plain file decryption failed")
+	assert.Equal(t, plain, result, "plain file should be returned as-is")
+
+	results := []v1alpha1.ObjectResult{
+		{APIVersion: "v1", Kind: "Secret", Namespace: "default", Name: "secret1", Action: applyActionFailed, Error: "invalid value: s3cr3t"},
+		{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "cm1", Action: applyActionFailed, Error: "invalid value: plain"},
+		{APIVersion: "v1", Kind: "Secret", Namespace: "other", Name: "secret1", Action: applyActionFailed, Error: "invalid value: other"},
+	}
+	d.redact(results)
+	assert.Equal(t, redactedError, results[0].Error, "error of decrypted object should be redacted")
+	assert.Equal(t, "invalid value: plain", results[1].Error, "error of plain object should be kept")
+	assert.Equal(t, "invalid value: other", results[2].Error, "error of plain object in another namespace should be kept")
+
+	tampered := strings.Replace(encrypted, "name: secret1", "name: secret2", 1)
+	_, err = d.decrypt([]byte(tampered))
+	assert.EqualError(t, err, "failed to verify data integrity", "tampered file should fail verification")
+
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err, "failed to generate age identity")
+	_, err = (&decryptor{ageIdentities: []age.Identity{other}, decrypted: make(map[string]bool)}).decrypt([]byte(encrypted))
+	assert.ErrorContains(t, err, "failed to decrypt data key", "decryption with the wrong identity should fail")
+}
+
+func TestDecryptorPGP(t *testing.T) {
+	entity, err := openpgp.NewEntity("test", "", "test@example.com", nil)
+	require.NoError(t, err, "failed to generate PGP key")
+	var ciphertext bytes.Buffer
+	armored, err := armor.Encode(&ciphertext, "PGP MESSAGE", nil)
+	require.NoError(t, err, "failed to create armor encoder")
+	w, err := openpgp.Encrypt(armored, openpgp.EntityList{entity}, nil, nil, nil)
+	require.NoError(t, err, "failed to create PGP encrypter")
+	_, err = w.Write([]byte("data-key"))
+	require.NoError(t, err, "failed to encrypt data key")
+	require.NoError(t, w.Close(), "failed to encrypt data key")
+	require.NoError(t, armored.Close(), "failed to armor data key")
+
+	d := &decryptor{pgpKeyRing: openpgp.EntityList{entity}, decrypted: make(map[string]bool)}
+	resp, err := d.Decrypt(context.Background(), &keyservice.DecryptRequest{
+		Key:        &keyservice.Key{KeyType: &keyservice.Key_PgpKey{PgpKey: &keyservice.PgpKey{Fingerprint: "test"}}},
+		Ciphertext: ciphertext.Bytes(),
+	})
+	require.NoError(t, err, "data key decryption failed")
+	assert.Equal(t, "data-key", string(resp.Plaintext), "incorrect data key")
+}
@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// validateSparsePaths verifies that the given sparse-checkout paths are relative paths inside the repository.
+func validateSparsePaths(paths []string) error {
+	for _, p := range paths {
+		if cleaned := cleanSparsePath(p); cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") || path.IsAbs(p) {
+			return fmt.Errorf("invalid sparse path '%s': must be a relative path inside the repository", p)
+		}
+	}
+	return nil
+}
+
+// cleanSparsePath normalizes the given sparse-checkout path (e.g. "./deploy/prod/" becomes "deploy/prod").
+func cleanSparsePath(p string) string {
+	return path.Clean(strings.TrimSuffix(p, "/"))
+}
+
+// inSparsePaths checks whether the given file path (relative to the repository root) is one of the given sparse paths,
+// or is inside one of them.
+func inSparsePaths(file string, paths []string) bool {
+	for _, p := range paths {
+		if p = cleanSparsePath(p); file == p || strings.HasPrefix(file, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkout checks out the given commit into the given worktree, detaching HEAD at it; only the files under the given
+// sparse paths are checked out, unless no sparse paths are given.
+func checkout(repository *git.Repository, worktree *git.Worktree, hash plumbing.Hash, sparsePaths []string) error {
+	if len(sparsePaths) == 0 {
+		return worktree.Checkout(&git.CheckoutOptions{Hash: hash, Force: true})
+	}
+	return checkoutSparse(repository, worktree.Filesystem.Root(), hash, sparsePaths)
+}
+
+// checkoutSparse checks out only the files of the given commit that are under the given paths into the work directory
+// of the given repository, removing any other files, and detaches HEAD at the commit. Files whose content is unchanged
+// are left untouched. Unlike a full checkout, the index is not updated.
+func checkoutSparse(repository *git.Repository, dir string, hash plumbing.Hash, paths []string) error {
+	commit, err := repository.CommitObject(hash)
+	if err != nil {
+		return fmt.Errorf("failed to find commit '%s': %w", hash, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return fmt.Errorf("failed to read tree of commit '%s': %w", hash, err)
+	}
+
+	// Collect the files under the sparse paths, rejecting paths that would be written outside the work directory
+	var files []*object.File
+	names := make(map[string]bool)
+	if err := tree.Files().ForEach(func(f *object.File) error {
+		if !inSparsePaths(f.Name, paths) {
+			return nil
+		} else if err := validateTreePath(dir, f.Name); err != nil {
+			return err
+		}
+		files = append(files, f)
+		names[f.Name] = true
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to read files: %w", err)
+	}
+
+	// Remove all other files, and directories left empty; this happens first, so that stale symbolic links (e.g. one
+	// replaced by a directory in this commit) are never followed when writing the files
+	var dirs []string
+	if err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if p == dir {
+			return nil
+		} else if d.Name() == git.GitDirName && filepath.Dir(p) == dir {
+			return filepath.SkipDir
+		} else if d.IsDir() {
+			dirs = append(dirs, p)
+			return nil
+		} else if rel, err := filepath.Rel(dir, p); err != nil {
+			return err
+		} else if !names[filepath.ToSlash(rel)] {
+			return os.Remove(p)
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to remove files outside of sparse paths: %w", err)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if entries, err := os.ReadDir(dirs[i]); err != nil {
+			return fmt.Errorf("failed to read directory '%s': %w", dirs[i], err)
+		} else if len(entries) == 0 {
+			if err := os.Remove(dirs[i]); err != nil {
+				return fmt.Errorf("failed to remove empty directory '%s': %w", dirs[i], err)
+			}
+		}
+	}
+
+	// Write the files under the sparse paths
+	for _, f := range files {
+		if err := writeSparseFile(dir, f); err != nil {
+			return fmt.Errorf("failed to check out files: %w", err)
+		}
+	}
+
+	if err := repository.Storer.SetReference(plumbing.NewHashReference(plumbing.HEAD, hash)); err != nil {
+		return fmt.Errorf("failed to update HEAD: %w", err)
+	}
+	return nil
+}
+
+// validateTreePath verifies that the given file path (relative to the repository root, as found in a commit's tree)
+// is a clean relative path, which stays inside the given work directory (and outside its ".git" directory).
+func validateTreePath(dir, name string) error {
+	invalid := path.Clean(name) != name || path.IsAbs(name)
+	for _, part := range strings.Split(name, "/") {
+		invalid = invalid || part == ".." || strings.EqualFold(part, git.GitDirName)
+	}
+	if rel, err := filepath.Rel(dir, filepath.Join(dir, filepath.FromSlash(name))); invalid || err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("invalid path '%s': must be a relative path inside the repository", name)
+	}
+	return nil
+}
+
+// makeSparseDirs creates the given directory (relative to the given work directory) and its parents, replacing any of
+// them that is not a directory (e.g. a symbolic link) rather than following it.
+func makeSparseDirs(dir, name string) error {
+	current := dir
+	for _, part := range strings.Split(name, "/") {
+		current = filepath.Join(current, part)
+		if info, err := os.Lstat(current); err == nil && info.IsDir() {
+			continue
+		} else if err == nil {
+			if err := os.Remove(current); err != nil {
+				return fmt.Errorf("failed to replace '%s': %w", name, err)
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to stat '%s': %w", name, err)
+		}
+		if err := os.Mkdir(current, 0755); err != nil {
+			return fmt.Errorf("failed to create directory '%s': %w", name, err)
+		}
+	}
+	return nil
+}
+
+// writeSparseFile writes the given Git file into the given work directory, unless it already holds the same content.
+// The file's path must have been validated with validateTreePath.
+func writeSparseFile(dir string, f *object.File) error {
+	target := filepath.Join(dir, filepath.FromSlash(f.Name))
+	if parent := path.Dir(f.Name); parent != "." {
+		if err := makeSparseDirs(dir, parent); err != nil {
+			return err
+		}
+	}
+
+	if f.Mode == filemode.Symlink {
+		linkTarget, err := f.Contents()
+		if err != nil {
+			return fmt.Errorf("failed to read '%s': %w", f.Name, err)
+		} else if current, err := os.Readlink(target); err == nil && current == linkTarget {
+			return nil
+		} else if err := os.RemoveAll(target); err != nil {
+			return fmt.Errorf("failed to replace '%s': %w", f.Name, err)
+		} else if err := os.Symlink(linkTarget, target); err != nil {
+			return fmt.Errorf("failed to create symbolic link '%s': %w", f.Name, err)
+		}
+		return nil
+	}
+
+	perm := os.FileMode(0644)
+	if f.Mode == filemode.Executable {
+		perm = 0755
+	}
+	if info, err := os.Lstat(target); err == nil && info.Mode().IsRegular() && info.Mode().Perm() == perm {
+		if current, err := os.ReadFile(target); err == nil && plumbing.ComputeHash(plumbing.BlobObject, current) == f.Hash {
+			return nil
+		}
+	} else if err == nil {
+		if err := os.RemoveAll(target); err != nil {
+			return fmt.Errorf("failed to replace '%s': %w", f.Name, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to stat '%s': %w", f.Name, err)
+	}
+
+	r, err := f.Reader()
+	if err != nil {
+		return fmt.Errorf("failed to read '%s': %w", f.Name, err)
+	}
+	defer r.Close()
+	w, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("failed to open '%s': %w", f.Name, err)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to write '%s': %w", f.Name, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to write '%s': %w", f.Name, err)
+	}
+	return os.Chmod(target, perm)
+}
@@ -5,18 +5,22 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/record"
 	"os"
 	"path/filepath"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 	"strings"
 	"time"
 
@@ -28,20 +32,26 @@ const (
 	typeAvailableGitRepository = "Available" // Is the GitRepository available for applying by bundles
 	typeClonedGitRepository    = "Cloned"    // Is the GitRepository cloned to the local filesystem
 	typeDegradedGitRepository  = "Degraded"  // When the GitRepository is deleted, but finalizer not applied yet
+	typeSuspendedGitRepository = "Suspended" // Is polling the GitRepository suspended?
+	reasonAuthenticationFailed = "AuthenticationFailed"
 )
 
 // GitRepositoryReconciler reconciles a GitRepository object
 type GitRepositoryReconciler struct {
-	Client   client.Client        // Kubernetes API client
-	Recorder record.EventRecorder // Kubernetes event recorder
-	Scheme   *runtime.Scheme      // Scheme registry
-	WorkDir  string               // Working directory for the controller
+	Client    client.Client             // Kubernetes API client
+	APIReader client.Reader             // Kubernetes API reader, bypassing the cache
+	Recorder  record.EventRecorder      // Kubernetes event recorder
+	Scheme    *runtime.Scheme           // Scheme registry
+	WorkDir   string                    // Working directory for the controller
+	Events    <-chan event.GenericEvent // Optional channel of externally-triggered reconciliations (e.g. webhooks)
+	stores    *objectStores             // Object stores shared by repositories with the same URL
 }
 
 //+kubebuilder:rbac:groups=kude.kfirs.com,resources=gitrepositories,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=kude.kfirs.com,resources=gitrepositories/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=kude.kfirs.com,resources=gitrepositories/finalizers,verbs=update
 //+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
 
 // Reconcile continuously aims to move the current state of [GitRepository] objects closer to their desired state.
 func (r *GitRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -84,6 +94,9 @@ func (r *GitRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 				if err := os.RemoveAll(o.Status.WorkDirectory); err != nil {
 					return ctrl.Result{}, fmt.Errorf("failed to delete local clone: %w", err)
 				}
+				if err := r.removeUnusedStores(ctx); err != nil {
+					return ctrl.Result{}, err
+				}
 				o.Status.WorkDirectory = ""
 				if err := r.Client.Status().Update(ctx, &o); err != nil {
 					return ctrl.Result{}, fmt.Errorf("failed to delete local clone: %w", err)
@@ -106,6 +119,19 @@ func (r *GitRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		return ctrl.Result{}, nil
 	}
 
+	// Skip all work while suspended; we'll be notified when resumed
+	if o.Spec.Suspend {
+		if !meta.IsStatusConditionTrue(o.Status.Conditions, typeSuspendedGitRepository) {
+			r.Recorder.Event(&o, v1.EventTypeNormal, "Suspended", "Reconciliation suspended")
+		}
+		return r.setCondition(ctx, &o, typeSuspendedGitRepository, metav1.ConditionTrue, "Suspended", "Reconciliation is suspended")
+	} else if meta.IsStatusConditionTrue(o.Status.Conditions, typeSuspendedGitRepository) {
+		r.Recorder.Event(&o, v1.EventTypeNormal, "Resumed", "Reconciliation resumed")
+	}
+	if res, err := r.setCondition(ctx, &o, typeSuspendedGitRepository, metav1.ConditionFalse, "NotSuspended", ""); res.Requeue || err != nil {
+		return res, err
+	}
+
 	// Set work path if missing/incorrect
 	if o.Status.WorkDirectory == "" {
 		o.Status.WorkDirectory = filepath.Join(r.WorkDir, string(o.UID))
@@ -129,6 +155,34 @@ func (r *GitRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		return ctrl.Result{Requeue: false}, nil
 	}
 
+	// Validate the reference selection
+	if err := validateRef(o.Spec); err != nil {
+		if _, err := r.setCondition(ctx, &o, typeAvailableGitRepository, metav1.ConditionFalse, "InvalidRef", err.Error()); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{Requeue: false}, nil
+	}
+
+	// Validate the sparse-checkout paths
+	if err := validateSparsePaths(o.Spec.SparsePaths); err != nil {
+		if _, err := r.setCondition(ctx, &o, typeAvailableGitRepository, metav1.ConditionFalse, "InvalidSparsePaths", err.Error()); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{Requeue: false}, nil
+	}
+
+	// Resolve credentials
+	creds, err := r.resolveCredentials(ctx, &o)
+	if err != nil {
+		if res, err := r.setCondition(ctx, &o, typeAvailableGitRepository, metav1.ConditionFalse, reasonAuthenticationFailed, err.Error()); err != nil {
+			return res, err
+		}
+		return ctrl.Result{RequeueAfter: interval}, nil
+	}
+
+	// Use the object store shared by all repositories with the same URL; fetches & checkouts using it are serialized
+	store := r.stores.get(o.Spec.URL, o.Spec.Depth)
+
 	// Clone the repository if it's missing
 	b := bytes.Buffer{}
 	if _, err := os.Stat(o.Status.WorkDirectory); err != nil {
@@ -140,13 +194,17 @@ func (r *GitRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 			if res, err := r.setCondition(ctx, &o, typeClonedGitRepository, metav1.ConditionFalse, "NotCloned", ""); res.Requeue || err != nil {
 				return res, err
 			}
-			if res, err := r.setCondition(ctx, &o, typeAvailableGitRepository, metav1.ConditionFalse, "NotCloned", ""); res.Requeue || err != nil {
-				return res, err
+			// Keep a previous authentication failure visible until a clone succeeds
+			if c := meta.FindStatusCondition(o.Status.Conditions, typeAvailableGitRepository); c.Reason != reasonAuthenticationFailed {
+				if res, err := r.setCondition(ctx, &o, typeAvailableGitRepository, metav1.ConditionFalse, "NotCloned", ""); res.Requeue || err != nil {
+					return res, err
+				}
 			}
 
 			// No clone exists, update status to reflect we have no pulled SHA
-			if o.Status.LastPulledSHA != "" {
+			if o.Status.LastPulledSHA != "" || o.Status.ResolvedRef != "" {
 				o.Status.LastPulledSHA = ""
+				o.Status.ResolvedRef = ""
 				if err := r.Client.Status().Update(ctx, &o); err != nil {
 					return ctrl.Result{}, fmt.Errorf("failed to update GitRepository status: %w", err)
 				} else {
@@ -155,9 +213,20 @@ func (r *GitRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 				}
 			}
 
-			// Clone
-			cloneOptions := git.CloneOptions{URL: o.Spec.URL, ReferenceName: plumbing.ReferenceName(o.Spec.Branch), Progress: &b}
-			if _, err := git.PlainClone(o.Status.WorkDirectory, false, &cloneOptions); err != nil {
+			// Clone: fetch the repository into the shared object store, and create a work directory using its objects
+			if _, _, err := store.fetch(o.Spec, creds, &b); err != nil {
+				r.Recorder.Eventf(&o, v1.EventTypeWarning, "CloneFailed", "Failed to clone repository: %s\n%s", err, b.String())
+
+				// Surface authentication failures on the "Available" condition
+				if isAuthenticationError(err) {
+					if res, err := r.setCondition(ctx, &o, typeAvailableGitRepository, metav1.ConditionFalse, reasonAuthenticationFailed, "Failed to clone repository: "+err.Error()); err != nil {
+						return res, err
+					}
+				}
+
+				// Retry on next tick
+				return ctrl.Result{RequeueAfter: interval}, nil
+			} else if err := store.initWorkDirectory(o.Status.WorkDirectory, o.Spec.URL); err != nil {
 				r.Recorder.Eventf(&o, v1.EventTypeWarning, "CloneFailed", "Failed to clone repository: %s\n%s", err, b.String())
 
 				// Clone failed - remove partial directory (if any)
@@ -187,7 +256,22 @@ func (r *GitRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 			return ctrl.Result{RequeueAfter: interval}, nil
 		}
 
-	} else if repository, err := git.PlainOpen(o.Status.WorkDirectory); err != nil {
+	} else if repository, err := store.openWorkDirectory(o.Status.WorkDirectory); errors.Is(err, errWorkDirectoryNotShared) {
+
+		// Re-create work directories not using the shared object store (e.g. full clones made by older versions)
+		if res, err := r.setCondition(ctx, &o, typeClonedGitRepository, metav1.ConditionUnknown, "CloneNotShared", err.Error()); err != nil {
+			return res, err
+		}
+		if err := os.RemoveAll(o.Status.WorkDirectory); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed deleting clone: %w", err)
+		}
+		// The work directory may have used another store (e.g. before the repository's depth changed)
+		if err := r.removeUnusedStores(ctx); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{Requeue: true}, nil
+
+	} else if err != nil {
 
 		// Failed to open repository; update the "Cloned" condition to "Unknown"
 		if res, err := r.setCondition(ctx, &o, typeClonedGitRepository, metav1.ConditionUnknown, "CloneOpenFailed", "Clone open failed: "+err.Error()); res.Requeue || err != nil {
@@ -230,30 +314,34 @@ func (r *GitRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		}
 		return ctrl.Result{Requeue: true}, nil
 
-	} else if err := origin.Fetch(&git.FetchOptions{Progress: &b, Tags: git.AllTags}); err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+	} else if storeRepository, storeOrigin, err := store.fetch(o.Spec, creds, &b); err != nil {
 
-		if res, err := r.setCondition(ctx, &o, typeAvailableGitRepository, metav1.ConditionFalse, "RemoteFetchFailed", "Failed to fetch remote: "+err.Error()); err != nil {
+		reason := "RemoteFetchFailed"
+		if isAuthenticationError(err) {
+			reason = reasonAuthenticationFailed
+		}
+		if res, err := r.setCondition(ctx, &o, typeAvailableGitRepository, metav1.ConditionFalse, reason, "Failed to fetch remote: "+err.Error()); err != nil {
 			return res, err
 		}
 		return ctrl.Result{RequeueAfter: interval}, nil
 
-	} else if worktree, err := repository.Worktree(); err != nil {
+	} else if refName, hash, err := resolveRef(storeRepository, storeOrigin, creds, o.Spec); err != nil {
 
-		if res, err := r.setCondition(ctx, &o, typeAvailableGitRepository, metav1.ConditionFalse, "WorktreeReadFailed", "Failed to read worktree: "+err.Error()); err != nil {
+		if res, err := r.setCondition(ctx, &o, typeAvailableGitRepository, metav1.ConditionFalse, "RefResolutionFailed", "Failed to resolve ref: "+err.Error()); err != nil {
 			return res, err
 		}
 		return ctrl.Result{RequeueAfter: interval}, nil
 
-	} else if err := worktree.Checkout(&git.CheckoutOptions{Branch: plumbing.ReferenceName(o.Spec.Branch), Force: true}); err != nil {
+	} else if worktree, err := repository.Worktree(); err != nil {
 
-		if res, err := r.setCondition(ctx, &o, typeAvailableGitRepository, metav1.ConditionFalse, "CheckoutFailed", "Failed to checkout branch: "+err.Error()); err != nil {
+		if res, err := r.setCondition(ctx, &o, typeAvailableGitRepository, metav1.ConditionFalse, "WorktreeReadFailed", "Failed to read worktree: "+err.Error()); err != nil {
 			return res, err
 		}
 		return ctrl.Result{RequeueAfter: interval}, nil
 
-	} else if err := worktree.Pull(&git.PullOptions{Progress: &b}); err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+	} else if err := store.checkout(repository, worktree, hash, o.Spec.SparsePaths); err != nil {
 
-		if res, err := r.setCondition(ctx, &o, typeAvailableGitRepository, metav1.ConditionFalse, "PullFailed", "Failed to pull branch: "+err.Error()); err != nil {
+		if res, err := r.setCondition(ctx, &o, typeAvailableGitRepository, metav1.ConditionFalse, "CheckoutFailed", fmt.Sprintf("Failed to checkout '%s': %s", refName, err)); err != nil {
 			return res, err
 		}
 		return ctrl.Result{RequeueAfter: interval}, nil
@@ -265,9 +353,10 @@ func (r *GitRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		}
 		return ctrl.Result{RequeueAfter: interval}, nil
 
-	} else if o.Status.LastPulledSHA != head.Hash().String() {
+	} else if o.Status.LastPulledSHA != head.Hash().String() || o.Status.ResolvedRef != refName.String() {
 
 		o.Status.LastPulledSHA = head.Hash().String()
+		o.Status.ResolvedRef = refName.String()
 		if err := r.Client.Status().Update(ctx, &o); err != nil {
 			return ctrl.Result{}, fmt.Errorf("failed updating status: %w", err)
 		} else {
@@ -282,9 +371,19 @@ func (r *GitRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 			return ctrl.Result{Requeue: true}, nil
 		}
 
+	} else if requested := reconcileRequestedAt(&o); o.Status.LastHandledReconcileAt != requested {
+
+		// Record that the requested reconciliation was handled, now that the repository was fetched
+		o.Status.LastHandledReconcileAt = requested
+		if err := r.Client.Status().Update(ctx, &o); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to update handled reconcile request in GitRepository status: %w", err)
+		}
+		return ctrl.Result{RequeueAfter: interval}, nil
+
 	} else {
 
-		return ctrl.Result{}, nil
+		// Poll again on the next tick
+		return ctrl.Result{RequeueAfter: interval}, nil
 
 	}
 }
@@ -319,11 +418,72 @@ func (r *GitRepositoryReconciler) setCondition(ctx context.Context, o *v1alpha1.
 	}
 }
 
+// removeUnusedStores removes the object stores no longer used by any repository (other than repositories being
+// deleted), e.g. after a repository was deleted or its URL or depth changed. Repositories are listed from the API
+// server rather than the cache, which may not have observed recently created repositories yet.
+func (r *GitRepositoryReconciler) removeUnusedStores(ctx context.Context) error {
+	repositories := &v1alpha1.GitRepositoryList{}
+	if err := r.APIReader.List(ctx, repositories); err != nil {
+		return fmt.Errorf("failed to list Git repositories: %w", err)
+	}
+	var specs []v1alpha1.GitRepositorySpec
+	for _, item := range repositories.Items {
+		if item.DeletionTimestamp == nil {
+			specs = append(specs, item.Spec)
+		}
+	}
+	return r.stores.removeUnused(specs)
+}
+
+func (r *GitRepositoryReconciler) findObjectsForSecret(secret client.Object) []reconcile.Request {
+	repositories := &v1alpha1.GitRepositoryList{}
+	listOps := &client.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector(".spec.secretRef.name", secret.GetName()),
+		Namespace:     secret.GetNamespace(),
+	}
+	err := r.Client.List(context.TODO(), repositories, listOps)
+	if err != nil {
+		ctrl.Log.Error(err, "Failed listing Git repositories for Secret", "secret", secret.GetNamespace()+"/"+secret.GetName())
+		return []reconcile.Request{}
+	}
+
+	requests := make([]reconcile.Request, len(repositories.Items))
+	for i, item := range repositories.Items {
+		requests[i] = reconcile.Request{
+			NamespacedName: types.NamespacedName{
+				Name:      item.GetName(),
+				Namespace: item.GetNamespace(),
+			},
+		}
+	}
+	return requests
+}
+
 func (r *GitRepositoryReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	r.Client = mgr.GetClient()
+	r.APIReader = mgr.GetAPIReader()
 	r.Recorder = mgr.GetEventRecorderFor("gitrepository")
 	r.Scheme = mgr.GetScheme()
-	return ctrl.NewControllerManagedBy(mgr).
+	r.stores = newObjectStores(filepath.Join(r.WorkDir, "stores"))
+
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &v1alpha1.GitRepository{}, ".spec.secretRef.name", func(rawObj client.Object) []string {
+		repository := rawObj.(*v1alpha1.GitRepository)
+		if repository.Spec.SecretRef == nil || repository.Spec.SecretRef.Name == "" {
+			return nil
+		}
+		return []string{repository.Spec.SecretRef.Name}
+	}); err != nil {
+		return fmt.Errorf("failed to create index for secret-ref: %w", err)
+	}
+
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&v1alpha1.GitRepository{}).
-		Complete(r)
+		Watches(
+			&source.Kind{Type: &v1.Secret{}},
+			handler.EnqueueRequestsFromMapFunc(r.findObjectsForSecret),
+		)
+	if r.Events != nil {
+		b = b.Watches(&source.Channel{Source: r.Events}, &handler.EnqueueRequestForObject{})
+	}
+	return b.Complete(r)
 }
@@ -5,18 +5,26 @@ import (
 	"github.com/arikkfir/kude-controller/internal/v1alpha1"
 	"github.com/arikkfir/kude-controller/test/gittest"
 	"github.com/arikkfir/kude-controller/test/harness"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io/fs"
+	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/api/events/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -107,7 +115,7 @@ func TestGitRepositoryClone(t *testing.T) {
 		},
 		Spec: v1alpha1.GitRepositorySpec{
 			URL:             repository.URL.String(),
-			Branch:          "refs/heads/main",
+			Ref:             "refs/heads/main",
 			PollingInterval: "5s",
 		},
 	}
@@ -149,7 +157,7 @@ func TestGitRepositoryDeletion(t *testing.T) {
 			},
 		},
 		Spec: v1alpha1.GitRepositorySpec{
-			Branch:          "refs/heads/main",
+			Ref:             "refs/heads/main",
 			PollingInterval: "5s",
 		},
 	}
@@ -216,7 +224,7 @@ func TestGitRepositoryDeletionFailsWhenWorkDirIsInvalid(t *testing.T) {
 			Labels:    map[string]string{"test": "test"},
 		},
 		Spec: v1alpha1.GitRepositorySpec{
-			Branch:          "refs/heads/main",
+			Ref:             "refs/heads/main",
 			PollingInterval: "5s",
 		},
 	}
@@ -274,3 +282,1034 @@ func TestGitRepositoryDeletionFailsWhenWorkDirIsInvalid(t *testing.T) {
 		t.Error("Timed out waiting for invalid workdir event")
 	}
 }
+
+func TestGitRepositoryCloneOverHTTPSWithBasicAuth(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	require.NoErrorf(t, repository.CommitFile("file1", "content1"), "failed to commit file")
+	defer os.RemoveAll(repository.Dir)
+
+	server, err := gittest.NewHTTPServer(repository, true, "kude", "s3cr3t")
+	require.NoErrorf(t, err, "failed to start HTTP server")
+	defer server.Close()
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()})
+
+	ctx := context.Background()
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "creds", Namespace: "default"},
+		Data: map[string][]byte{
+			"username": []byte("kude"),
+			"password": []byte("s3cr3t"),
+			"caFile":   server.CACert(),
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, secret), "secret creation failed")
+
+	repo := &v1alpha1.GitRepository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.GitRepository{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "repo1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.GitRepositorySpec{
+			URL:             server.URL(),
+			Ref:             "refs/heads/main",
+			PollingInterval: "5s",
+			SecretRef:       &corev1.LocalObjectReference{Name: secret.Name},
+		},
+	}
+	lookupKey := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+
+	require.NoErrorf(t, k8sClient.Create(ctx, repo), "resource creation failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			cAvailable := meta.FindStatusCondition(r.Status.Conditions, typeAvailableGitRepository)
+			if assert.NotNil(c, cAvailable, "available condition not found") {
+				assert.Equal(c, metav1.ConditionTrue, cAvailable.Status, "incorrect status")
+				assert.Equal(c, "Ready", cAvailable.Reason, "incorrect reason")
+			}
+			assert.NotEmpty(c, r.Status.LastPulledSHA, "last pulled SHA not set")
+		}
+	}, 10*time.Second, 1*time.Second, "resource not cloned correctly")
+}
+
+func TestGitRepositoryAuthenticationFailure(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	require.NoErrorf(t, repository.CommitFile("file1", "content1"), "failed to commit file")
+	defer os.RemoveAll(repository.Dir)
+
+	server, err := gittest.NewHTTPServer(repository, false, "kude", "s3cr3t")
+	require.NoErrorf(t, err, "failed to start HTTP server")
+	defer server.Close()
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()})
+
+	ctx := context.Background()
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "creds", Namespace: "default"},
+		Data: map[string][]byte{
+			"username": []byte("kude"),
+			"password": []byte("wrong"),
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, secret), "secret creation failed")
+
+	repo := &v1alpha1.GitRepository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.GitRepository{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "repo1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.GitRepositorySpec{
+			URL:             server.URL(),
+			Ref:             "refs/heads/main",
+			PollingInterval: "5s",
+			SecretRef:       &corev1.LocalObjectReference{Name: secret.Name},
+		},
+	}
+	lookupKey := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+
+	require.NoErrorf(t, k8sClient.Create(ctx, repo), "resource creation failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			cAvailable := meta.FindStatusCondition(r.Status.Conditions, typeAvailableGitRepository)
+			if assert.NotNil(c, cAvailable, "available condition not found") {
+				assert.Equal(c, metav1.ConditionFalse, cAvailable.Status, "incorrect status")
+				assert.Equal(c, reasonAuthenticationFailed, cAvailable.Reason, "incorrect reason")
+			}
+		}
+	}, 10*time.Second, 1*time.Second, "authentication failure not reported")
+
+	// Fix the credentials and expect the repository to recover
+	secret.Data["password"] = []byte("s3cr3t")
+	require.NoErrorf(t, k8sClient.Update(ctx, secret), "secret update failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			cAvailable := meta.FindStatusCondition(r.Status.Conditions, typeAvailableGitRepository)
+			if assert.NotNil(c, cAvailable, "available condition not found") {
+				assert.Equal(c, metav1.ConditionTrue, cAvailable.Status, "incorrect status")
+				assert.Equal(c, "Ready", cAvailable.Reason, "incorrect reason")
+			}
+		}
+	}, 10*time.Second, 1*time.Second, "resource did not recover after fixing credentials")
+}
+
+func TestGitRepositoryCloneOverSSH(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	require.NoErrorf(t, repository.CommitFile("file1", "content1"), "failed to commit file")
+	defer os.RemoveAll(repository.Dir)
+
+	identity, publicKey, err := gittest.GenerateSSHIdentity("p4ssphr4se")
+	require.NoErrorf(t, err, "failed to generate SSH identity")
+	server, err := gittest.NewSSHServer(repository, publicKey)
+	require.NoErrorf(t, err, "failed to start SSH server")
+	defer server.Close()
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()})
+
+	ctx := context.Background()
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "creds", Namespace: "default"},
+		Data: map[string][]byte{
+			"identity":    identity,
+			"passphrase":  []byte("p4ssphr4se"),
+			"known_hosts": server.KnownHosts(),
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, secret), "secret creation failed")
+
+	repo := &v1alpha1.GitRepository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.GitRepository{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "repo1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.GitRepositorySpec{
+			URL:             server.URL(),
+			Ref:             "refs/heads/main",
+			PollingInterval: "5s",
+			SecretRef:       &corev1.LocalObjectReference{Name: secret.Name},
+		},
+	}
+	lookupKey := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+
+	require.NoErrorf(t, k8sClient.Create(ctx, repo), "resource creation failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			cAvailable := meta.FindStatusCondition(r.Status.Conditions, typeAvailableGitRepository)
+			if assert.NotNil(c, cAvailable, "available condition not found") {
+				assert.Equal(c, metav1.ConditionTrue, cAvailable.Status, "incorrect status")
+				assert.Equal(c, "Ready", cAvailable.Reason, "incorrect reason")
+			}
+			assert.NotEmpty(c, r.Status.LastPulledSHA, "last pulled SHA not set")
+		}
+	}, 10*time.Second, 1*time.Second, "resource not cloned correctly")
+}
+
+func TestGitRepositorySSHRequiresKnownHosts(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	require.NoErrorf(t, repository.CommitFile("file1", "content1"), "failed to commit file")
+	defer os.RemoveAll(repository.Dir)
+
+	identity, publicKey, err := gittest.GenerateSSHIdentity("")
+	require.NoErrorf(t, err, "failed to generate SSH identity")
+	server, err := gittest.NewSSHServer(repository, publicKey)
+	require.NoErrorf(t, err, "failed to start SSH server")
+	defer server.Close()
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()})
+
+	ctx := context.Background()
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "creds", Namespace: "default"},
+		Data:       map[string][]byte{"identity": identity},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, secret), "secret creation failed")
+
+	repo := &v1alpha1.GitRepository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.GitRepository{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "repo1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.GitRepositorySpec{
+			URL:             server.URL(),
+			Ref:             "refs/heads/main",
+			PollingInterval: "1s",
+			SecretRef:       &corev1.LocalObjectReference{Name: secret.Name},
+		},
+	}
+	lookupKey := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+
+	// Without known hosts, the server's host key cannot be verified, so the repository must not be cloned
+	require.NoErrorf(t, k8sClient.Create(ctx, repo), "resource creation failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			cAvailable := meta.FindStatusCondition(r.Status.Conditions, typeAvailableGitRepository)
+			if assert.NotNil(c, cAvailable, "available condition not found") {
+				assert.Equal(c, metav1.ConditionFalse, cAvailable.Status, "incorrect status")
+				assert.Equal(c, reasonAuthenticationFailed, cAvailable.Reason, "incorrect reason")
+				assert.Contains(c, cAvailable.Message, "known_hosts", "incorrect message")
+			}
+			assert.Empty(c, r.Status.LastPulledSHA, "repository should not have been pulled")
+		}
+	}, 10*time.Second, 1*time.Second, "missing known hosts not reported")
+
+	// Adding known hosts lets the repository be cloned
+	secret.Data["known_hosts"] = server.KnownHosts()
+	require.NoErrorf(t, k8sClient.Update(ctx, secret), "secret update failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			assert.True(c, meta.IsStatusConditionTrue(r.Status.Conditions, typeAvailableGitRepository), "repository not available")
+			assert.NotEmpty(c, r.Status.LastPulledSHA, "last pulled SHA not set")
+		}
+	}, 10*time.Second, 1*time.Second, "resource did not recover after adding known hosts")
+}
+
+func TestGitRepositoryTagRef(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	require.NoErrorf(t, repository.CommitFile("file1", "content1"), "failed to commit file")
+	require.NoErrorf(t, repository.Tag("v1.0.0"), "failed to tag commit")
+	taggedSHA, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	require.NoErrorf(t, repository.CommitFile("file2", "content2"), "failed to commit file")
+	defer os.RemoveAll(repository.Dir)
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()})
+
+	repo := &v1alpha1.GitRepository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.GitRepository{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "repo1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.GitRepositorySpec{
+			URL:             repository.URL.String(),
+			Ref:             "refs/tags/v1.0.0",
+			PollingInterval: "5s",
+		},
+	}
+	lookupKey := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+
+	ctx := context.Background()
+	require.NoErrorf(t, k8sClient.Create(ctx, repo), "resource creation failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			assert.True(c, meta.IsStatusConditionTrue(r.Status.Conditions, typeAvailableGitRepository), "repository not available")
+			assert.Equal(c, "refs/tags/v1.0.0", r.Status.ResolvedRef, "incorrect resolved ref")
+			assert.Equal(c, taggedSHA, r.Status.LastPulledSHA, "incorrect SHA")
+		}
+	}, 10*time.Second, 1*time.Second, "tag not resolved correctly")
+}
+
+func TestGitRepositoryCommitRef(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	require.NoErrorf(t, repository.CommitFile("file1", "content1"), "failed to commit file")
+	sha, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	require.NoErrorf(t, repository.CommitFile("file2", "content2"), "failed to commit file")
+	defer os.RemoveAll(repository.Dir)
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()})
+
+	repo := &v1alpha1.GitRepository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.GitRepository{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "repo1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.GitRepositorySpec{
+			URL:             repository.URL.String(),
+			Ref:             sha,
+			PollingInterval: "5s",
+		},
+	}
+	lookupKey := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+
+	ctx := context.Background()
+	require.NoErrorf(t, k8sClient.Create(ctx, repo), "resource creation failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			assert.True(c, meta.IsStatusConditionTrue(r.Status.Conditions, typeAvailableGitRepository), "repository not available")
+			assert.Equal(c, sha, r.Status.ResolvedRef, "incorrect resolved ref")
+			assert.Equal(c, sha, r.Status.LastPulledSHA, "incorrect SHA")
+			if r.Status.WorkDirectory != "" {
+				_, err := os.Stat(filepath.Join(r.Status.WorkDirectory, "file2"))
+				assert.ErrorIs(c, err, os.ErrNotExist, "later commit's file found in work directory")
+			}
+		}
+	}, 10*time.Second, 1*time.Second, "commit not resolved correctly")
+}
+
+func TestGitRepositorySemverTag(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	for _, version := range []string{"1.0.0", "1.5.0", "2.0.0"} {
+		require.NoErrorf(t, repository.CommitFile("version", version), "failed to commit file")
+		require.NoErrorf(t, repository.Tag("v"+version), "failed to tag commit")
+	}
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()})
+
+	repo := &v1alpha1.GitRepository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.GitRepository{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "repo1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.GitRepositorySpec{
+			URL:             repository.URL.String(),
+			Tag:             ">=1.0.0 <2.0.0",
+			PollingInterval: "1s",
+		},
+	}
+	lookupKey := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+
+	ctx := context.Background()
+	require.NoErrorf(t, k8sClient.Create(ctx, repo), "resource creation failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			assert.True(c, meta.IsStatusConditionTrue(r.Status.Conditions, typeAvailableGitRepository), "repository not available")
+			assert.Equal(c, "refs/tags/v1.5.0", r.Status.ResolvedRef, "incorrect resolved ref")
+		}
+	}, 10*time.Second, 1*time.Second, "semver constraint not resolved correctly")
+
+	// A newer matching tag should be picked up on the next poll
+	require.NoErrorf(t, repository.CommitFile("version", "1.6.0"), "failed to commit file")
+	require.NoErrorf(t, repository.Tag("v1.6.0"), "failed to tag commit")
+	sha, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			assert.Equal(c, "refs/tags/v1.6.0", r.Status.ResolvedRef, "incorrect resolved ref")
+			assert.Equal(c, sha, r.Status.LastPulledSHA, "incorrect SHA")
+		}
+	}, 10*time.Second, 1*time.Second, "newer tag not picked up")
+}
+
+func TestGitRepositoryInvalidRef(t *testing.T) {
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()})
+
+	repo := &v1alpha1.GitRepository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.GitRepository{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "repo1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.GitRepositorySpec{
+			Ref:             "refs/heads/main",
+			Tag:             ">=1.0.0",
+			PollingInterval: "5s",
+		},
+	}
+	lookupKey := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+
+	ctx := context.Background()
+	require.NoErrorf(t, k8sClient.Create(ctx, repo), "resource creation failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			cAvailable := meta.FindStatusCondition(r.Status.Conditions, typeAvailableGitRepository)
+			if assert.NotNil(c, cAvailable, "available condition not found") {
+				assert.Equal(c, metav1.ConditionFalse, cAvailable.Status, "incorrect status")
+				assert.Equal(c, "InvalidRef", cAvailable.Reason, "incorrect reason")
+			}
+		}
+	}, 5*time.Second, 1*time.Second, "invalid ref not reported")
+}
+
+func TestGitRepositorySuspend(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	require.NoErrorf(t, repository.CommitFile("file1", "content1"), "failed to commit file")
+	defer os.RemoveAll(repository.Dir)
+	sha1, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()})
+
+	repo := &v1alpha1.GitRepository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.GitRepository{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "repo1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.GitRepositorySpec{
+			URL:             repository.URL.String(),
+			Ref:             "refs/heads/main",
+			PollingInterval: "1s",
+		},
+	}
+	lookupKey := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+
+	ctx := context.Background()
+	require.NoErrorf(t, k8sClient.Create(ctx, repo), "resource creation failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			assert.Equal(c, sha1, r.Status.LastPulledSHA, "incorrect SHA")
+			cSuspended := meta.FindStatusCondition(r.Status.Conditions, typeSuspendedGitRepository)
+			if assert.NotNil(c, cSuspended, "suspended condition not found") {
+				assert.Equal(c, metav1.ConditionFalse, cSuspended.Status, "incorrect status")
+			}
+		}
+	}, 10*time.Second, 1*time.Second, "repository not cloned")
+
+	// While suspended, new commits are not pulled
+	patch := client.MergeFrom(repo.DeepCopy())
+	repo.Spec.Suspend = true
+	require.NoErrorf(t, k8sClient.Patch(ctx, repo, patch), "resource update failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			cSuspended := meta.FindStatusCondition(r.Status.Conditions, typeSuspendedGitRepository)
+			if assert.NotNil(c, cSuspended, "suspended condition not found") {
+				assert.Equal(c, metav1.ConditionTrue, cSuspended.Status, "incorrect status")
+				assert.Equal(c, "Suspended", cSuspended.Reason, "incorrect reason")
+			}
+		}
+	}, 10*time.Second, 1*time.Second, "repository not suspended")
+	require.NoErrorf(t, repository.CommitFile("file1", "content2"), "failed to commit file")
+	sha2, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	time.Sleep(3 * time.Second)
+	var r v1alpha1.GitRepository
+	require.NoErrorf(t, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed")
+	assert.Equal(t, sha1, r.Status.LastPulledSHA, "suspended repository should not have been pulled")
+
+	// Once resumed, new commits are pulled again
+	patch = client.MergeFrom(repo.DeepCopy())
+	repo.Spec.Suspend = false
+	require.NoErrorf(t, k8sClient.Patch(ctx, repo, patch), "resource update failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			assert.Equal(c, sha2, r.Status.LastPulledSHA, "incorrect SHA")
+			cSuspended := meta.FindStatusCondition(r.Status.Conditions, typeSuspendedGitRepository)
+			if assert.NotNil(c, cSuspended, "suspended condition not found") {
+				assert.Equal(c, metav1.ConditionFalse, cSuspended.Status, "incorrect status")
+				assert.Equal(c, "NotSuspended", cSuspended.Reason, "incorrect reason")
+			}
+		}
+	}, 10*time.Second, 1*time.Second, "repository not resumed")
+}
+
+func TestGitRepositoryReconcileRequest(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	require.NoErrorf(t, repository.CommitFile("file1", "content1"), "failed to commit file")
+	defer os.RemoveAll(repository.Dir)
+	sha1, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()})
+
+	repo := &v1alpha1.GitRepository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.GitRepository{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "repo1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.GitRepositorySpec{
+			URL:             repository.URL.String(),
+			Ref:             "refs/heads/main",
+			PollingInterval: "1h",
+		},
+	}
+	lookupKey := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+
+	ctx := context.Background()
+	require.NoErrorf(t, k8sClient.Create(ctx, repo), "resource creation failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			assert.Equal(c, sha1, r.Status.LastPulledSHA, "incorrect SHA")
+			assert.True(c, meta.IsStatusConditionTrue(r.Status.Conditions, typeAvailableGitRepository), "repository not available")
+		}
+	}, 10*time.Second, 1*time.Second, "repository not cloned")
+
+	// New commits are not pulled until the next poll (once the reconciliations following the clone have settled)
+	time.Sleep(3 * time.Second)
+	require.NoErrorf(t, repository.CommitFile("file1", "content2"), "failed to commit file")
+	sha2, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	time.Sleep(3 * time.Second)
+	var r v1alpha1.GitRepository
+	require.NoErrorf(t, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed")
+	assert.Equal(t, sha1, r.Status.LastPulledSHA, "repository should not have been pulled before the next poll")
+
+	// Requesting a reconciliation pulls new commits immediately
+	patch := client.MergeFrom(repo.DeepCopy())
+	repo.Annotations = map[string]string{annotationReconcileRequestedAt: "2022-09-01T10:00:00Z"}
+	require.NoErrorf(t, k8sClient.Patch(ctx, repo, patch), "resource update failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			assert.Equal(c, sha2, r.Status.LastPulledSHA, "incorrect SHA")
+			assert.Equal(c, "2022-09-01T10:00:00Z", r.Status.LastHandledReconcileAt, "incorrect handled reconcile request")
+		}
+	}, 10*time.Second, 1*time.Second, "reconcile request not handled")
+}
+
+func TestGitRepositorySharedStore(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("file1", "content1"), "failed to commit file")
+	sha1, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	require.NoErrorf(t, repository.RunGit("checkout", "-b", "feature"), "failed to create branch")
+	require.NoErrorf(t, repository.CommitFile("file2", "content2"), "failed to commit file")
+	sha2, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	require.NoErrorf(t, repository.RunGit("checkout", "main"), "failed to checkout branch")
+
+	workDir := t.TempDir()
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: workDir})
+	ctx := context.Background()
+
+	// Repositories with the same (normalized) URL share the same object store, while checking out different branches
+	newRepository := func(name, url, ref string) *v1alpha1.GitRepository {
+		repo := &v1alpha1.GitRepository{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: v1alpha1.GroupVersion.String(),
+				Kind:       reflect.TypeOf(v1alpha1.GitRepository{}).Name(),
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+			},
+			Spec: v1alpha1.GitRepositorySpec{
+				URL:             url,
+				Ref:             ref,
+				PollingInterval: "1s",
+			},
+		}
+		require.NoErrorf(t, k8sClient.Create(ctx, repo), "resource creation failed")
+		return repo
+	}
+	mainRepo := newRepository("repo-main", repository.URL.String(), "refs/heads/main")
+	featureRepo := newRepository("repo-feature", repository.URL.String()+"/", "refs/heads/feature")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		for repo, sha := range map[*v1alpha1.GitRepository]string{mainRepo: sha1, featureRepo: sha2} {
+			var r v1alpha1.GitRepository
+			if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(repo), &r), "resource lookup failed") {
+				assert.Equal(c, sha, r.Status.LastPulledSHA, "incorrect SHA")
+				assert.True(c, meta.IsStatusConditionTrue(r.Status.Conditions, typeAvailableGitRepository), "repository not available")
+			}
+		}
+	}, 15*time.Second, 1*time.Second, "repositories not cloned")
+
+	stores, err := os.ReadDir(filepath.Join(workDir, "stores"))
+	require.NoErrorf(t, err, "failed to read stores directory")
+	assert.Len(t, stores, 1, "incorrect number of object stores")
+	for repo, hasFile2 := range map[*v1alpha1.GitRepository]bool{mainRepo: false, featureRepo: true} {
+		var r v1alpha1.GitRepository
+		require.NoErrorf(t, k8sClient.Get(ctx, client.ObjectKeyFromObject(repo), &r), "resource lookup failed")
+		assert.FileExists(t, filepath.Join(r.Status.WorkDirectory, "file1"), "file missing from work directory")
+		if hasFile2 {
+			assert.FileExists(t, filepath.Join(r.Status.WorkDirectory, "file2"), "file missing from work directory")
+		} else {
+			assert.NoFileExists(t, filepath.Join(r.Status.WorkDirectory, "file2"), "file of other branch found in work directory")
+		}
+		packs, err := filepath.Glob(filepath.Join(r.Status.WorkDirectory, ".git", "objects", "pack", "*.pack"))
+		require.NoErrorf(t, err, "failed to list packs")
+		assert.Empty(t, packs, "work directory should not hold its own objects")
+	}
+
+	// Changing the depth of a repository moves it to another object store, removing the previous one once unused
+	setDepth := func(repo *v1alpha1.GitRepository, depth int) {
+		var r v1alpha1.GitRepository
+		require.NoErrorf(t, k8sClient.Get(ctx, client.ObjectKeyFromObject(repo), &r), "resource lookup failed")
+		r.Spec.Depth = depth
+		require.NoErrorf(t, k8sClient.Update(ctx, &r), "resource update failed")
+	}
+	assertStores := func(count int, msg string) {
+		assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+			for repo, sha := range map[*v1alpha1.GitRepository]string{mainRepo: sha1, featureRepo: sha2} {
+				var r v1alpha1.GitRepository
+				if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(repo), &r), "resource lookup failed") {
+					assert.Equal(c, sha, r.Status.LastPulledSHA, "incorrect SHA")
+					assert.FileExists(c, filepath.Join(r.Status.WorkDirectory, "file1"), "file missing from work directory")
+				}
+			}
+			stores, err := os.ReadDir(filepath.Join(workDir, "stores"))
+			if assert.NoErrorf(c, err, "failed to read stores directory") {
+				assert.Len(c, stores, count, "incorrect number of object stores")
+			}
+		}, 15*time.Second, 1*time.Second, msg)
+	}
+	setDepth(featureRepo, 1)
+	assertStores(2, "shallow object store not created")
+	setDepth(mainRepo, 1)
+	assertStores(1, "unused object store not removed")
+
+	// The object store is removed once no repository uses it
+	require.NoErrorf(t, k8sClient.Delete(ctx, mainRepo), "resource deletion failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		assert.True(c, apierrors.IsNotFound(k8sClient.Get(ctx, client.ObjectKeyFromObject(mainRepo), &r)), "resource not deleted")
+	}, 10*time.Second, 1*time.Second, "repository not deleted")
+	stores, err = os.ReadDir(filepath.Join(workDir, "stores"))
+	require.NoErrorf(t, err, "failed to read stores directory")
+	assert.Len(t, stores, 1, "object store of a used URL should not have been removed")
+	require.NoErrorf(t, k8sClient.Delete(ctx, featureRepo), "resource deletion failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		stores, err := os.ReadDir(filepath.Join(workDir, "stores"))
+		if assert.NoErrorf(c, err, "failed to read stores directory") {
+			assert.Empty(c, stores, "unused object store not removed")
+		}
+	}, 10*time.Second, 1*time.Second, "object store not removed")
+}
+
+func TestGitRepositoryShallowSingleBranch(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("file1", "content1"), "failed to commit file")
+	sha1, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	require.NoErrorf(t, repository.CommitFile("file1", "content2"), "failed to commit file")
+	sha2, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	require.NoErrorf(t, repository.RunGit("branch", "feature"), "failed to create branch")
+
+	workDir := t.TempDir()
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: workDir})
+
+	repo := &v1alpha1.GitRepository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.GitRepository{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "repo1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.GitRepositorySpec{
+			URL:             repository.URL.String(),
+			Ref:             "refs/heads/main",
+			Depth:           1,
+			SingleBranch:    true,
+			PollingInterval: "1s",
+		},
+	}
+	lookupKey := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+
+	ctx := context.Background()
+	require.NoErrorf(t, k8sClient.Create(ctx, repo), "resource creation failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			assert.True(c, meta.IsStatusConditionTrue(r.Status.Conditions, typeAvailableGitRepository), "repository not available")
+			assert.Equal(c, sha2, r.Status.LastPulledSHA, "incorrect SHA")
+		}
+	}, 10*time.Second, 1*time.Second, "repository not cloned")
+
+	// Only the tip of the selected branch is fetched
+	stores, err := os.ReadDir(filepath.Join(workDir, "stores"))
+	require.NoErrorf(t, err, "failed to read stores directory")
+	require.Len(t, stores, 1, "incorrect number of object stores")
+	store, err := git.PlainOpen(filepath.Join(workDir, "stores", stores[0].Name()))
+	require.NoErrorf(t, err, "failed to open object store")
+	_, err = store.CommitObject(plumbing.NewHash(sha2))
+	assert.NoErrorf(t, err, "fetched commit not found in object store")
+	_, err = store.CommitObject(plumbing.NewHash(sha1))
+	assert.Errorf(t, err, "commit beyond depth found in object store")
+	_, err = store.Reference(plumbing.NewRemoteReferenceName("origin", "feature"), false)
+	assert.Errorf(t, err, "unselected branch found in object store")
+
+	// New commits are fetched shallowly as well
+	require.NoErrorf(t, repository.CommitFile("file1", "content3"), "failed to commit file")
+	sha3, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			assert.Equal(c, sha3, r.Status.LastPulledSHA, "incorrect SHA")
+			if content, err := os.ReadFile(filepath.Join(r.Status.WorkDirectory, "file1")); assert.NoErrorf(c, err, "failed to read file") {
+				assert.Equal(c, "content3", string(content), "incorrect file content")
+			}
+		}
+	}, 10*time.Second, 1*time.Second, "new commit not pulled")
+	_, err = store.CommitObject(plumbing.NewHash(sha1))
+	assert.Errorf(t, err, "commit beyond depth found in object store")
+}
+
+func TestGitRepositorySingleBranchRequiresRef(t *testing.T) {
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()})
+
+	repo := &v1alpha1.GitRepository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.GitRepository{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "repo1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.GitRepositorySpec{
+			Tag:             ">=1.0.0",
+			SingleBranch:    true,
+			PollingInterval: "5s",
+		},
+	}
+	lookupKey := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+
+	ctx := context.Background()
+	require.NoErrorf(t, k8sClient.Create(ctx, repo), "resource creation failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			cAvailable := meta.FindStatusCondition(r.Status.Conditions, typeAvailableGitRepository)
+			if assert.NotNil(c, cAvailable, "available condition not found") {
+				assert.Equal(c, metav1.ConditionFalse, cAvailable.Status, "incorrect status")
+				assert.Equal(c, "InvalidRef", cAvailable.Reason, "incorrect reason")
+			}
+		}
+	}, 5*time.Second, 1*time.Second, "invalid single-branch ref not reported")
+}
+
+func TestGitRepositorySparseCheckout(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	for file, content := range map[string]string{
+		"README.md":               "readme",
+		"deploy/base/app.yaml":    "base",
+		"deploy/prod/app.yaml":    "prod",
+		"deploy/staging/app.yaml": "staging",
+		"assets/large.bin":        "binary",
+	} {
+		require.NoErrorf(t, repository.CommitFile(file, content), "failed to commit file")
+	}
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()})
+
+	repo := &v1alpha1.GitRepository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.GitRepository{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "repo1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.GitRepositorySpec{
+			URL:             repository.URL.String(),
+			Ref:             "refs/heads/main",
+			SparsePaths:     []string{"deploy/base", "deploy/prod/", "README.md"},
+			PollingInterval: "1s",
+		},
+	}
+	lookupKey := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+
+	// workDirectoryFiles lists the files in the work directory of the repository (excluding the ".git" directory)
+	workDirectoryFiles := func(c assert.TestingT, dir string) []string {
+		var files []string
+		assert.NoErrorf(c, filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			} else if d.IsDir() && d.Name() == ".git" {
+				return filepath.SkipDir
+			} else if !d.IsDir() {
+				rel, err := filepath.Rel(dir, path)
+				files = append(files, filepath.ToSlash(rel))
+				return err
+			}
+			return nil
+		}), "failed to list work directory")
+		sort.Strings(files)
+		return files
+	}
+
+	// Only the sparse paths are checked out
+	ctx := context.Background()
+	require.NoErrorf(t, k8sClient.Create(ctx, repo), "resource creation failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			assert.True(c, meta.IsStatusConditionTrue(r.Status.Conditions, typeAvailableGitRepository), "repository not available")
+			if r.Status.WorkDirectory != "" {
+				assert.Equal(c, []string{"README.md", "deploy/base/app.yaml", "deploy/prod/app.yaml"}, workDirectoryFiles(c, r.Status.WorkDirectory), "incorrect files checked out")
+			}
+		}
+	}, 10*time.Second, 1*time.Second, "sparse paths not checked out")
+
+	// New commits update the sparse paths only, removing deleted files
+	require.NoErrorf(t, repository.CommitFile("deploy/prod/extra.yaml", "extra"), "failed to commit file")
+	require.NoErrorf(t, repository.CommitFile("assets/other.bin", "binary"), "failed to commit file")
+	require.NoErrorf(t, repository.RemoveFile("deploy/base/app.yaml"), "failed to remove file")
+	sha, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			assert.Equal(c, sha, r.Status.LastPulledSHA, "incorrect SHA")
+			assert.Equal(c, []string{"README.md", "deploy/prod/app.yaml", "deploy/prod/extra.yaml"}, workDirectoryFiles(c, r.Status.WorkDirectory), "incorrect files checked out")
+			assert.NoDirExists(c, filepath.Join(r.Status.WorkDirectory, "deploy", "base"), "empty directory not removed")
+		}
+	}, 10*time.Second, 1*time.Second, "sparse paths not updated")
+
+	// Removing the sparse paths checks out the whole repository
+	require.NoErrorf(t, k8sClient.Get(ctx, lookupKey, repo), "resource lookup failed")
+	repo.Spec.SparsePaths = nil
+	require.NoErrorf(t, k8sClient.Update(ctx, repo), "resource update failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			assert.Equal(c, []string{"README.md", "assets/large.bin", "assets/other.bin", "deploy/prod/app.yaml", "deploy/prod/extra.yaml", "deploy/staging/app.yaml"}, workDirectoryFiles(c, r.Status.WorkDirectory), "incorrect files checked out")
+		}
+	}, 10*time.Second, 1*time.Second, "whole repository not checked out")
+}
+
+func TestGitRepositorySparseCheckoutSymlinkReplacedByDirectory(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	outside := t.TempDir()
+	require.NoErrorf(t, repository.CommitFile("deploy/app.yaml", "app"), "failed to commit file")
+	require.NoErrorf(t, os.Symlink(outside, filepath.Join(repository.Dir, "deploy", "x")), "failed to create symbolic link")
+	require.NoErrorf(t, repository.RunGit("add", "deploy/x"), "failed to add symbolic link")
+	require.NoErrorf(t, repository.RunGit("commit", "-m", "Adding deploy/x"), "failed to commit symbolic link")
+	sha1, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()})
+	ctx := context.Background()
+	repo := &v1alpha1.GitRepository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.GitRepository{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "repo1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.GitRepositorySpec{
+			URL:             repository.URL.String(),
+			Ref:             "refs/heads/main",
+			SparsePaths:     []string{"deploy"},
+			PollingInterval: "1s",
+		},
+	}
+	lookupKey := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+	require.NoErrorf(t, k8sClient.Create(ctx, repo), "resource creation failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			assert.Equal(c, sha1, r.Status.LastPulledSHA, "incorrect SHA")
+			if r.Status.WorkDirectory != "" {
+				target, err := os.Readlink(filepath.Join(r.Status.WorkDirectory, "deploy", "x"))
+				if assert.NoErrorf(c, err, "symbolic link not checked out") {
+					assert.Equal(c, outside, target, "incorrect symbolic link target")
+				}
+			}
+		}
+	}, 10*time.Second, 1*time.Second, "symbolic link not checked out")
+
+	// Replacing the symbolic link with a directory writes into the work directory, rather than the link's target
+	require.NoErrorf(t, repository.RunGit("rm", "--quiet", "deploy/x"), "failed to remove symbolic link")
+	require.NoErrorf(t, repository.CommitFile("deploy/x/file", "content"), "failed to commit file")
+	sha2, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &r), "resource lookup failed") {
+			assert.Equal(c, sha2, r.Status.LastPulledSHA, "incorrect SHA")
+			assert.True(c, meta.IsStatusConditionTrue(r.Status.Conditions, typeAvailableGitRepository), "repository not available")
+			if info, err := os.Lstat(filepath.Join(r.Status.WorkDirectory, "deploy", "x")); assert.NoErrorf(c, err, "directory not checked out") {
+				assert.True(c, info.IsDir(), "symbolic link not replaced by a directory")
+			}
+			assert.FileExists(c, filepath.Join(r.Status.WorkDirectory, "deploy", "x", "file"), "file not checked out")
+		}
+	}, 10*time.Second, 1*time.Second, "directory not checked out")
+	assert.NoFileExists(t, filepath.Join(outside, "file"), "file written outside the work directory")
+}
+
+func TestGitRepositorySparseCheckoutRejectsEscapingPaths(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("deploy/app.yaml", "app"), "failed to commit file")
+
+	// Craft a commit holding "deploy/../../escaped" (which Git refuses to check out, but happily stores)
+	runGit := func(stdin string, args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repository.Dir
+		cmd.Stdin = strings.NewReader(stdin)
+		out, err := cmd.Output()
+		require.NoErrorf(t, err, "failed to run git command '%s'", strings.Join(args, " "))
+		return strings.TrimSpace(string(out))
+	}
+	blob := runGit("escaped", "hash-object", "-w", "--stdin")
+	tree := runGit("100644 blob "+blob+"\tescaped\n", "mktree")
+	tree = runGit("040000 tree "+tree+"\t..\n", "mktree")
+	tree = runGit("040000 tree "+tree+"\t..\n", "mktree")
+	tree = runGit("040000 tree "+tree+"\tdeploy\n", "mktree")
+	commit := runGit("", "commit-tree", tree, "-p", "HEAD", "-m", "Escaping the work directory")
+	runGit("", "update-ref", "refs/heads/main", commit)
+
+	workDir := t.TempDir()
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: filepath.Join(workDir, "controller")})
+	ctx := context.Background()
+	repo := &v1alpha1.GitRepository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.GitRepository{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "repo1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.GitRepositorySpec{
+			URL:             repository.URL.String(),
+			Ref:             "refs/heads/main",
+			SparsePaths:     []string{"deploy"},
+			PollingInterval: "1s",
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, repo), "resource creation failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(repo), &r), "resource lookup failed") {
+			cAvailable := meta.FindStatusCondition(r.Status.Conditions, typeAvailableGitRepository)
+			if assert.NotNil(c, cAvailable, "available condition not found") {
+				assert.Equal(c, metav1.ConditionFalse, cAvailable.Status, "incorrect status")
+				assert.Equal(c, "CheckoutFailed", cAvailable.Reason, "incorrect reason")
+				assert.Contains(c, cAvailable.Message, "invalid path 'deploy/../../escaped'", "incorrect message")
+			}
+		}
+	}, 10*time.Second, 1*time.Second, "escaping path not rejected")
+	assert.NoFileExists(t, filepath.Join(workDir, "escaped"), "file written outside the work directory")
+	assert.NoFileExists(t, filepath.Join(workDir, "controller", "escaped"), "file written outside the work directory")
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
+	"strings"
+
+	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+)
+
+const (
+	secretKeyIdentity    = "identity"    // PEM-encoded SSH private key
+	secretKeyPassphrase  = "passphrase"  // Passphrase of the SSH private key
+	secretKeyKnownHosts  = "known_hosts" // SSH known hosts, used to pin the server's host key (required for SSH)
+	secretKeyUsername    = "username"    // HTTPS basic authentication username (or SSH user)
+	secretKeyPassword    = "password"    // HTTPS basic authentication password or token
+	secretKeyBearerToken = "bearerToken" // HTTPS bearer token
+	secretKeyCAFile      = "caFile"      // Additional PEM-encoded CA certificates for HTTPS
+)
+
+// gitCredentials holds the authentication material used for accessing a remote Git repository.
+type gitCredentials struct {
+	Auth     transport.AuthMethod // Authentication method (nil for anonymous access)
+	CABundle []byte               // Additional CA certificates for HTTPS remotes
+}
+
+// resolveCredentials builds the Git credentials for the given GitRepository from its referenced secret, if any.
+func (r *GitRepositoryReconciler) resolveCredentials(ctx context.Context, o *v1alpha1.GitRepository) (*gitCredentials, error) {
+	if o.Spec.SecretRef == nil || o.Spec.SecretRef.Name == "" {
+		return &gitCredentials{}, nil
+	}
+
+	var secret v1.Secret
+	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: o.Namespace, Name: o.Spec.SecretRef.Name}, &secret); err != nil {
+		return nil, fmt.Errorf("failed to get secret '%s': %w", o.Spec.SecretRef.Name, err)
+	}
+
+	creds := &gitCredentials{CABundle: secret.Data[secretKeyCAFile]}
+	if identity, ok := secret.Data[secretKeyIdentity]; ok {
+		user := string(secret.Data[secretKeyUsername])
+		if user == "" {
+			if endpoint, err := transport.NewEndpoint(o.Spec.URL); err == nil && endpoint.User != "" {
+				user = endpoint.User
+			} else {
+				user = ssh.DefaultUsername
+			}
+		}
+		publicKeys, err := ssh.NewPublicKeys(user, identity, string(secret.Data[secretKeyPassphrase]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SSH identity in secret '%s': %w", secret.Name, err)
+		}
+		// Host keys must always be pinned, otherwise anyone in the middle could serve arbitrary manifests
+		if knownHosts, ok := secret.Data[secretKeyKnownHosts]; !ok || len(knownHosts) == 0 {
+			return nil, fmt.Errorf("secret '%s' has no '%s' key; it's required for verifying the SSH server's host key", secret.Name, secretKeyKnownHosts)
+		} else if callback, err := newKnownHostsCallback(knownHosts); err != nil {
+			return nil, fmt.Errorf("failed to parse known hosts in secret '%s': %w", secret.Name, err)
+		} else {
+			publicKeys.HostKeyCallback = callback
+		}
+		creds.Auth = publicKeys
+	} else if token, ok := secret.Data[secretKeyBearerToken]; ok {
+		creds.Auth = &http.TokenAuth{Token: string(token)}
+	} else if password, ok := secret.Data[secretKeyPassword]; ok {
+		creds.Auth = &http.BasicAuth{Username: string(secret.Data[secretKeyUsername]), Password: string(password)}
+	}
+	return creds, nil
+}
+
+// newKnownHostsCallback creates an SSH host key callback that only accepts hosts listed in the given known hosts data.
+func newKnownHostsCallback(knownHosts []byte) (gossh.HostKeyCallback, error) {
+	f, err := os.CreateTemp("", "known_hosts")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary known hosts file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(knownHosts); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to write temporary known hosts file: %w", err)
+	} else if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close temporary known hosts file: %w", err)
+	}
+	return ssh.NewKnownHostsCallback(f.Name())
+}
+
+// isAuthenticationError checks whether the given error signals that the remote rejected our credentials (or that we
+// rejected the remote's host key).
+func isAuthenticationError(err error) bool {
+	if errors.Is(err, transport.ErrAuthenticationRequired) || errors.Is(err, transport.ErrAuthorizationFailed) {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "unable to authenticate") || strings.Contains(msg, "knownhosts:")
+}
@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"github.com/blang/semver"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"regexp"
+	"strings"
+
+	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+)
+
+const (
+	refHeadsPrefix = "refs/heads/"
+	refTagsPrefix  = "refs/tags/"
+)
+
+var (
+	// Ref specs used when fetching; tags are force-updated so that moved tags are picked up
+	fetchRefSpecs = []config.RefSpec{
+		"+refs/heads/*:refs/remotes/origin/*",
+		"+refs/tags/*:refs/tags/*",
+	}
+	commitSHARegex = regexp.MustCompile(`^[0-9a-f]{40}$`)
+)
+
+// validateRef verifies that the reference selection in the given spec is valid.
+func validateRef(spec v1alpha1.GitRepositorySpec) error {
+	if spec.Ref != "" && spec.Tag != "" {
+		return errors.New("only one of 'ref' and 'tag' may be specified")
+	} else if spec.Tag != "" {
+		if _, err := semver.ParseRange(spec.Tag); err != nil {
+			return fmt.Errorf("invalid semantic version constraint '%s': %w", spec.Tag, err)
+		}
+	} else if spec.Ref != "" {
+		if !strings.HasPrefix(spec.Ref, refHeadsPrefix) && !strings.HasPrefix(spec.Ref, refTagsPrefix) && !commitSHARegex.MatchString(spec.Ref) {
+			return fmt.Errorf("invalid ref '%s': must be a branch (refs/heads/...), a tag (refs/tags/...) or a commit SHA", spec.Ref)
+		}
+	}
+	if spec.SingleBranch && !strings.HasPrefix(spec.Ref, refHeadsPrefix) && !strings.HasPrefix(spec.Ref, refTagsPrefix) {
+		return errors.New("'singleBranch' requires 'ref' to be a branch (refs/heads/...) or a tag (refs/tags/...)")
+	}
+	return nil
+}
+
+// refSpecsFor returns the ref specs to fetch for the given spec: all branches & tags, or only the branch or tag
+// selected by its ref when fetching a single branch.
+func refSpecsFor(spec v1alpha1.GitRepositorySpec) []config.RefSpec {
+	if !spec.SingleBranch {
+		return fetchRefSpecs
+	} else if strings.HasPrefix(spec.Ref, refHeadsPrefix) {
+		branch := strings.TrimPrefix(spec.Ref, refHeadsPrefix)
+		return []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", spec.Ref, plumbing.NewRemoteReferenceName(git.DefaultRemoteName, branch)))}
+	} else {
+		return []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", spec.Ref, spec.Ref))}
+	}
+}
+
+// resolveRef resolves the reference selected by the given spec to a concrete reference name and commit hash, based on
+// the current (fetched) state of the given local repository.
+func resolveRef(repository *git.Repository, origin *git.Remote, creds *gitCredentials, spec v1alpha1.GitRepositorySpec) (plumbing.ReferenceName, plumbing.Hash, error) {
+	if spec.Tag != "" {
+		return resolveSemverTag(repository, spec.Tag)
+	} else if strings.HasPrefix(spec.Ref, refHeadsPrefix) {
+		branch := strings.TrimPrefix(spec.Ref, refHeadsPrefix)
+		hash, err := repository.ResolveRevision(plumbing.Revision(plumbing.NewRemoteReferenceName(origin.Config().Name, branch)))
+		if err != nil {
+			return "", plumbing.ZeroHash, fmt.Errorf("failed to resolve branch '%s': %w", branch, err)
+		}
+		return plumbing.ReferenceName(spec.Ref), *hash, nil
+	} else if strings.HasPrefix(spec.Ref, refTagsPrefix) {
+		hash, err := repository.ResolveRevision(plumbing.Revision(spec.Ref))
+		if err != nil {
+			return "", plumbing.ZeroHash, fmt.Errorf("failed to resolve tag '%s': %w", spec.Ref, err)
+		}
+		return plumbing.ReferenceName(spec.Ref), *hash, nil
+	} else if spec.Ref != "" {
+		hash := plumbing.NewHash(spec.Ref)
+		if _, err := repository.CommitObject(hash); err != nil {
+			return "", plumbing.ZeroHash, fmt.Errorf("failed to find commit '%s': %w", spec.Ref, err)
+		}
+		return plumbing.ReferenceName(spec.Ref), hash, nil
+	} else {
+		return resolveDefaultBranch(repository, origin, creds)
+	}
+}
+
+// resolveSemverTag finds the tag with the highest semantic version satisfying the given constraint.
+func resolveSemverTag(repository *git.Repository, constraint string) (plumbing.ReferenceName, plumbing.Hash, error) {
+	versionRange, err := semver.ParseRange(constraint)
+	if err != nil {
+		return "", plumbing.ZeroHash, fmt.Errorf("invalid semantic version constraint '%s': %w", constraint, err)
+	}
+
+	tags, err := repository.Tags()
+	if err != nil {
+		return "", plumbing.ZeroHash, fmt.Errorf("failed to list tags: %w", err)
+	}
+	var bestRef *plumbing.Reference
+	var bestVersion semver.Version
+	if err := tags.ForEach(func(ref *plumbing.Reference) error {
+		if v, err := semver.ParseTolerant(ref.Name().Short()); err == nil && versionRange(v) {
+			if bestRef == nil || v.GT(bestVersion) {
+				bestRef, bestVersion = ref, v
+			}
+		}
+		return nil
+	}); err != nil {
+		return "", plumbing.ZeroHash, fmt.Errorf("failed to iterate tags: %w", err)
+	}
+	if bestRef == nil {
+		return "", plumbing.ZeroHash, fmt.Errorf("no tag matches semantic version constraint '%s'", constraint)
+	}
+
+	hash, err := repository.ResolveRevision(plumbing.Revision(bestRef.Name()))
+	if err != nil {
+		return "", plumbing.ZeroHash, fmt.Errorf("failed to resolve tag '%s': %w", bestRef.Name(), err)
+	}
+	return bestRef.Name(), *hash, nil
+}
+
+// resolveDefaultBranch finds the branch pointed to by the remote's HEAD.
+func resolveDefaultBranch(repository *git.Repository, origin *git.Remote, creds *gitCredentials) (plumbing.ReferenceName, plumbing.Hash, error) {
+	refs, err := origin.List(&git.ListOptions{Auth: creds.Auth, CABundle: creds.CABundle})
+	if err != nil {
+		return "", plumbing.ZeroHash, fmt.Errorf("failed to list remote references: %w", err)
+	}
+	for _, ref := range refs {
+		if ref.Name() != plumbing.HEAD {
+			continue
+		} else if ref.Type() == plumbing.SymbolicReference && ref.Target().IsBranch() {
+			branch := ref.Target().Short()
+			hash, err := repository.ResolveRevision(plumbing.Revision(plumbing.NewRemoteReferenceName(origin.Config().Name, branch)))
+			if err != nil {
+				return "", plumbing.ZeroHash, fmt.Errorf("failed to resolve default branch '%s': %w", branch, err)
+			}
+			return ref.Target(), *hash, nil
+		} else {
+			return plumbing.HEAD, ref.Hash(), nil
+		}
+	}
+	return "", plumbing.ZeroHash, errors.New("remote does not advertise a HEAD reference")
+}
@@ -0,0 +1,242 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+)
+
+// errWorkDirectoryNotShared is returned when opening a work directory that does not use its object store, e.g. one
+// cloned by an older version of the controller.
+var errWorkDirectoryNotShared = errors.New("work directory does not use the shared object store")
+
+// objectStores manages the object stores shared by repositories with the same (normalized) URL. Each store is a bare
+// repository that all branches & tags of the URL are fetched into, while each repository checks out its commit into
+// its own work directory, using the objects of the store rather than keeping its own copy.
+type objectStores struct {
+	dir    string                  // Directory holding the stores
+	lock   sync.Mutex              // Guards stores
+	stores map[string]*objectStore // Stores, by normalized URL & depth
+}
+
+// newObjectStores creates a new manager of object stores kept in the given directory.
+func newObjectStores(dir string) *objectStores {
+	return &objectStores{dir: dir, stores: make(map[string]*objectStore)}
+}
+
+// get returns the object store of the given URL & fetch depth; shallow stores are kept apart from full ones (and from
+// each other), since their histories differ.
+func (s *objectStores) get(rawURL string, depth int) *objectStore {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := storeKey(rawURL, depth)
+	if store, ok := s.stores[key]; ok {
+		return store
+	}
+	store := &objectStore{dir: s.storeDir(key)}
+	s.stores[key] = store
+	return store
+}
+
+// removeUnused removes the stores not used by any of the given repository specs, e.g. stores of deleted repositories,
+// or stores left behind when a repository's URL or depth changed. Stores left by previous runs of the controller (and
+// hence unknown to this manager) are removed as well.
+func (s *objectStores) removeUnused(specs []v1alpha1.GitRepositorySpec) error {
+	used := make(map[string]bool)
+	for _, spec := range specs {
+		used[s.storeDir(storeKey(spec.URL, spec.Depth))] = true
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	known := make(map[string]bool)
+	for _, store := range s.stores {
+		known[store.dir] = true
+		if !used[store.dir] {
+			store.Lock()
+			err := store.remove()
+			store.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to list object stores: %w", err)
+	}
+	for _, entry := range entries {
+		if dir := filepath.Join(s.dir, entry.Name()); !used[dir] && !known[dir] {
+			if err := os.RemoveAll(dir); err != nil {
+				return fmt.Errorf("failed to remove object store at '%s': %w", dir, err)
+			}
+		}
+	}
+	return nil
+}
+
+// storeDir returns the directory of the store with the given key.
+func (s *objectStores) storeDir(key string) string {
+	checksum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(checksum[:]))
+}
+
+// storeKey returns the key of the object store of the given URL & fetch depth; URLs referring to the same repository
+// (see normalizeGitURL) share the same store.
+func storeKey(rawURL string, depth int) string {
+	key := normalizeGitURL(rawURL)
+	if depth > 0 {
+		key = fmt.Sprintf("%s#depth=%d", key, depth)
+	}
+	return key
+}
+
+// objectStore is a bare repository holding the objects of all repositories with the same URL. Fetches, work directory
+// initializations & checkouts lock the store, so that concurrent ones do not corrupt it.
+type objectStore struct {
+	sync.Mutex                     // Serializes fetching into the store, initializing work directories & checking out
+	dir        string              // Directory of the bare repository
+	storageMu  sync.Mutex          // Guards storage
+	storage    *filesystem.Storage // Storage of the bare repository, once opened
+}
+
+// open opens the store's bare repository, initializing it if it's missing.
+func (s *objectStore) open() (*git.Repository, error) {
+	s.storageMu.Lock()
+	defer s.storageMu.Unlock()
+
+	if s.storage == nil {
+		s.storage = filesystem.NewStorage(osfs.New(s.dir), cache.NewObjectLRUDefault())
+	}
+	repository, err := git.Open(s.storage, nil)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		if repository, err = git.Init(s.storage, nil); err != nil {
+			s.storage = nil
+			return nil, fmt.Errorf("failed to initialize object store at '%s': %w", s.dir, err)
+		}
+	} else if err != nil {
+		s.storage = nil
+		return nil, fmt.Errorf("failed to open object store at '%s': %w", s.dir, err)
+	}
+	return repository, nil
+}
+
+// fetch fetches the branches & tags selected by the given spec (all of them, unless fetching a single branch) into the
+// store, up to the spec's depth, using the given credentials. The store's repository is returned, along with the remote
+// that was fetched.
+func (s *objectStore) fetch(spec v1alpha1.GitRepositorySpec, creds *gitCredentials, progress io.Writer) (*git.Repository, *git.Remote, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	repository, err := s.open()
+	if err != nil {
+		return nil, nil, err
+	}
+	origin := git.NewRemote(repository.Storer, &config.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{spec.URL}})
+	if err := origin.Fetch(&git.FetchOptions{RefSpecs: refSpecsFor(spec), Depth: spec.Depth, Auth: creds.Auth, CABundle: creds.CABundle, Progress: progress, Tags: git.NoTags}); err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil, nil, err
+	}
+	return repository, origin, nil
+}
+
+// initWorkDirectory creates a work directory for checking out commits of the repository at the given URL from the
+// store. The work directory refers to the store's objects as Git "alternates", so it's usable by Git tools as well.
+func (s *objectStore) initWorkDirectory(dir, rawURL string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	repository, err := git.PlainInit(dir, false)
+	if err != nil {
+		return fmt.Errorf("failed to initialize work directory: %w", err)
+	}
+	if _, err := repository.CreateRemote(&config.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{rawURL}}); err != nil {
+		return fmt.Errorf("failed to configure remote: %w", err)
+	}
+	alternates := filepath.Join(dir, git.GitDirName, "objects", "info", "alternates")
+	if err := os.MkdirAll(filepath.Dir(alternates), 0755); err != nil {
+		return fmt.Errorf("failed to create objects directory: %w", err)
+	}
+	if err := os.WriteFile(alternates, []byte(filepath.Join(s.dir, "objects")+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to link object store: %w", err)
+	}
+	return nil
+}
+
+// checkout checks out the given commit into the given worktree of a work directory using the store, optionally only
+// under the given sparse paths (see the checkout function).
+func (s *objectStore) checkout(repository *git.Repository, worktree *git.Worktree, hash plumbing.Hash, sparsePaths []string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return checkout(repository, worktree, hash, sparsePaths)
+}
+
+// openWorkDirectory opens the given work directory, reading objects from the store (and keeping its references, index
+// & configuration in the work directory itself). Fails with errWorkDirectoryNotShared if the work directory does not
+// refer to the store's objects.
+func (s *objectStore) openWorkDirectory(dir string) (*git.Repository, error) {
+	alternates, err := os.ReadFile(filepath.Join(dir, git.GitDirName, "objects", "info", "alternates"))
+	if errors.Is(err, os.ErrNotExist) || err == nil && strings.TrimSpace(string(alternates)) != filepath.Join(s.dir, "objects") {
+		return nil, errWorkDirectoryNotShared
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read alternates: %w", err)
+	}
+
+	store, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	local := filesystem.NewStorage(osfs.New(filepath.Join(dir, git.GitDirName)), cache.NewObjectLRUDefault())
+	return git.Open(&workDirectoryStorage{
+		EncodedObjectStorer: store.Storer,
+		ShallowStorer:       store.Storer,
+		ReferenceStorer:     local,
+		IndexStorer:         local,
+		ConfigStorer:        local,
+		ModuleStorer:        local,
+	}, osfs.New(dir))
+}
+
+// remove deletes the store's bare repository; it's re-initialized if used again. Callers must lock the store.
+func (s *objectStore) remove() error {
+	s.storageMu.Lock()
+	defer s.storageMu.Unlock()
+
+	s.storage = nil
+	if err := os.RemoveAll(s.dir); err != nil {
+		return fmt.Errorf("failed to remove object store at '%s': %w", s.dir, err)
+	}
+	return nil
+}
+
+// workDirectoryStorage is the storage of a work directory, reading & writing objects (and shallow commits) from its
+// object store, and references, index & configuration from the work directory itself.
+type workDirectoryStorage struct {
+	storer.EncodedObjectStorer
+	storer.ShallowStorer
+	storer.ReferenceStorer
+	storer.IndexStorer
+	config.ConfigStorer
+	storage.ModuleStorer
+}
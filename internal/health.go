@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/cli-utils/pkg/kstatus/status"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"time"
+)
+
+const (
+	reasonHealthy             = "Healthy"           // Reason of bundles whose objects are all ready
+	reasonProgressing         = "Progressing"       // Reason of bundles waiting for their objects to become ready
+	reasonUnhealthy           = "Unhealthy"         // Reason of bundles whose objects failed, or did not become ready in time
+	reasonHealthNotChecked    = "NotChecked"        // Reason of bundles that do not check the health of their objects
+	reasonHealthCheckFailed   = "HealthCheckFailed" // Reason of bundles whose objects' health could not be checked
+	defaultHealthCheckTimeout = 5 * time.Minute     // Default maximum duration of waiting for objects to become ready
+	healthCheckPollInterval   = 5 * time.Second     // Interval of polling objects that are not ready yet
+)
+
+// healthCheckEntries returns the objects whose health the given bundle checks: its inventory when it waits for its
+// objects, as well as its explicit health checks (defaulting to the bundle's namespace).
+func healthCheckEntries(o *v1alpha1.KubectlBundle) []v1alpha1.InventoryEntry {
+	var entries []v1alpha1.InventoryEntry
+	for _, check := range o.Spec.HealthChecks {
+		gv, _ := schema.ParseGroupVersion(check.APIVersion)
+		namespace := check.Namespace
+		if namespace == "" {
+			namespace = o.Namespace
+		}
+		entries = append(entries, v1alpha1.InventoryEntry{Group: gv.Group, Version: gv.Version, Kind: check.Kind, Namespace: namespace, Name: check.Name})
+	}
+	if o.Spec.Wait {
+		return mergeInventory(o.Status.Inventory, entries)
+	}
+	return entries
+}
+
+// checkObjectsHealth assesses the readiness of the objects of the given inventory entries using kstatus rules (e.g.
+// Deployments rolled out, Jobs complete, and custom resources with a "Ready" condition), and returns the objects that
+// are still in progress (including missing objects), as well as those that failed, formatted for humans.
+func checkObjectsHealth(ctx context.Context, c client.Client, entries []v1alpha1.InventoryEntry) ([]string, []string, error) {
+	var progressing, failed []string
+	for _, entry := range entries {
+		name := entry.Name
+		if entry.Namespace != "" {
+			name = entry.Namespace + "/" + name
+		}
+
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(schema.GroupVersionKind{Group: entry.Group, Version: entry.Version, Kind: entry.Kind})
+		if err := c.Get(ctx, client.ObjectKey{Namespace: entry.Namespace, Name: entry.Name}, obj); apierrors.IsNotFound(err) {
+			progressing = append(progressing, fmt.Sprintf("%s %s: not found", entry.Kind, name))
+			continue
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("failed to get %s '%s': %w", entry.Kind, name, err)
+		}
+
+		result, err := status.Compute(obj)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to compute status of %s '%s': %w", entry.Kind, name, err)
+		}
+		switch result.Status {
+		case status.CurrentStatus:
+		case status.FailedStatus:
+			failed = append(failed, fmt.Sprintf("%s %s: %s", entry.Kind, name, result.Message))
+		default:
+			progressing = append(progressing, fmt.Sprintf("%s %s: %s", entry.Kind, name, result.Message))
+		}
+	}
+	return progressing, failed, nil
+}
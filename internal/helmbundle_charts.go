@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/kube"
+	"helm.sh/helm/v3/pkg/repo"
+	"io"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"net/http"
+	"path/filepath"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/yaml"
+	"strings"
+	"time"
+)
+
+const (
+	helmStorageDriver    = "secret"        // Helm release storage driver
+	helmMaxDownloadBytes = 100 << 20       // Maximum size of downloaded chart repository indices & chart archives
+	helmHTTPTimeout      = 1 * time.Minute // Timeout for chart repository requests
+	helmMaxHistory       = 10              // Maximum number of revisions kept per release by upgrades & rollbacks
+)
+
+// helmRESTClientGetter adapts a REST config to the RESTClientGetter interface expected by the Helm SDK.
+type helmRESTClientGetter struct {
+	config    *rest.Config // REST config of the target cluster
+	namespace string       // Default namespace for release objects
+}
+
+func (g *helmRESTClientGetter) ToRESTConfig() (*rest.Config, error) {
+	return rest.CopyConfig(g.config), nil
+}
+
+func (g *helmRESTClientGetter) ToDiscoveryClient() (discovery.CachedDiscoveryInterface, error) {
+	dc, err := discovery.NewDiscoveryClientForConfig(g.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create discovery client: %w", err)
+	}
+	return memory.NewMemCacheClient(dc), nil
+}
+
+func (g *helmRESTClientGetter) ToRESTMapper() (meta.RESTMapper, error) {
+	dc, err := g.ToDiscoveryClient()
+	if err != nil {
+		return nil, err
+	}
+	return restmapper.NewShortcutExpander(restmapper.NewDeferredDiscoveryRESTMapper(dc), dc), nil
+}
+
+func (g *helmRESTClientGetter) ToRawKubeConfigLoader() clientcmd.ClientConfig {
+	overrides := &clientcmd.ConfigOverrides{Context: clientcmdapi.Context{Namespace: g.namespace}}
+	return clientcmd.NewDefaultClientConfig(*clientcmdapi.NewConfig(), overrides)
+}
+
+// newHelmConfiguration creates a Helm action configuration for managing releases in the given namespace.
+func newHelmConfiguration(config *rest.Config, namespace string) (*action.Configuration, error) {
+	log := ctrl.Log.WithName("helm").WithValues("namespace", namespace)
+	cfg := &action.Configuration{}
+	if err := cfg.Init(&helmRESTClientGetter{config: config, namespace: namespace}, namespace, helmStorageDriver, func(format string, v ...interface{}) {
+		log.V(1).Info(fmt.Sprintf(format, v...))
+	}); err != nil {
+		return nil, fmt.Errorf("failed to initialize Helm: %w", err)
+	}
+	cfg.KubeClient.(*kube.Client).Namespace = namespace
+	return cfg, nil
+}
+
+// loadChartFromDirectory loads the chart at the given path, relative to the given directory.
+func loadChartFromDirectory(dir, path string) (*chart.Chart, error) {
+	target := filepath.Join(dir, path)
+	if rel, err := filepath.Rel(dir, target); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("chart path '%s' is outside the repository", path)
+	}
+	c, err := loader.Load(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load chart '%s': %w", path, err)
+	}
+	return c, nil
+}
+
+// resolveChartVersion fetches the index of the given chart repository, and returns the highest version of the given
+// chart matching the given version constraint (or the latest version if no constraint is given).
+func resolveChartVersion(ctx context.Context, repositoryURL, name, version string) (*repo.ChartVersion, error) {
+	indexURL := strings.TrimSuffix(repositoryURL, "/") + "/index.yaml"
+	data, err := httpGet(ctx, indexURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch chart repository index: %w", err)
+	}
+
+	index := repo.NewIndexFile()
+	if err := yaml.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("failed to parse chart repository index: %w", err)
+	}
+	index.SortEntries()
+
+	chartVersion, err := index.Get(name, version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find chart '%s' version '%s': %w", name, version, err)
+	} else if len(chartVersion.URLs) == 0 {
+		return nil, fmt.Errorf("chart '%s' version '%s' has no download URLs", name, chartVersion.Version)
+	}
+	return chartVersion, nil
+}
+
+// downloadChart downloads & loads the given chart version from the given chart repository.
+func downloadChart(ctx context.Context, repositoryURL string, chartVersion *repo.ChartVersion) (*chart.Chart, error) {
+	chartURL, err := repo.ResolveReferenceURL(repositoryURL, chartVersion.URLs[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve chart URL '%s': %w", chartVersion.URLs[0], err)
+	}
+	data, err := httpGet(ctx, chartURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download chart: %w", err)
+	}
+	c, err := loader.LoadArchive(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load chart archive '%s': %w", chartURL, err)
+	}
+	return c, nil
+}
+
+// httpGet fetches the given URL, failing on non-200 responses.
+func httpGet(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, helmHTTPTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request for '%s': %w", url, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch '%s': %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch '%s': %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, helmMaxDownloadBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read '%s': %w", url, err)
+	}
+	return data, nil
+}
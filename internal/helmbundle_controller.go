@@ -0,0 +1,437 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	kstrings "k8s.io/utils/strings"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"time"
+)
+
+const (
+	finalizerHelmBundle     = "helmbundles.kude.kfirs.com/finalizer"
+	typeUpToDateHelmBundle  = "UpToDate"  // Is the HelmBundle release up to date?
+	typeDegradedHelmBundle  = "Degraded"  // When the HelmBundle is deleted, but finalizer not applied yet
+	typeSuspendedHelmBundle = "Suspended" // Is reconciliation of the HelmBundle suspended?
+)
+
+// HelmBundleReconciler reconciles a HelmBundle object
+type HelmBundleReconciler struct {
+	Client                client.Client        // Kubernetes API client
+	Recorder              record.EventRecorder // Kubernetes event recorder
+	Scheme                *runtime.Scheme      // Scheme registry
+	Config                *rest.Config         // REST config of the cluster the controller runs in; defaults to the manager's config
+	DefaultServiceAccount string               // Service account to impersonate for local bundles not specifying one
+	targets               *targetClusters      // Clients of remote clusters that bundles are applied to
+}
+
+//+kubebuilder:rbac:groups=kude.kfirs.com,resources=helmbundles,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=kude.kfirs.com,resources=helmbundles/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=kude.kfirs.com,resources=helmbundles/finalizers,verbs=update
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=get;list;watch;impersonate
+//+kubebuilder:rbac:groups=core,resources=groups,verbs=impersonate
+
+// Reconcile continuously aims to move the current state of [HelmBundle] objects closer to their desired state.
+func (r *HelmBundleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var o v1alpha1.HelmBundle
+	if err := r.Client.Get(ctx, req.NamespacedName, &o); err != nil {
+		// we'll ignore not-found errors, since they can't be fixed by an immediate
+		// requeue (we'll need to wait for a new notification), and we can get them
+		// on deleted requests.
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// Ensure statuses have the "Unknown" value when they are missing
+	if meta.FindStatusCondition(o.Status.Conditions, typeUpToDateHelmBundle) == nil {
+		if res, err := r.setCondition(ctx, &o, typeUpToDateHelmBundle, metav1.ConditionUnknown, "Reconciling", "Initial value"); res.Requeue || err != nil {
+			return res, err
+		}
+	}
+	if meta.FindStatusCondition(o.Status.Conditions, typeDegradedHelmBundle) == nil {
+		if res, err := r.setCondition(ctx, &o, typeDegradedHelmBundle, metav1.ConditionFalse, "Reconciling", "Initial value"); res.Requeue || err != nil {
+			return res, err
+		}
+	}
+
+	// Add our finalizer
+	if controllerutil.AddFinalizer(&o, finalizerHelmBundle) {
+		if err := r.Client.Update(ctx, &o); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to update HelmBundle with finalizer: %w", err)
+		} else {
+			return ctrl.Result{Requeue: true}, nil
+		}
+	}
+
+	// If marked for deletion, uninstall the release & remove finalizer
+	if o.DeletionTimestamp != nil {
+		if res, err := r.setCondition(ctx, &o, typeDegradedHelmBundle, metav1.ConditionTrue, "Deleted", "Deleting resource"); res.Requeue || err != nil {
+			return res, err
+		}
+		if res, err := r.setCondition(ctx, &o, typeUpToDateHelmBundle, metav1.ConditionUnknown, "Deleted", "Deleting resource"); res.Requeue || err != nil {
+			return res, err
+		}
+		// Without its kubeconfig or service account (e.g. when its namespace is being deleted), the release is left in place
+		if config, _, reason, err := r.targets.connect(ctx, r.Client, r.Config, o.Namespace, o.Spec.KubeConfig, o.Spec.ServiceAccountName); isTargetMissing(err) {
+			r.Recorder.Eventf(&o, v1.EventTypeWarning, reason, "Not uninstalling release '%s': %s", releaseName(&o), err)
+		} else if err != nil {
+			r.Recorder.Eventf(&o, v1.EventTypeWarning, reason, err.Error())
+			return ctrl.Result{}, err
+		} else if err := r.uninstall(config, &o); err != nil {
+			r.Recorder.Eventf(&o, v1.EventTypeWarning, "UninstallFailed", "Failed uninstalling release '%s': %s", releaseName(&o), err)
+			return ctrl.Result{}, err
+		}
+		if controllerutil.RemoveFinalizer(&o, finalizerHelmBundle) {
+			if err := r.Client.Update(ctx, &o); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		return ctrl.Result{}, nil
+	}
+
+	// Skip all work while suspended; we'll be notified when resumed
+	if o.Spec.Suspend {
+		if !meta.IsStatusConditionTrue(o.Status.Conditions, typeSuspendedHelmBundle) {
+			r.Recorder.Event(&o, v1.EventTypeNormal, "Suspended", "Reconciliation suspended")
+		}
+		return r.setCondition(ctx, &o, typeSuspendedHelmBundle, metav1.ConditionTrue, "Suspended", "Reconciliation is suspended")
+	} else if meta.IsStatusConditionTrue(o.Status.Conditions, typeSuspendedHelmBundle) {
+		r.Recorder.Event(&o, v1.EventTypeNormal, "Resumed", "Reconciliation resumed")
+	}
+	if res, err := r.setCondition(ctx, &o, typeSuspendedHelmBundle, metav1.ConditionFalse, "NotSuspended", ""); res.Requeue || err != nil {
+		return res, err
+	}
+
+	// Validate chart source
+	if (o.Spec.Repository == "") == (o.Spec.SourceRepository == "") {
+		return r.setCondition(ctx, &o, typeUpToDateHelmBundle, metav1.ConditionFalse, "InvalidSpec", "Exactly one of 'repository' or 'sourceRepository' must be specified")
+	}
+
+	// Get interval
+	checkInterval := o.Spec.Interval
+	if checkInterval == "" {
+		checkInterval = "10m"
+	}
+	interval, err := time.ParseDuration(checkInterval)
+	if err != nil {
+		return r.setCondition(ctx, &o, typeUpToDateHelmBundle, metav1.ConditionFalse, "InvalidInterval", "Invalid interval: "+checkInterval)
+	}
+
+	// Wait for dependencies to be up-to-date with their current commit; we'll be notified when they change
+	if reason, message, err := checkDependencies(ctx, r.Client, "HelmBundle", &o); err != nil {
+		return ctrl.Result{}, err
+	} else if reason != "" {
+		return r.setCondition(ctx, &o, typeUpToDateHelmBundle, metav1.ConditionFalse, reason, message)
+	}
+
+	// Connect to the bundle's target cluster, impersonating the bundle's service account, if any
+	config, _, reason, err := r.targets.connect(ctx, r.Client, r.Config, o.Namespace, o.Spec.KubeConfig, o.Spec.ServiceAccountName)
+	if err != nil {
+		r.Recorder.Eventf(&o, v1.EventTypeWarning, reason, err.Error())
+		if res, err := r.setCondition(ctx, &o, typeUpToDateHelmBundle, metav1.ConditionFalse, reason, err.Error()); err != nil {
+			return res, err
+		}
+		// Return an error, so the request is retried with backoff
+		return ctrl.Result{}, err
+	}
+
+	// Load the chart, unless the installed release is already up-to-date and no reconciliation was requested since it
+	// was installed
+	requested := reconcileRequestedAt(&o)
+	var c *chart.Chart
+	var sha string
+	if o.Spec.SourceRepository != "" {
+		var repo v1alpha1.GitRepository
+		gitRepoNamespace, gitRepoName := kstrings.SplitQualifiedName(o.Spec.SourceRepository)
+		if err := r.Client.Get(ctx, types.NamespacedName{Namespace: gitRepoNamespace, Name: gitRepoName}, &repo); err != nil {
+			return r.setCondition(ctx, &o, typeUpToDateHelmBundle, metav1.ConditionUnknown, "GitRepositoryNotFound", err.Error())
+		} else if !meta.IsStatusConditionTrue(repo.Status.Conditions, typeAvailableGitRepository) {
+			return r.setCondition(ctx, &o, typeUpToDateHelmBundle, metav1.ConditionUnknown, "GitRepositoryNotAvailable", "")
+		}
+		sha = repo.Status.LastPulledSHA
+		if r.isUpToDate(&o) && o.Status.LastAppliedSHA == sha && o.Status.LastHandledReconcileAt == requested {
+			return r.setCondition(ctx, &o, typeUpToDateHelmBundle, metav1.ConditionTrue, "UpToDate", "Release is up-to-date with current repository SHA")
+		}
+		c, err = loadChartFromDirectory(repo.Status.WorkDirectory, o.Spec.Chart)
+		if err != nil {
+			return r.failChartLoad(ctx, &o, err)
+		}
+	} else {
+		chartVersion, err := resolveChartVersion(ctx, o.Spec.Repository, o.Spec.Chart, o.Spec.Version)
+		if err != nil {
+			return r.failChartLoad(ctx, &o, err)
+		}
+		if r.isUpToDate(&o) && o.Status.ChartVersion == chartVersion.Version && o.Status.LastHandledReconcileAt == requested {
+			if res, err := r.setCondition(ctx, &o, typeUpToDateHelmBundle, metav1.ConditionTrue, "UpToDate", "Release is up-to-date with latest chart version"); res.Requeue || err != nil {
+				return res, err
+			}
+			return ctrl.Result{RequeueAfter: interval}, nil
+		}
+		c, err = downloadChart(ctx, o.Spec.Repository, chartVersion)
+		if err != nil {
+			return r.failChartLoad(ctx, &o, err)
+		}
+	}
+
+	// Parse values
+	values, err := chartutil.ReadValues([]byte(o.Spec.Values))
+	if err != nil {
+		return r.setCondition(ctx, &o, typeUpToDateHelmBundle, metav1.ConditionFalse, "InvalidValues", err.Error())
+	}
+
+	// Install or upgrade the release
+	rel, reason, err := r.installOrUpgrade(config, &o, c, values)
+	if rel != nil {
+		o.Status.ChartStatus = rel.Info.Status.String()
+		o.Status.ChartVersion = rel.Chart.Metadata.Version
+		o.Status.Revision = rel.Version
+	} else {
+		o.Status.ChartStatus = ""
+		o.Status.Revision = 0
+	}
+	if err == nil {
+		o.Status.LastAppliedSHA = sha
+		o.Status.ObservedGeneration = o.Generation
+		o.Status.LastHandledReconcileAt = requested
+	}
+	if err := r.Client.Status().Update(ctx, &o); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to update HelmBundle status: %w", err)
+	}
+	if err != nil {
+		r.Recorder.Eventf(&o, v1.EventTypeWarning, reason, "Failed installing release '%s': %s", releaseName(&o), err)
+		if res, err := r.setCondition(ctx, &o, typeUpToDateHelmBundle, metav1.ConditionFalse, reason, err.Error()); err != nil {
+			return res, err
+		}
+		// Return an error, so the request is retried with backoff
+		return ctrl.Result{}, fmt.Errorf("failed installing release '%s': %w", releaseName(&o), err)
+	}
+	r.Recorder.Eventf(&o, v1.EventTypeNormal, reason, "Release '%s' revision %d of chart '%s' version '%s' is %s", rel.Name, rel.Version, rel.Chart.Metadata.Name, rel.Chart.Metadata.Version, rel.Info.Status)
+	if res, err := r.setCondition(ctx, &o, typeUpToDateHelmBundle, metav1.ConditionTrue, "UpToDate", "Release is up-to-date"); res.Requeue || err != nil {
+		return res, err
+	}
+	if o.Spec.Repository != "" {
+		return ctrl.Result{RequeueAfter: interval}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// releaseName returns the name of the Helm release managed by the given bundle.
+func releaseName(o *v1alpha1.HelmBundle) string {
+	if o.Spec.Release != "" {
+		return o.Spec.Release
+	}
+	return o.Name
+}
+
+// isUpToDate checks whether the current generation of the given bundle was successfully installed.
+func (r *HelmBundleReconciler) isUpToDate(o *v1alpha1.HelmBundle) bool {
+	return o.Status.ObservedGeneration == o.Generation && o.Status.ChartStatus == release.StatusDeployed.String()
+}
+
+// failChartLoad records the given chart loading error in the bundle's status, and returns an error so the request is
+// retried with backoff.
+func (r *HelmBundleReconciler) failChartLoad(ctx context.Context, o *v1alpha1.HelmBundle, err error) (ctrl.Result, error) {
+	r.Recorder.Eventf(o, v1.EventTypeWarning, "ChartLoadFailed", "Failed loading chart '%s': %s", o.Spec.Chart, err)
+	if res, err := r.setCondition(ctx, o, typeUpToDateHelmBundle, metav1.ConditionFalse, "ChartLoadFailed", err.Error()); err != nil {
+		return res, err
+	}
+	return ctrl.Result{}, err
+}
+
+// installOrUpgrade installs the given chart using the given REST config if the bundle's release does not exist yet, or
+// upgrades it otherwise. A failed installation is uninstalled, and a failed upgrade is rolled back to the previous
+// revision; releases stuck in a pending state are recovered first. It returns the resulting release (if any) and the
+// reason to report.
+func (r *HelmBundleReconciler) installOrUpgrade(config *rest.Config, o *v1alpha1.HelmBundle, c *chart.Chart, values map[string]interface{}) (*release.Release, string, error) {
+	cfg, err := newHelmConfiguration(config, o.Namespace)
+	if err != nil {
+		return nil, "InstallFailed", err
+	}
+	name := releaseName(o)
+
+	last, err := cfg.Releases.Last(name)
+	if err == nil && last.Info.Status.IsPending() {
+		r.Recorder.Eventf(o, v1.EventTypeWarning, "PendingRelease", "Recovering release '%s' stuck in '%s' status", name, last.Info.Status)
+		if err = recoverPendingRelease(cfg, last); err != nil {
+			return nil, "RecoveryFailed", err
+		}
+		_, err = cfg.Releases.Last(name)
+	}
+	if errors.Is(err, driver.ErrReleaseNotFound) {
+		install := action.NewInstall(cfg)
+		install.ReleaseName = name
+		install.Namespace = o.Namespace
+		rel, err := install.Run(c, values)
+		if err != nil {
+			if _, uninstallErr := action.NewUninstall(cfg).Run(name); uninstallErr != nil && !errors.Is(uninstallErr, driver.ErrReleaseNotFound) {
+				return rel, "InstallFailed", fmt.Errorf("%w (failed uninstalling failed release: %s)", err, uninstallErr)
+			}
+			return nil, "InstallFailed", err
+		}
+		return rel, "Installed", nil
+	} else if err != nil {
+		return nil, "InstallFailed", fmt.Errorf("failed to fetch release history: %w", err)
+	}
+
+	upgrade := action.NewUpgrade(cfg)
+	upgrade.Namespace = o.Namespace
+	upgrade.MaxHistory = helmMaxHistory
+	rel, err := upgrade.Run(name, c, values)
+	if err != nil {
+		rollback := action.NewRollback(cfg)
+		rollback.MaxHistory = helmMaxHistory
+		if rollbackErr := rollback.Run(name); rollbackErr != nil {
+			return rel, "UpgradeFailed", fmt.Errorf("%w (failed rolling back: %s)", err, rollbackErr)
+		}
+		if rel, getErr := action.NewGet(cfg).Run(name); getErr == nil {
+			return rel, "RolledBack", err
+		}
+		return nil, "RolledBack", err
+	}
+	return rel, "Upgraded", nil
+}
+
+// recoverPendingRelease recovers the given release from a pending state (e.g. when the controller restarted in the
+// middle of an operation), since Helm refuses to operate on pending releases: a pending upgrade or rollback is rolled
+// back to the last successfully deployed revision, while a pending installation (or a release without such a revision)
+// is uninstalled.
+func recoverPendingRelease(cfg *action.Configuration, last *release.Release) error {
+	history, err := cfg.Releases.History(last.Name)
+	if err != nil {
+		return fmt.Errorf("failed to fetch history of release '%s': %w", last.Name, err)
+	}
+	previous := 0
+	for _, rel := range history {
+		if rel.Version < last.Version && rel.Version > previous && (rel.Info.Status == release.StatusDeployed || rel.Info.Status == release.StatusSuperseded) {
+			previous = rel.Version
+		}
+	}
+
+	if last.Info.Status == release.StatusPendingInstall || previous == 0 {
+		if _, err := action.NewUninstall(cfg).Run(last.Name); err != nil && !errors.Is(err, driver.ErrReleaseNotFound) {
+			return fmt.Errorf("failed to uninstall pending release '%s': %w", last.Name, err)
+		}
+		return nil
+	}
+
+	rollback := action.NewRollback(cfg)
+	rollback.Version = previous
+	rollback.MaxHistory = helmMaxHistory
+	if err := rollback.Run(last.Name); err != nil {
+		return fmt.Errorf("failed to roll back pending release '%s' to revision %d: %w", last.Name, previous, err)
+	}
+	return nil
+}
+
+// uninstall uninstalls the bundle's release using the given REST config, if it exists.
+func (r *HelmBundleReconciler) uninstall(config *rest.Config, o *v1alpha1.HelmBundle) error {
+	cfg, err := newHelmConfiguration(config, o.Namespace)
+	if err != nil {
+		return err
+	}
+	if _, err := action.NewUninstall(cfg).Run(releaseName(o)); err != nil && !errors.Is(err, driver.ErrReleaseNotFound) {
+		return fmt.Errorf("failed to uninstall release '%s': %w", releaseName(o), err)
+	}
+	return nil
+}
+
+func (r *HelmBundleReconciler) findObjectsForGitRepository(gr client.Object) []reconcile.Request {
+	grKey := gr.GetNamespace() + "/" + gr.GetName()
+
+	bundles := &v1alpha1.HelmBundleList{}
+	listOps := &client.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector(".spec.sourceRepository", grKey),
+	}
+	err := r.Client.List(context.TODO(), bundles, listOps)
+	if err != nil {
+		ctrl.Log.Error(err, "Failed listing Helm bundles for GitRepository", "gitRepository", grKey)
+		return []reconcile.Request{}
+	}
+
+	requests := make([]reconcile.Request, len(bundles.Items))
+	for i, b := range bundles.Items {
+		requests[i] = reconcile.Request{
+			NamespacedName: types.NamespacedName{
+				Name:      b.GetName(),
+				Namespace: b.GetNamespace(),
+			},
+		}
+	}
+	return requests
+}
+
+func (r *HelmBundleReconciler) setCondition(ctx context.Context, o *v1alpha1.HelmBundle, conditionType string, status metav1.ConditionStatus, reason, message string) (ctrl.Result, error) {
+	if c := meta.FindStatusCondition(o.Status.Conditions, conditionType); c == nil || c.Status != status || c.Reason != reason || c.Message != message {
+		meta.SetStatusCondition(&o.Status.Conditions, metav1.Condition{
+			Type:    conditionType,
+			Status:  status,
+			Reason:  reason,
+			Message: message,
+		})
+		if err := r.Client.Status().Update(ctx, o); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to set condition '%s' to '%s' with reason '%s': %w", conditionType, status, reason, err)
+		} else {
+			return ctrl.Result{Requeue: true}, nil
+		}
+	} else {
+		return ctrl.Result{}, nil
+	}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *HelmBundleReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.Client = mgr.GetClient()
+	r.Scheme = mgr.GetScheme()
+	r.Recorder = mgr.GetEventRecorderFor("helmbundle")
+	if r.Config == nil {
+		r.Config = mgr.GetConfig()
+	}
+	r.targets = newTargetClusters(r.DefaultServiceAccount)
+
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &v1alpha1.HelmBundle{}, ".spec.sourceRepository", func(rawObj client.Object) []string {
+		bundle := rawObj.(*v1alpha1.HelmBundle)
+		if bundle.Spec.SourceRepository == "" {
+			return nil
+		}
+		return []string{bundle.Spec.SourceRepository}
+	}); err != nil {
+		return fmt.Errorf("failed to create index for source-repository: %w", err)
+	}
+
+	if err := indexDependencies(mgr, "HelmBundle"); err != nil {
+		return err
+	}
+
+	if err := indexKubeConfigs(mgr, "HelmBundle"); err != nil {
+		return err
+	}
+
+	b := ctrl.NewControllerManagedBy(mgr).
+		For(&v1alpha1.HelmBundle{}).
+		Watches(
+			&source.Kind{Type: &v1alpha1.GitRepository{}},
+			handler.EnqueueRequestsFromMapFunc(r.findObjectsForGitRepository),
+		)
+	b = watchDependencies(b, r.Client, &v1alpha1.HelmBundleList{})
+	return watchKubeConfigs(b, r.Client, &v1alpha1.HelmBundleList{}).Complete(r)
+}
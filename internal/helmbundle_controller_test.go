@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+	"github.com/arikkfir/kude-controller/test/gittest"
+	"github.com/arikkfir/kude-controller/test/harness"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/repo"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"testing"
+	"time"
+)
+
+const helmTestConfigMapTemplate = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}-cm
+data:
+  key: {{ .Values.key | quote }}
+  version: {{ .Chart.Version | quote }}
+`
+
+func TestIgnoreMissingHelmBundleResource(t *testing.T) {
+	reconciler := &HelmBundleReconciler{}
+	_, _, _ = harness.SetupTestEnv(t, reconciler)
+
+	time.Sleep(5 * time.Second) // Give manager and cache time to start; needed since we're directly invoking controller
+	res, err := reconciler.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: types.NamespacedName{
+			Namespace: "ns1",
+			Name:      "r1",
+		},
+	})
+	assert.NoErrorf(t, err, "expected reconciliation for missing resource NOT to fail")
+	assert.Falsef(t, res.Requeue, "expected reconciliation for missing resource NOT to request requeuing, got: %+v", res)
+}
+
+// serveHelmRepository packages a test chart for each of the given versions, and serves them from a chart repository
+// index over HTTP.
+func serveHelmRepository(t *testing.T, name string, versions ...string) *httptest.Server {
+	dir := t.TempDir()
+	for _, version := range versions {
+		c := &chart.Chart{
+			Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: name, Version: version},
+			Raw:      []*chart.File{{Name: chartutil.ValuesfileName, Data: []byte("key: default\n")}},
+			Templates: []*chart.File{
+				{Name: "templates/configmap.yaml", Data: []byte(helmTestConfigMapTemplate)},
+			},
+		}
+		_, err := chartutil.Save(c, dir)
+		require.NoErrorf(t, err, "failed to package chart version '%s'", version)
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	t.Cleanup(server.Close)
+
+	index, err := repo.IndexDirectory(dir, server.URL)
+	require.NoErrorf(t, err, "failed to index charts")
+	require.NoErrorf(t, index.WriteFile(filepath.Join(dir, "index.yaml"), 0600), "failed to write index")
+	return server
+}
+
+// createHelmBundle creates a HelmBundle with the given spec.
+func createHelmBundle(t *testing.T, k8sClient client.Client, spec v1alpha1.HelmBundleSpec) *v1alpha1.HelmBundle {
+	bundle := &v1alpha1.HelmBundle{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.HelmBundle{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bundle1",
+			Namespace: "default",
+		},
+		Spec: spec,
+	}
+	require.NoErrorf(t, k8sClient.Create(context.Background(), bundle), "bundle creation failed")
+	return bundle
+}
+
+// assertHelmRelease waits until the given bundle's release is deployed with the given chart version & revision, and
+// its config map contains the given value.
+func assertHelmRelease(t *testing.T, k8sClient client.Client, bundle *v1alpha1.HelmBundle, version string, revision int, value string) {
+	ctx := context.Background()
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.HelmBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			assert.Contains(c, b.Finalizers, finalizerHelmBundle, "finalizer not found")
+			assert.Equal(c, "deployed", b.Status.ChartStatus, "incorrect chart status")
+			assert.Equal(c, version, b.Status.ChartVersion, "incorrect chart version")
+			assert.Equal(c, revision, b.Status.Revision, "incorrect revision")
+			assert.True(c, meta.IsStatusConditionTrue(b.Status.Conditions, typeUpToDateHelmBundle), "bundle not up to date")
+		}
+		var cm corev1.ConfigMap
+		if assert.NoErrorf(c, k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "bundle1-cm"}, &cm), "config map lookup failed") {
+			assert.Equal(c, value, cm.Data["key"], "incorrect config map value")
+			assert.Equal(c, version, cm.Data["version"], "incorrect config map version")
+		}
+	}, 30*time.Second, 1*time.Second, "release not deployed correctly")
+}
+
+func TestHelmBundleFromGitRepository(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("charts/chart1/Chart.yaml", "apiVersion: v2\nname: chart1\nversion: 1.0.0\n"), "failed to commit file")
+	require.NoErrorf(t, repository.CommitFile("charts/chart1/values.yaml", "key: default\n"), "failed to commit file")
+	require.NoErrorf(t, repository.CommitFile("charts/chart1/templates/configmap.yaml", helmTestConfigMapTemplate), "failed to commit file")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &HelmBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	ctx := context.Background()
+	repo := &v1alpha1.GitRepository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.GitRepository{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "repo1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.GitRepositorySpec{
+			URL:             repository.URL.String(),
+			Ref:             "refs/heads/main",
+			PollingInterval: "1s",
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, repo), "repository creation failed")
+	bundle := createHelmBundle(t, k8sClient, v1alpha1.HelmBundleSpec{
+		Chart:            "charts/chart1",
+		SourceRepository: repo.Namespace + "/" + repo.Name,
+		Values:           "key: value1\n",
+	})
+	assertHelmRelease(t, k8sClient, bundle, "1.0.0", 1, "value1")
+
+	// A new commit should upgrade the release
+	require.NoErrorf(t, repository.CommitFile("charts/chart1/Chart.yaml", "apiVersion: v2\nname: chart1\nversion: 1.1.0\n"), "failed to commit file")
+	assertHelmRelease(t, k8sClient, bundle, "1.1.0", 2, "value1")
+
+	// Deleting the bundle should uninstall the release
+	require.NoErrorf(t, k8sClient.Delete(ctx, bundle), "bundle deletion failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.HelmBundle
+		assert.True(c, apierrors.IsNotFound(k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b)), "bundle not deleted")
+		var cm corev1.ConfigMap
+		assert.True(c, apierrors.IsNotFound(k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "bundle1-cm"}, &cm)), "release not uninstalled")
+	}, 30*time.Second, 1*time.Second, "release not uninstalled on deletion")
+}
+
+func TestHelmBundleFromChartRepository(t *testing.T) {
+	server := serveHelmRepository(t, "chart1", "1.0.0", "1.1.0", "2.0.0")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &HelmBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	ctx := context.Background()
+	bundle := createHelmBundle(t, k8sClient, v1alpha1.HelmBundleSpec{
+		Chart:      "chart1",
+		Repository: server.URL,
+		Version:    "~1.0",
+	})
+	assertHelmRelease(t, k8sClient, bundle, "1.0.0", 1, "default")
+
+	// Changing the version constraint & values should upgrade the release
+	var b v1alpha1.HelmBundle
+	require.NoErrorf(t, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed")
+	b.Spec.Version = "^1"
+	b.Spec.Values = "key: value2\n"
+	require.NoErrorf(t, k8sClient.Update(ctx, &b), "bundle update failed")
+	assertHelmRelease(t, k8sClient, bundle, "1.1.0", 2, "value2")
+}
+
+func TestHelmBundlePendingRelease(t *testing.T) {
+	server := serveHelmRepository(t, "chart1", "1.0.0", "1.1.0")
+
+	k8sClient, k8sConfig, _ := harness.SetupTestEnv(t, &HelmBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	ctx := context.Background()
+	bundle := createHelmBundle(t, k8sClient, v1alpha1.HelmBundleSpec{
+		Chart:      "chart1",
+		Repository: server.URL,
+		Version:    "1.0.0",
+	})
+	assertHelmRelease(t, k8sClient, bundle, "1.0.0", 1, "default")
+
+	var b v1alpha1.HelmBundle
+	require.NoErrorf(t, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed")
+	b.Spec.Version = "1.1.0"
+	require.NoErrorf(t, k8sClient.Update(ctx, &b), "bundle update failed")
+	assertHelmRelease(t, k8sClient, bundle, "1.1.0", 2, "default")
+
+	// Simulate an upgrade interrupted midway (e.g. by a controller restart), leaving the release in a pending state
+	cfg, err := newHelmConfiguration(k8sConfig, "default")
+	require.NoErrorf(t, err, "failed to create Helm configuration")
+	rel, err := cfg.Releases.Last(releaseName(bundle))
+	require.NoErrorf(t, err, "failed to get release")
+	rel.SetStatus(release.StatusPendingUpgrade, "Interrupted")
+	require.NoErrorf(t, cfg.Releases.Update(rel), "failed to update release")
+
+	// The pending release should be rolled back to revision 1 (revision 3) before being upgraded (revision 4)
+	require.NoErrorf(t, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed")
+	b.Spec.Version = "1.0.0"
+	require.NoErrorf(t, k8sClient.Update(ctx, &b), "bundle update failed")
+	assertHelmRelease(t, k8sClient, bundle, "1.0.0", 4, "default")
+}
+
+func TestHelmBundleChartLoadFailure(t *testing.T) {
+	server := serveHelmRepository(t, "chart1", "1.0.0")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &HelmBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	bundle := createHelmBundle(t, k8sClient, v1alpha1.HelmBundleSpec{
+		Chart:      "chart1",
+		Repository: server.URL,
+		Version:    "2.0.0",
+	})
+
+	ctx := context.Background()
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.HelmBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			assert.Empty(c, b.Status.ChartStatus, "unexpected chart status")
+			cUpToDate := meta.FindStatusCondition(b.Status.Conditions, typeUpToDateHelmBundle)
+			if assert.NotNil(c, cUpToDate, "uptodate condition not found") {
+				assert.Equal(c, metav1.ConditionFalse, cUpToDate.Status, "incorrect status")
+				assert.Equal(c, "ChartLoadFailed", cUpToDate.Reason, "incorrect reason")
+				assert.Contains(c, cUpToDate.Message, fmt.Sprintf("failed to find chart '%s' version '%s'", "chart1", "2.0.0"), "incorrect message")
+			}
+		}
+	}, 15*time.Second, 1*time.Second, "chart load failure not recorded correctly")
+}
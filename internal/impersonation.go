@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	reasonImpersonationFailed = "ImpersonationFailed" // Reason of bundles whose service account cannot be impersonated
+)
+
+var (
+	// errServiceAccountNotFound is returned when impersonating a missing service account.
+	errServiceAccountNotFound = errors.New("service account not found")
+
+	// errNoServiceAccount is returned when applying a bundle to the local cluster without a service account to impersonate.
+	errNoServiceAccount = errors.New("no service account to impersonate: set the bundle's 'serviceAccountName' or the controller's default service account")
+)
+
+// getServiceAccount returns the given service account in the given namespace, failing with errServiceAccountNotFound
+// if it does not exist.
+func getServiceAccount(ctx context.Context, c client.Client, namespace, serviceAccountName string) (*v1.ServiceAccount, error) {
+	var sa v1.ServiceAccount
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: serviceAccountName}, &sa); apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("%w: '%s/%s'", errServiceAccountNotFound, namespace, serviceAccountName)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get service account '%s/%s': %w", namespace, serviceAccountName, err)
+	}
+	return &sa, nil
+}
+
+// impersonate returns a REST config & a client acting as the given service account in the given namespace.
+func impersonate(c client.Client, config *rest.Config, namespace, serviceAccountName string) (*rest.Config, client.Client, error) {
+	// Impersonate the groups of the service account as well, since permissions granted to them are otherwise missing
+	impersonatingConfig := rest.CopyConfig(config)
+	impersonatingConfig.Impersonate = rest.ImpersonationConfig{
+		UserName: fmt.Sprintf("system:serviceaccount:%s:%s", namespace, serviceAccountName),
+		Groups:   []string{"system:serviceaccounts", "system:serviceaccounts:" + namespace, "system:authenticated"},
+	}
+	impersonatingClient, err := client.New(impersonatingConfig, client.Options{Scheme: c.Scheme(), Mapper: c.RESTMapper()})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create client for service account '%s/%s': %w", namespace, serviceAccountName, err)
+	}
+	return impersonatingConfig, impersonatingClient, nil
+}
+
+// verifyImpersonation verifies that the given client, impersonating the given service account in the given namespace,
+// is allowed to do so.
+func verifyImpersonation(ctx context.Context, c client.Client, namespace, serviceAccountName string) error {
+	// Any authenticated user may review its own access, so this only fails if impersonation itself is not allowed
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      "get",
+				Resource:  "serviceaccounts",
+				Name:      serviceAccountName,
+			},
+		},
+	}
+	if err := c.Create(ctx, review); err != nil {
+		return fmt.Errorf("failed to impersonate service account '%s/%s': %w", namespace, serviceAccountName, err)
+	}
+	return nil
+}
@@ -1,24 +1,29 @@
 package internal
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/arikkfir/kude-controller/internal/v1alpha1"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	kstrings "k8s.io/utils/strings"
-	"os/exec"
+	"reflect"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 	"sort"
@@ -27,17 +32,34 @@ import (
 )
 
 const (
-	finalizerKubectlBundle    = "kubectlbundles.kude.kfirs.com/finalizer"
-	typeUpToDateKubectlBundle = "UpToDate"                               // Is the ®KubectlBundle up to date?
-	typeDegradedKubectlBundle = "Degraded"                               // When the KubectlBundle is deleted, but finalizer not applied yet
-	ownerUIDKubectlBundle     = "kubectlbundles.kude.kfirs.com/ownerUID" // Label for setting the owner UID
+	finalizerKubectlBundle      = "kubectlbundles.kude.kfirs.com/finalizer"
+	typeUpToDateKubectlBundle   = "UpToDate"                               // Is the ®KubectlBundle up to date?
+	typeDegradedKubectlBundle   = "Degraded"                               // When the KubectlBundle is deleted, but finalizer not applied yet
+	typeDriftedKubectlBundle    = "Drifted"                                // Has the live state of the bundle's objects drifted?
+	typeHealthyKubectlBundle    = "Healthy"                                // Are the bundle's objects ready?
+	typeSuspendedKubectlBundle  = "Suspended"                              // Is reconciliation of the KubectlBundle suspended?
+	ownerUIDKubectlBundle       = "kubectlbundles.kude.kfirs.com/ownerUID" // Label for setting the owner UID
+	defaultKubectlBundleTimeout = 5 * time.Minute                          // Default maximum duration of a single run
+	defaultRetryMaxDelay        = time.Hour                                // Default maximum delay before retrying a failed run
 )
 
+// kubectlBundleCommands maps the modes of bundles to the commands recorded in their runs.
+var kubectlBundleCommands = map[string]string{
+	applyModeApply:  "apply",
+	applyModeDryRun: "dry-run",
+	applyModeDiff:   "diff",
+}
+
 // KubectlBundleReconciler reconciles a KubectlBundle object
 type KubectlBundleReconciler struct {
-	Client   client.Client        // Kubernetes API client
-	Recorder record.EventRecorder // Kubernetes event recorder
-	Scheme   *runtime.Scheme      // Scheme registry
+	Client                client.Client        // Kubernetes API client
+	APIReader             client.Reader        // Kubernetes API reader, bypassing the cache
+	Recorder              record.EventRecorder // Kubernetes event recorder
+	Scheme                *runtime.Scheme      // Scheme registry
+	Config                *rest.Config         // REST config of the cluster the controller runs in; defaults to the manager's config
+	DefaultServiceAccount string               // Service account to impersonate (and run jobs as) for local bundles not specifying one
+	targets               *targetClusters      // Clients of remote clusters that bundles are applied to
+	executor              *commandExecutor     // Executes in-process runs in the background
 }
 
 //+kubebuilder:rbac:groups=kude.kfirs.com,resources=kubectlbundles,verbs=get;list;watch;create;update;patch;delete
@@ -46,6 +68,9 @@ type KubectlBundleReconciler struct {
 //+kubebuilder:rbac:groups=kude.kfirs.com,resources=commandruns,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=kude.kfirs.com,resources=commandruns/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=get;list;watch;impersonate
+//+kubebuilder:rbac:groups=core,resources=groups,verbs=impersonate
+//+kubebuilder:rbac:groups=core,resources=configmaps;secrets,verbs=get
 
 // Reconcile continuously aims to move the current state of [KubectlBundle] objects closer to their desired state.
 func (r *KubectlBundleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -73,6 +98,22 @@ func (r *KubectlBundleReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		}
 	}
 
+	if meta.FindStatusCondition(o.Status.Conditions, typeDriftedKubectlBundle) == nil {
+		if res, err := r.setCondition(ctx, &o, typeDriftedKubectlBundle, metav1.ConditionUnknown, "Reconciling", "Initial value"); res.Requeue || err != nil {
+			return res, err
+		} else {
+			return ctrl.Result{Requeue: true}, nil
+		}
+	}
+
+	if meta.FindStatusCondition(o.Status.Conditions, typeHealthyKubectlBundle) == nil {
+		if res, err := r.setCondition(ctx, &o, typeHealthyKubectlBundle, metav1.ConditionUnknown, "Reconciling", "Initial value"); res.Requeue || err != nil {
+			return res, err
+		} else {
+			return ctrl.Result{Requeue: true}, nil
+		}
+	}
+
 	// Add our finalizer
 	if controllerutil.AddFinalizer(&o, finalizerKubectlBundle) {
 		if err := r.Client.Update(ctx, &o); err != nil {
@@ -90,7 +131,23 @@ func (r *KubectlBundleReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		if res, err := r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionUnknown, "Deleted", "Deleting resource"); res.Requeue || err != nil {
 			return res, err
 		}
-		// TODO: consider pruning last run's created objects
+		if executing, err := r.cancelRuns(ctx, &o); err != nil {
+			return ctrl.Result{}, err
+		} else if executing {
+			// Wait for in-flight runs to return before pruning; we'll be notified when they do
+			return ctrl.Result{}, nil
+		}
+		if o.Spec.Prune && len(o.Status.Inventory) > 0 {
+			// Without its kubeconfig or service account (e.g. when its namespace is being deleted), objects are left in place
+			if _, applier, reason, err := r.targets.connect(ctx, r.Client, r.Config, o.Namespace, o.Spec.KubeConfig, o.Spec.ServiceAccountName); isTargetMissing(err) {
+				r.Recorder.Eventf(&o, v1.EventTypeWarning, reason, "Not pruning %d objects: %s", len(o.Status.Inventory), err)
+			} else if err != nil {
+				r.Recorder.Eventf(&o, v1.EventTypeWarning, reason, err.Error())
+				return ctrl.Result{}, err
+			} else if err := r.pruneInventory(ctx, &o, applier); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
 		if controllerutil.RemoveFinalizer(&o, finalizerKubectlBundle) {
 			if err := r.Client.Update(ctx, &o); err != nil {
 				return ctrl.Result{}, err
@@ -99,6 +156,19 @@ func (r *KubectlBundleReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		return ctrl.Result{}, nil
 	}
 
+	// Skip all work while suspended; we'll be notified when resumed
+	if o.Spec.Suspend {
+		if !meta.IsStatusConditionTrue(o.Status.Conditions, typeSuspendedKubectlBundle) {
+			r.Recorder.Event(&o, v1.EventTypeNormal, "Suspended", "Reconciliation suspended")
+		}
+		return r.setCondition(ctx, &o, typeSuspendedKubectlBundle, metav1.ConditionTrue, "Suspended", "Reconciliation is suspended")
+	} else if meta.IsStatusConditionTrue(o.Status.Conditions, typeSuspendedKubectlBundle) {
+		r.Recorder.Event(&o, v1.EventTypeNormal, "Resumed", "Reconciliation resumed")
+	}
+	if res, err := r.setCondition(ctx, &o, typeSuspendedKubectlBundle, metav1.ConditionFalse, "NotSuspended", ""); res.Requeue || err != nil {
+		return res, err
+	}
+
 	// Get interval
 	interval, err := time.ParseDuration(o.Spec.DriftDetectionInterval)
 	if err != nil {
@@ -108,6 +178,77 @@ func (r *KubectlBundleReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		return ctrl.Result{Requeue: false}, nil
 	}
 
+	// Get timeout
+	timeout := defaultKubectlBundleTimeout
+	if o.Spec.Timeout != "" {
+		if timeout, err = time.ParseDuration(o.Spec.Timeout); err != nil || timeout <= 0 {
+			if res, err := r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionUnknown, "InvalidTimeout", "Invalid timeout: "+o.Spec.Timeout); res.Requeue || err != nil {
+				return res, err
+			}
+			return ctrl.Result{Requeue: false}, nil
+		}
+	}
+
+	// Get health check timeout
+	healthCheckTimeout := defaultHealthCheckTimeout
+	if o.Spec.HealthCheckTimeout != "" {
+		if healthCheckTimeout, err = time.ParseDuration(o.Spec.HealthCheckTimeout); err != nil || healthCheckTimeout <= 0 {
+			if res, err := r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionUnknown, "InvalidHealthCheckTimeout", "Invalid health check timeout: "+o.Spec.HealthCheckTimeout); res.Requeue || err != nil {
+				return res, err
+			}
+			return ctrl.Result{Requeue: false}, nil
+		}
+	}
+
+	// Get retry policy
+	retryInitialDelay, retryMaxDelay, maxAttempts := interval, defaultRetryMaxDelay, 0
+	if o.Spec.Retry != nil {
+		if o.Spec.Retry.InitialDelay != "" {
+			if retryInitialDelay, err = time.ParseDuration(o.Spec.Retry.InitialDelay); err != nil || retryInitialDelay <= 0 {
+				if res, err := r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionUnknown, "InvalidRetryPolicy", "Invalid retry initial delay: "+o.Spec.Retry.InitialDelay); res.Requeue || err != nil {
+					return res, err
+				}
+				return ctrl.Result{Requeue: false}, nil
+			}
+		}
+		if o.Spec.Retry.MaxDelay != "" {
+			if retryMaxDelay, err = time.ParseDuration(o.Spec.Retry.MaxDelay); err != nil || retryMaxDelay <= 0 {
+				if res, err := r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionUnknown, "InvalidRetryPolicy", "Invalid retry max delay: "+o.Spec.Retry.MaxDelay); res.Requeue || err != nil {
+					return res, err
+				}
+				return ctrl.Result{Requeue: false}, nil
+			}
+		}
+		maxAttempts = o.Spec.Retry.MaxAttempts
+	}
+
+	// Variables are substituted (and files are decrypted) in-process, so jobs cannot do so
+	if o.Spec.Job != nil && (o.Spec.Substitute != nil || o.Spec.SubstituteFrom != nil) {
+		if res, err := r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionFalse, "InvalidSpec", "Variable substitution is not supported when running in a Job"); res.Requeue || err != nil {
+			return res, err
+		}
+		return ctrl.Result{Requeue: false}, nil
+	}
+	if o.Spec.Job != nil && o.Spec.Decryption != nil {
+		if res, err := r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionFalse, "InvalidSpec", "Decryption is not supported when running in a Job"); res.Requeue || err != nil {
+			return res, err
+		}
+		return ctrl.Result{Requeue: false}, nil
+	}
+	if o.Spec.Job != nil && o.Spec.Wait {
+		if res, err := r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionFalse, "InvalidSpec", "Waiting for applied objects is not supported when running in a Job"); res.Requeue || err != nil {
+			return res, err
+		}
+		return ctrl.Result{Requeue: false}, nil
+	}
+	mode := kubectlBundleMode(&o)
+	if o.Spec.Job != nil && mode != applyModeApply {
+		if res, err := r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionFalse, "InvalidSpec", fmt.Sprintf("Mode '%s' is not supported when running in a Job", mode)); res.Requeue || err != nil {
+			return res, err
+		}
+		return ctrl.Result{Requeue: false}, nil
+	}
+
 	// Fetch list of runs for this bundle
 	runs := &v1alpha1.CommandRunList{}
 	if err := r.Client.List(ctx, runs, client.InNamespace(o.Namespace), client.MatchingLabels{ownerUIDKubectlBundle: string(o.UID)}); err != nil {
@@ -115,7 +256,7 @@ func (r *KubectlBundleReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 	}
 
 	// Sort by creation time (DESC) and get the latest <limit> runs
-	sort.Stable(sort.Reverse(runs))
+	sort.SliceStable(runs.Items, func(i, j int) bool { return isCommandRunNewer(&runs.Items[i], &runs.Items[j]) })
 	limit := o.Spec.RunsHistoryLimit
 	if limit <= 0 {
 		limit = 10
@@ -136,6 +277,32 @@ func (r *KubectlBundleReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		}
 	}
 
+	// In-process runs that are unfinished, yet not executing, were either just finished (and our cache is stale) or
+	// interrupted by a restart of the controller
+	if lastRun != nil && lastRun.Spec.Job == nil && !isCommandRunFinished(lastRun) && !r.executor.IsExecuting(lastRun.UID) {
+		if err := r.recoverRun(ctx, lastRun); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Wait for dependencies to be up-to-date with their current commit; we'll be notified when they change
+	if reason, message, err := checkDependencies(ctx, r.Client, "KubectlBundle", &o); err != nil {
+		return ctrl.Result{}, err
+	} else if reason != "" {
+		return r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionFalse, reason, message)
+	}
+
+	// Connect to the bundle's target cluster, impersonating the bundle's service account, if any
+	_, applier, reason, err := r.targets.connect(ctx, r.Client, r.Config, o.Namespace, o.Spec.KubeConfig, o.Spec.ServiceAccountName)
+	if err != nil {
+		r.Recorder.Eventf(&o, v1.EventTypeWarning, reason, err.Error())
+		if res, err := r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionFalse, reason, err.Error()); err != nil {
+			return res, err
+		}
+		// Return an error, so the request is retried with backoff
+		return ctrl.Result{}, err
+	}
+
 	// Fetch source GitRepository
 	var repo v1alpha1.GitRepository
 	gitRepoNamespace, gitRepoName := kstrings.SplitQualifiedName(o.Spec.SourceRepository)
@@ -148,23 +315,100 @@ func (r *KubectlBundleReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		return r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionUnknown, "GitRepositoryNotAvailable", "")
 	}
 
+	// Resolve the variables to substitute in the files, if any
+	variables, secretVariables, err := resolveSubstitutions(ctx, r.APIReader, &o)
+	if err != nil {
+		r.Recorder.Eventf(&o, v1.EventTypeWarning, reasonSubstitutionFailed, err.Error())
+		if res, err := r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionFalse, reasonSubstitutionFailed, err.Error()); err != nil {
+			return res, err
+		}
+		// Return an error, so the request is retried with backoff
+		return ctrl.Result{}, err
+	}
+
+	// Load the keys for decrypting the files, if any
+	decryptor, err := newDecryptor(ctx, r.APIReader, o.Namespace, o.Spec.Decryption)
+	if err != nil {
+		r.Recorder.Eventf(&o, v1.EventTypeWarning, reasonDecryptionFailed, err.Error())
+		if res, err := r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionFalse, reasonDecryptionFailed, err.Error()); err != nil {
+			return res, err
+		}
+		// Return an error, so the request is retried with backoff
+		return ctrl.Result{}, err
+	}
+
+	// Digest the files to apply (and the variables substituted in them), so that commits not changing them are not run
+	// again; files that cannot be read never match, leaving it to the run to report the failure
+	digest, err := digestManifests(repo.Status.WorkDirectory, o.Spec.Files, variables)
+	if err != nil {
+		digest = ""
+	}
+
 	// Compare SHA of last run to GitRepository SHAl update the UpToDate condition accordingly
 	// We're up-to-date if:
 	//		- at least one run exists
-	//		- last run matches the latest repository commit SHA
-	//		- last run was successful
+	//		- last run matches the latest repository commit SHA (or its files' digest, if it succeeded) & the bundle's mode
+	//		- no reconciliation was requested since the last run was created
+	//		- last run finished successfully
+	//		- the bundle is applied, rather than previewed
+	// When up-to-date, check the health of the bundle's objects, compare their live state to the desired state, and
+	// re-apply them if they drifted and drift correction is enabled. When the last run failed, retry it once the retry
+	// delay elapsed, unless the retry attempts are exhausted.
+	command := kubectlBundleCommands[mode]
+	requested := reconcileRequestedAt(&o)
+	delay := retryDelay(retryInitialDelay, retryMaxDelay, o.Status.Attempts)
+	lastRunMatches := lastRun != nil && lastRun.Spec.Command == command && o.Status.LastHandledReconcileAt == requested &&
+		(lastRun.Spec.CommitSHA == repo.Status.LastPulledSHA || digest != "" && lastRun.Spec.FilesDigest == digest && isCommandRunFinished(lastRun) && lastRun.Status.ExitCode == 0)
 	if lastRun != nil {
-		if lastRun.Spec.CommitSHA == repo.Status.LastPulledSHA {
-			if lastRun.Status.ExitCode == 0 {
+		if lastRunMatches {
+			if !isCommandRunFinished(lastRun) {
+				return r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionUnknown, "Running", fmt.Sprintf("Waiting for run '%s' to finish", lastRun.Name))
+			} else if lastRun.Status.ExitCode == 0 && mode != applyModeApply {
+				// Previews leave the cluster as-is, so there's nothing to do until the commit or the mode change
+				return r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionFalse, mode, fmt.Sprintf("Run '%s' previewed commit '%s'; set mode to 'Apply' to apply it", lastRun.Name, lastRun.Spec.CommitSHA))
+			} else if lastRun.Status.ExitCode == 0 {
+				if o.Status.LastAppliedSHA != repo.Status.LastPulledSHA {
+					// Commits that do not change the files are recorded as applied by the last run
+					if lastRun.Spec.CommitSHA != repo.Status.LastPulledSHA {
+						r.Recorder.Eventf(&o, v1.EventTypeNormal, "Unchanged", "Commit '%s' does not change the files applied by run '%s'", repo.Status.LastPulledSHA, lastRun.Name)
+					}
+					o.Status.LastAppliedSHA = repo.Status.LastPulledSHA
+					if err := r.Client.Status().Update(ctx, &o); err != nil {
+						return ctrl.Result{}, fmt.Errorf("failed to update KubectlBundle last applied SHA: %w", err)
+					}
+					return ctrl.Result{Requeue: true}, nil
+				}
 				if res, err := r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionTrue, "UpToDate", "Last run matches current repository SHA"); err != nil || res.Requeue {
 					return res, err
-				} else {
+				} else if res, err := r.checkHealth(ctx, &o, applier, lastRun, healthCheckTimeout); err != nil || res.Requeue || res.RequeueAfter > 0 {
+					return res, err
+				} else if res, err := r.detectDrift(ctx, &o, applier, repo.Status.WorkDirectory, decryptor, variables); err != nil || res.Requeue {
+					return res, err
+				} else if len(o.Status.DriftedObjects) == 0 || !o.Spec.CorrectDrift {
 					return ctrl.Result{RequeueAfter: interval}, nil
 				}
-			} else if res, err := r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionFalse, "Failed", "Last run failed, retrying"); err != nil || res.Requeue {
+			} else if !isCommandRunInterrupted(lastRun) && maxAttempts > 0 && o.Status.Attempts >= maxAttempts {
+				// Stop retrying until the commit changes or a reconciliation is requested; we'll be notified when they do
+				if c := meta.FindStatusCondition(o.Status.Conditions, typeUpToDateKubectlBundle); c == nil || c.Reason != "RetriesExhausted" {
+					r.Recorder.Eventf(&o, v1.EventTypeWarning, "RetriesExhausted", "Commit '%s' failed %d times, no longer retrying", lastRun.Spec.CommitSHA, o.Status.Attempts)
+				}
+				return r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionFalse, "RetriesExhausted", fmt.Sprintf("Last run failed after %d attempts; waiting for a new commit or a reconcile request", o.Status.Attempts))
+			} else if res, err := r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionFalse, "Failed", fmt.Sprintf("Last run failed, retrying in %s", delay)); err != nil || res.Requeue {
+				return res, err
+			} else if !isCommandRunInterrupted(lastRun) && lastRun.Status.CompletionTime != nil && time.Since(lastRun.Status.CompletionTime.Time) < delay {
+				// Retry failed runs only once the retry delay elapsed (backing off exponentially between consecutive
+				// failed runs), rather than continuously re-running failing runs; interrupted runs are retried immediately
+				return ctrl.Result{RequeueAfter: delay - time.Since(lastRun.Status.CompletionTime.Time)}, nil
+			}
+		} else if lastRun.Spec.CommitSHA != repo.Status.LastPulledSHA {
+			if res, err := r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionFalse, "OutOfDate", "Last run does not match current repository SHA"); err != nil || res.Requeue {
 				return res, err
 			}
-		} else if res, err := r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionFalse, "OutOfDate", "Last run does not match current repository SHA"); err != nil || res.Requeue {
+		} else if lastRun.Spec.Command != command {
+			if res, err := r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionFalse, "OutOfDate", "Last run does not match current mode"); err != nil || res.Requeue {
+				return res, err
+			}
+		} else if res, err := r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionFalse, "ReconcileRequested", fmt.Sprintf("Reconciliation requested at '%s'", requested)); err != nil || res.Requeue {
 			return res, err
 		}
 	} else if res, err := r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionFalse, "NotApplied", "Bundle has no runs yet"); err != nil || res.Requeue {
@@ -180,55 +424,317 @@ func (r *KubectlBundleReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		runs.Items = runs.Items[:limit-1]
 	}
 
-	args := make([]string, 0)
-	args = append(args, "apply")
-	args = append(args, o.Spec.Args...)
-	args = append(args, "-f")
-	args = append(args, o.Spec.Files...)
-	cmd := exec.CommandContext(ctx, "kubectl", args...)
-	cmd.Dir = repo.Status.WorkDirectory
-	run, err := r.createRun(ctx, &o, repo.Status.LastPulledSHA, cmd.Dir, cmd.Path, cmd.Args)
+	// Count the attempts at running the current commit: failed runs are retried as another attempt (interrupted runs as
+	// the same attempt), while anything else starts over
+	attempts := 1
+	if lastRunMatches && lastRun.Status.ExitCode != 0 {
+		if isCommandRunInterrupted(lastRun) {
+			attempts = o.Status.Attempts
+		} else {
+			attempts = o.Status.Attempts + 1
+		}
+	}
+
+	// Record the run
+	run, err := r.createRun(ctx, &o, &repo, command, o.Spec.Files, digest, timeout)
 	if err != nil {
 		r.Recorder.Eventf(&o, v1.EventTypeWarning, "FailedCreatingRun", err.Error())
 		return ctrl.Result{RequeueAfter: interval}, err
 	}
 
-	// Start the command
-	var b bytes.Buffer
-	b.WriteString(fmt.Sprintf("$ %s\n", strings.Join(cmd.Args, " ")))
-	cmd.Stdout = &b
-	cmd.Stderr = &b
-	if err := cmd.Start(); err != nil {
-		r.Recorder.Eventf(&o, v1.EventTypeWarning, "FailedStartingRun", "Failed to start run '%s': %s\n%s", run.Name, err.Error(), b.String())
-		run.Status.ExitCode = -1
-		run.Status.Error = fmt.Errorf("failed to start command: %w", err).Error()
-		return ctrl.Result{RequeueAfter: interval}, r.Client.Status().Update(ctx, run)
-	}
-
-	// Wait for the command to finish, then update status
-	if err := cmd.Wait(); err != nil {
-		r.Recorder.Eventf(&o, v1.EventTypeWarning, "RunFailed", "Run '%s' failed: %s\n%s", run.Name, err.Error(), b.String())
-		run.Status.ExitCode = cmd.ProcessState.ExitCode()
-		run.Status.Output = b.String()
-		run.Status.Error = fmt.Errorf("command failed: %w", err).Error()
-		return ctrl.Result{RequeueAfter: interval}, r.Client.Status().Update(ctx, run)
+	// Record the attempt, and that the requested reconciliation (if any) was handled by this run
+	if o.Status.Attempts != attempts || o.Status.LastHandledReconcileAt != requested {
+		o.Status.Attempts = attempts
+		o.Status.LastHandledReconcileAt = requested
+		if err := r.Client.Status().Update(ctx, &o); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to update attempts in KubectlBundle status: %w", err)
+		}
+	}
+
+	// Runs executed in Jobs are picked up by the CommandRun reconciler; we'll be notified when they finish
+	if run.Spec.Job != nil {
+		r.Recorder.Eventf(&o, v1.EventTypeNormal, "RunCreated", "Run '%s' created for commit '%s'", run.Name, run.Spec.CommitSHA)
+		return r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionUnknown, "Running", fmt.Sprintf("Waiting for run '%s' to finish", run.Name))
+	}
+
+	// Read & decrypt the manifests, recording the variables substituted in them; run status is patched without optimistic locking,
+	// since the CommandRun reconciler may concurrently mark it as pending
+	base := run.DeepCopy()
+	substitution := newSubstitution(variables, secretVariables, o.Spec.StrictSubstitution)
+	objects, err := readManifests(repo.Status.WorkDirectory, o.Spec.Files, decryptor, substitution)
+	run.Status.Variables = substitution.usedVariables()
+	if err != nil {
+		r.Recorder.Eventf(&o, v1.EventTypeWarning, "FailedReadingManifests", "Run '%s' failed reading manifests: %s", run.Name, err.Error())
+		run.Status.ExitCode = 1
+		run.Status.Error = fmt.Errorf("failed reading manifests: %w", err).Error()
+		markCommandRunFinished(run, "ReadFailed", run.Status.Error, time.Now())
+		return ctrl.Result{RequeueAfter: interval}, r.Client.Status().Patch(ctx, run, client.MergeFrom(base))
+	}
+
+	// Mark the run as started
+	markCommandRunStarted(run, time.Now())
+	if err := r.Client.Status().Patch(ctx, run, client.MergeFrom(base)); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to update CommandRun status: %w", err)
+	}
+
+	// Apply the manifests in the background; we'll be notified when the run finishes
+	bundle := o.DeepCopy()
+	if err := r.executor.Execute(run.UID, bundle, timeout, func(ctx context.Context) { r.apply(ctx, applier, bundle, run, objects, decryptor, substitution) }); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to execute run '%s': %w", run.Name, err)
+	}
+	return r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionUnknown, "Running", fmt.Sprintf("Waiting for run '%s' to finish", run.Name))
+}
+
+// pruneInventory deletes all objects in the given bundle's inventory using the given client, keeping only the objects
+// that failed to be deleted in the inventory.
+func (r *KubectlBundleReconciler) pruneInventory(ctx context.Context, o *v1alpha1.KubectlBundle, c client.Client) error {
+	var remaining []v1alpha1.InventoryEntry
+	for _, result := range pruneObjects(ctx, c, o.Status.Inventory, applyModeApply) {
+		if result.Action == applyActionFailed {
+			r.Recorder.Eventf(o, v1.EventTypeWarning, "PruneFailed", "Failed pruning %s", formatObjectResult(result))
+			remaining = append(remaining, inventoryEntryFor(result))
+		}
+	}
+	o.Status.Inventory = remaining
+	if err := r.Client.Status().Update(ctx, o); err != nil {
+		return fmt.Errorf("failed to update KubectlBundle inventory: %w", err)
+	} else if len(remaining) > 0 {
+		return fmt.Errorf("failed to prune %d objects", len(remaining))
+	}
+	return nil
+}
+
+// apply applies the given objects for the given run of the given bundle using the given client, records the outcome in
+// the run (redacting the errors of objects decrypted by the given decryptor, and the values of Secret variables
+// substituted by the given substitution), and updates the bundle's inventory. When the bundle is only previewed,
+// objects are applied (and pruned) using a server-side dry-run, and the inventory is left as-is. It's executed in the background, and stops applying objects once the given context is done (e.g. when the
+// run's timeout elapsed, or the controller is shutting down).
+func (r *KubectlBundleReconciler) apply(ctx context.Context, c client.Client, o *v1alpha1.KubectlBundle, run *v1alpha1.CommandRun, objects []*unstructured.Unstructured, d *decryptor, s *substitution) {
+	mode := kubectlBundleMode(o)
+	base := run.DeepCopy()
+	run.Status.Objects = applyObjects(ctx, c, o.Namespace, objects, mode)
+	d.redact(run.Status.Objects)
+	s.redact(run.Status.Objects)
+	var applied []v1alpha1.InventoryEntry
+	failed := 0
+	for _, result := range run.Status.Objects {
+		if result.Action == applyActionFailed {
+			failed++
+		} else {
+			applied = append(applied, inventoryEntryFor(result))
+		}
+	}
+
+	// Update the inventory, pruning objects no longer in the bundle (only after a fully successful apply)
+	inventory := applied
+	pruneFailed := 0
+	if failed > 0 || ctx.Err() != nil {
+		// Keep tracking previously applied objects until they can be safely pruned
+		inventory = mergeInventory(o.Status.Inventory, applied)
+	} else if o.Spec.Prune {
+		pruned := pruneObjects(ctx, c, subtractInventory(o.Status.Inventory, applied), mode)
+		for _, result := range pruned {
+			if result.Action == applyActionFailed {
+				pruneFailed++
+				inventory = append(inventory, inventoryEntryFor(result))
+			}
+		}
+		run.Status.Objects = append(run.Status.Objects, pruned...)
+	}
+
+	// Update status
+	var b strings.Builder
+	for _, result := range run.Status.Objects {
+		if mode == applyModeApply {
+			b.WriteString(formatObjectResult(result) + "\n")
+		} else {
+			b.WriteString(formatObjectResult(result) + " (server dry run)\n")
+		}
+		for _, diff := range result.Diff {
+			b.WriteString(formatFieldDiff(diff) + "\n")
+		}
+	}
+	run.Status.Output = b.String()
+	reason := "Applied"
+	if mode != applyModeApply {
+		reason = mode
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		reason = reasonTimedOutCommandRun
+		run.Status.ExitCode = 1
+		run.Status.Error = fmt.Sprintf("timed out after %s", run.Spec.Timeout.Duration)
+	} else if ctx.Err() != nil {
+		reason = reasonInterruptedCommandRun
+		run.Status.ExitCode = 1
+		run.Status.Error = "interrupted before finishing"
+	} else if failed > 0 || pruneFailed > 0 {
+		run.Status.ExitCode = 1
+		if failed > 0 {
+			run.Status.Error = fmt.Sprintf("failed applying %d of %d objects", failed, len(objects))
+		} else {
+			run.Status.Error = fmt.Sprintf("failed pruning %d objects", pruneFailed)
+		}
 	} else {
-		run.Status.ExitCode = cmd.ProcessState.ExitCode()
-		run.Status.Output = b.String()
-		if err := r.Client.Status().Update(ctx, run); err != nil {
-			return ctrl.Result{}, fmt.Errorf("failed to update CommandRun status: %w", err)
+		run.Status.ExitCode = 0
+	}
+	if run.Status.ExitCode != 0 {
+		r.Recorder.Eventf(o, v1.EventTypeWarning, "RunFailed", "Run '%s' %s:\n%s", run.Name, run.Status.Error, b.String())
+	}
+	markCommandRunFinished(run, reason, run.Status.Error, time.Now())
+
+	// The given context may be done by now, so status is updated using a separate context
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := r.Client.Status().Patch(ctx, run, client.MergeFrom(base)); err != nil {
+		ctrl.Log.Error(err, "Failed updating CommandRun status", "commandRun", run.Namespace+"/"+run.Name)
+	}
+	if mode != applyModeApply {
+		return
+	}
+	if err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		var bundle v1alpha1.KubectlBundle
+		if err := r.APIReader.Get(ctx, client.ObjectKeyFromObject(o), &bundle); err != nil {
+			return err
+		}
+		bundle.Status.Inventory = inventory
+		return r.Client.Status().Update(ctx, &bundle)
+	}); err != nil {
+		ctrl.Log.Error(err, "Failed updating KubectlBundle inventory", "kubectlBundle", o.Namespace+"/"+o.Name)
+	}
+}
+
+// recoverRun refreshes the given in-process run, which is unfinished yet not executing, from the API server. If it's
+// indeed unfinished, it was interrupted (e.g. by a restart of the controller), and is marked as such.
+func (r *KubectlBundleReconciler) recoverRun(ctx context.Context, run *v1alpha1.CommandRun) error {
+	if err := r.APIReader.Get(ctx, client.ObjectKeyFromObject(run), run); err != nil {
+		return fmt.Errorf("failed to get CommandRun: %w", err)
+	} else if isCommandRunFinished(run) {
+		return nil
+	}
+	base := run.DeepCopy()
+	run.Status.ExitCode = 1
+	run.Status.Error = "interrupted before finishing"
+	markCommandRunFinished(run, reasonInterruptedCommandRun, run.Status.Error, time.Now())
+	if err := r.Client.Status().Patch(ctx, run, client.MergeFrom(base)); err != nil {
+		return fmt.Errorf("failed to update CommandRun status: %w", err)
+	}
+	return nil
+}
+
+// cancelRuns cancels the in-flight runs of the given bundle, and returns whether any were executing.
+func (r *KubectlBundleReconciler) cancelRuns(ctx context.Context, o *v1alpha1.KubectlBundle) (bool, error) {
+	runs := &v1alpha1.CommandRunList{}
+	if err := r.Client.List(ctx, runs, client.InNamespace(o.Namespace), client.MatchingLabels{ownerUIDKubectlBundle: string(o.UID)}); err != nil {
+		return false, fmt.Errorf("failed to list command runs: %w", err)
+	}
+	executing := false
+	for _, run := range runs.Items {
+		if r.executor.Cancel(run.UID) {
+			executing = true
+		}
+	}
+	return executing, nil
+}
+
+// checkHealth checks the readiness of the given bundle's objects (as seen by the given client) after the given run
+// applied them, and updates the bundle's Healthy condition accordingly. Objects that are not ready yet are polled until
+// the given timeout elapsed since the run finished, and are reported as unhealthy afterwards.
+func (r *KubectlBundleReconciler) checkHealth(ctx context.Context, o *v1alpha1.KubectlBundle, c client.Client, run *v1alpha1.CommandRun, timeout time.Duration) (ctrl.Result, error) {
+	entries := healthCheckEntries(o)
+	if len(entries) == 0 {
+		return r.setCondition(ctx, o, typeHealthyKubectlBundle, metav1.ConditionUnknown, reasonHealthNotChecked, "Health checks are not enabled")
+	}
+
+	progressing, failed, err := checkObjectsHealth(ctx, c, entries)
+	if err != nil {
+		if res, err := r.setCondition(ctx, o, typeHealthyKubectlBundle, metav1.ConditionUnknown, reasonHealthCheckFailed, err.Error()); err != nil || res.Requeue {
+			return res, err
 		}
-		if res, err := r.setCondition(ctx, &o, typeUpToDateKubectlBundle, metav1.ConditionTrue, "UpToDate", "Last run matches current repository SHA"); err != nil {
+		return ctrl.Result{RequeueAfter: healthCheckPollInterval}, nil
+	}
+
+	var elapsed time.Duration
+	if run.Status.CompletionTime != nil {
+		elapsed = time.Since(run.Status.CompletionTime.Time)
+	}
+	var message string
+	if len(failed) > 0 {
+		message = fmt.Sprintf("%d objects failed: %s", len(failed), strings.Join(failed, "; "))
+	} else if len(progressing) > 0 && elapsed < timeout {
+		message = fmt.Sprintf("Waiting for %d objects to become ready: %s", len(progressing), strings.Join(progressing, "; "))
+		if res, err := r.setCondition(ctx, o, typeHealthyKubectlBundle, metav1.ConditionUnknown, reasonProgressing, message); err != nil || res.Requeue {
 			return res, err
+		}
+		return ctrl.Result{RequeueAfter: healthCheckPollInterval}, nil
+	} else if len(progressing) > 0 {
+		message = fmt.Sprintf("%d objects did not become ready within %s: %s", len(progressing), timeout, strings.Join(progressing, "; "))
+	} else {
+		return r.setCondition(ctx, o, typeHealthyKubectlBundle, metav1.ConditionTrue, reasonHealthy, fmt.Sprintf("All %d objects are ready", len(entries)))
+	}
+
+	if !meta.IsStatusConditionFalse(o.Status.Conditions, typeHealthyKubectlBundle) {
+		r.Recorder.Eventf(o, v1.EventTypeWarning, reasonUnhealthy, message)
+	}
+	return r.setCondition(ctx, o, typeHealthyKubectlBundle, metav1.ConditionFalse, reasonUnhealthy, message)
+}
+
+// detectDrift compares the live state of the bundle's objects (as seen by the given client) to the desired state in the
+// given directory (decrypting files & substituting the given variables, if any), and updates the bundle's drift status
+// accordingly.
+func (r *KubectlBundleReconciler) detectDrift(ctx context.Context, o *v1alpha1.KubectlBundle, c client.Client, dir string, d *decryptor, variables map[string]string) (ctrl.Result, error) {
+	objects, err := readManifests(dir, o.Spec.Files, d, newSubstitution(variables, nil, o.Spec.StrictSubstitution))
+	if err != nil {
+		return r.setCondition(ctx, o, typeDriftedKubectlBundle, metav1.ConditionUnknown, "DriftDetectionFailed", err.Error())
+	}
+	drifted, err := detectDrift(ctx, c, o.Namespace, objects)
+	if err != nil {
+		return r.setCondition(ctx, o, typeDriftedKubectlBundle, metav1.ConditionUnknown, "DriftDetectionFailed", err.Error())
+	}
+
+	if !reflect.DeepEqual(o.Status.DriftedObjects, drifted) {
+		if len(drifted) > 0 {
+			r.Recorder.Eventf(o, v1.EventTypeWarning, "DriftDetected", "Detected drift in %d objects", len(drifted))
+		}
+		o.Status.DriftedObjects = drifted
+		if err := r.Client.Status().Update(ctx, o); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to update KubectlBundle drifted objects: %w", err)
 		} else {
-			return ctrl.Result{RequeueAfter: interval}, nil
+			return ctrl.Result{Requeue: true}, nil
 		}
+	} else if len(drifted) > 0 {
+		return r.setCondition(ctx, o, typeDriftedKubectlBundle, metav1.ConditionTrue, "Drifted", fmt.Sprintf("Live state of %d objects drifted from desired state", len(drifted)))
+	} else {
+		return r.setCondition(ctx, o, typeDriftedKubectlBundle, metav1.ConditionFalse, "NoDrift", "")
+	}
+}
+
+// kubectlBundleMode returns the mode of the given bundle, defaulting to applying it.
+func kubectlBundleMode(o *v1alpha1.KubectlBundle) string {
+	if o.Spec.Mode == "" {
+		return applyModeApply
+	}
+	return o.Spec.Mode
+}
+
+// retryDelay returns the delay before retrying a failed run after the given number of attempts, doubling the given
+// initial delay after every attempt up to the given maximum delay (or the initial delay, if it's longer).
+func retryDelay(initialDelay, maxDelay time.Duration, attempts int) time.Duration {
+	delay := initialDelay
+	for i := 1; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay && initialDelay <= maxDelay {
+		return maxDelay
 	}
+	return delay
 }
 
-func (r *KubectlBundleReconciler) createRun(ctx context.Context, bundle *v1alpha1.KubectlBundle, commitSHA, dir, command string, args []string) (*v1alpha1.CommandRun, error) {
+func (r *KubectlBundleReconciler) createRun(ctx context.Context, bundle *v1alpha1.KubectlBundle, repo *v1alpha1.GitRepository, command string, args []string, digest string, timeout time.Duration) (*v1alpha1.CommandRun, error) {
 	run := v1alpha1.CommandRun{
 		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				annotationCommandRunCreatedAt: time.Now().UTC().Format(commandRunCreatedAtLayout),
+			},
 			Labels: map[string]string{
 				ownerUIDKubectlBundle: string(bundle.UID),
 			},
@@ -240,12 +746,32 @@ func (r *KubectlBundleReconciler) createRun(ctx context.Context, bundle *v1alpha
 			},
 		},
 		Spec: v1alpha1.CommandRunSpec{
-			CommitSHA: commitSHA,
-			Directory: dir,
-			Command:   command,
-			Args:      args,
+			CommitSHA:               repo.Status.LastPulledSHA,
+			Directory:               repo.Status.WorkDirectory,
+			Command:                 command,
+			Args:                    args,
+			FilesDigest:             digest,
+			Timeout:                 &metav1.Duration{Duration: timeout},
+			TTLSecondsAfterFinished: bundle.Spec.RunsTTLSecondsAfterFinished,
 		},
 	}
+	if bundle.Spec.Job != nil {
+		if repo.Spec.SecretRef != nil && repo.Spec.SecretRef.Name != "" {
+			if repo.Namespace != bundle.Namespace {
+				return nil, fmt.Errorf("credentials of repository '%s/%s' cannot be used by jobs in namespace '%s'", repo.Namespace, repo.Name, bundle.Namespace)
+			}
+			run.Spec.RepositorySecretRef = repo.Spec.SecretRef.DeepCopy()
+		}
+		run.Spec.RepositoryURL = repo.Spec.URL
+		run.Spec.Job = bundle.Spec.Job.DeepCopy()
+		if run.Spec.Job.ServiceAccountName == "" {
+			run.Spec.Job.ServiceAccountName = bundle.Spec.ServiceAccountName
+		}
+		if run.Spec.Job.ServiceAccountName == "" && bundle.Spec.KubeConfig == nil {
+			run.Spec.Job.ServiceAccountName = r.DefaultServiceAccount
+		}
+		run.Spec.KubeConfig = bundle.Spec.KubeConfig.DeepCopy()
+	}
 	if err := r.Client.Create(ctx, &run); err != nil {
 		return nil, fmt.Errorf("failed to create a bundle run: %w", err)
 	}
@@ -310,8 +836,17 @@ func (r *KubectlBundleReconciler) setCondition(ctx context.Context, o *v1alpha1.
 // SetupWithManager sets up the controller with the Manager.
 func (r *KubectlBundleReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	r.Client = mgr.GetClient()
+	r.APIReader = mgr.GetAPIReader()
 	r.Scheme = mgr.GetScheme()
 	r.Recorder = mgr.GetEventRecorderFor("kubectlbundle")
+	if r.Config == nil {
+		r.Config = mgr.GetConfig()
+	}
+	r.targets = newTargetClusters(r.DefaultServiceAccount)
+	r.executor = newCommandExecutor()
+	if err := mgr.Add(r.executor); err != nil {
+		return fmt.Errorf("failed to add command executor: %w", err)
+	}
 
 	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &v1alpha1.KubectlBundle{}, ".spec.sourceRepository", func(rawObj client.Object) []string {
 		// Extract the ConfigMap name from the ConfigDeployment Spec, if one is provided
@@ -324,11 +859,25 @@ func (r *KubectlBundleReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		return fmt.Errorf("failed to create index for source-repository: %w", err)
 	}
 
-	return ctrl.NewControllerManagedBy(mgr).
+	if err := indexDependencies(mgr, "KubectlBundle"); err != nil {
+		return err
+	}
+
+	if err := indexKubeConfigs(mgr, "KubectlBundle"); err != nil {
+		return err
+	}
+
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&v1alpha1.KubectlBundle{}).
+		Owns(&v1alpha1.CommandRun{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+			// Only runs executed in jobs finish asynchronously
+			return obj.(*v1alpha1.CommandRun).Spec.Job != nil
+		}))).
 		Watches(
 			&source.Kind{Type: &v1alpha1.GitRepository{}},
 			handler.EnqueueRequestsFromMapFunc(r.findObjectsForGitRepository),
 		).
-		Complete(r)
+		Watches(&source.Channel{Source: r.executor.events}, &handler.EnqueueRequestForObject{})
+	b = watchDependencies(b, r.Client, &v1alpha1.KubectlBundleList{})
+	return watchKubeConfigs(b, r.Client, &v1alpha1.KubectlBundleList{}).Complete(r)
 }
@@ -2,16 +2,31 @@ package internal
 
 import (
 	"context"
+	"filippo.io/age"
+	"fmt"
 	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+	"github.com/arikkfir/kude-controller/test/gittest"
 	"github.com/arikkfir/kude-controller/test/harness"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/client-go/util/retry"
+	"os"
+	"path/filepath"
 	"reflect"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -32,7 +47,8 @@ func TestIgnoreMissingKubectlBundleResource(t *testing.T) {
 }
 
 func TestKubectlBundleInitialization(t *testing.T) {
-	k8sClient, _, _ := harness.SetupTestEnv(t, &KubectlBundleReconciler{})
+	k8sClient, _, _ := harness.SetupTestEnv(t, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
 
 	bundle := &v1alpha1.KubectlBundle{
 		TypeMeta: metav1.TypeMeta{
@@ -62,7 +78,8 @@ func TestKubectlBundleInitialization(t *testing.T) {
 }
 
 func TestKubectlBundleDeletion(t *testing.T) {
-	k8sClient, _, _ := harness.SetupTestEnv(t, &KubectlBundleReconciler{})
+	k8sClient, _, _ := harness.SetupTestEnv(t, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
 
 	bundle := &v1alpha1.KubectlBundle{
 		TypeMeta: metav1.TypeMeta{
@@ -120,3 +137,1510 @@ func TestKubectlBundleDeletion(t *testing.T) {
 		}, 5*time.Second, 1*time.Second, "resource not finalized correctly")
 	}
 }
+
+// bundleServiceAccount is the default service account that bundles are applied as in tests
+const bundleServiceAccount = "bundles"
+
+// createBundleServiceAccount creates the default service account of bundles in the given namespace, allowed to do
+// anything in the cluster.
+func createBundleServiceAccount(t *testing.T, k8sClient client.Client, namespace string) {
+	ctx := context.Background()
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: bundleServiceAccount}}
+	require.NoErrorf(t, k8sClient.Create(ctx, sa), "service account creation failed")
+	binding := &rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: namespace + "-" + bundleServiceAccount},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "cluster-admin"},
+		Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Namespace: sa.Namespace, Name: sa.Name}},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, binding), "cluster role binding creation failed")
+}
+
+// createGitRepository creates a GitRepository for the given local repository.
+func createGitRepository(t *testing.T, k8sClient client.Client, repository *gittest.GitRepository) *v1alpha1.GitRepository {
+	repo := &v1alpha1.GitRepository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.GitRepository{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "repo1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.GitRepositorySpec{
+			URL:             repository.URL.String(),
+			Ref:             "refs/heads/main",
+			PollingInterval: "1s",
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(context.Background(), repo), "repository creation failed")
+	return repo
+}
+
+// createKubectlBundleWithRepository creates a GitRepository for the given local repository, and a KubectlBundle that
+// applies the given files from it.
+func createKubectlBundleWithRepository(t *testing.T, k8sClient client.Client, repository *gittest.GitRepository, prune bool, files ...string) *v1alpha1.KubectlBundle {
+	repo := createGitRepository(t, k8sClient, repository)
+	bundle := &v1alpha1.KubectlBundle{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.KubectlBundle{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bundle1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.KubectlBundleSpec{
+			DriftDetectionInterval: "1h",
+			SourceRepository:       repo.Namespace + "/" + repo.Name,
+			Files:                  files,
+			Prune:                  prune,
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(context.Background(), bundle), "bundle creation failed")
+	return bundle
+}
+
+// findKubectlBundleRun finds the run of the given bundle for the given commit SHA.
+func findKubectlBundleRun(c *assert.CollectT, k8sClient client.Client, bundle *v1alpha1.KubectlBundle, sha string) *v1alpha1.CommandRun {
+	var b v1alpha1.KubectlBundle
+	if !assert.NoErrorf(c, k8sClient.Get(context.Background(), client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+		return nil
+	}
+	runs := &v1alpha1.CommandRunList{}
+	if !assert.NoErrorf(c, k8sClient.List(context.Background(), runs, client.InNamespace(b.Namespace), client.MatchingLabels{ownerUIDKubectlBundle: string(b.UID)}), "runs lookup failed") {
+		return nil
+	}
+	for i := range runs.Items {
+		if runs.Items[i].Spec.CommitSHA == sha {
+			return &runs.Items[i]
+		}
+	}
+	assert.Failf(c, "run not found", "no run found for commit '%s'", sha)
+	return nil
+}
+
+func TestKubectlBundleApply(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("namespace.yaml", "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: ns1\n"), "failed to commit file")
+	require.NoErrorf(t, repository.CommitFile("configmap.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\ndata:\n  key: value1\n"), "failed to commit file")
+	require.NoErrorf(t, repository.CommitFile("configmap2.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm2\ndata:\n  key: value1\n"), "failed to commit file")
+	sha1, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	bundle := createKubectlBundleWithRepository(t, k8sClient, repository, false, "*.yaml")
+
+	ctx := context.Background()
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if run := findKubectlBundleRun(c, k8sClient, bundle, sha1); run != nil {
+			assert.Equal(c, 0, run.Status.ExitCode, "incorrect exit code")
+			assert.Equal(c, []v1alpha1.ObjectResult{
+				{APIVersion: "v1", Kind: "Namespace", Name: "ns1", Action: applyActionCreated},
+				{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "cm1", Action: applyActionCreated},
+				{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "cm2", Action: applyActionCreated},
+			}, run.Status.Objects, "incorrect object results")
+		}
+		var cm corev1.ConfigMap
+		if assert.NoErrorf(c, k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "cm1"}, &cm), "config map lookup failed") {
+			assert.Equal(c, "value1", cm.Data["key"], "incorrect config map data")
+			if assert.Len(c, cm.ManagedFields, 1, "incorrect managed fields") {
+				assert.Equal(c, fieldManager, cm.ManagedFields[0].Manager, "incorrect field manager")
+				assert.Equal(c, metav1.ManagedFieldsOperationApply, cm.ManagedFields[0].Operation, "incorrect operation")
+			}
+		}
+	}, 15*time.Second, 1*time.Second, "bundle not applied correctly")
+
+	// Change only the first config map; the second should be reported as unchanged
+	require.NoErrorf(t, repository.CommitFile("configmap.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\ndata:\n  key: value2\n"), "failed to commit file")
+	sha2, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if run := findKubectlBundleRun(c, k8sClient, bundle, sha2); run != nil {
+			assert.Equal(c, 0, run.Status.ExitCode, "incorrect exit code")
+			if assert.Len(c, run.Status.Objects, 3, "incorrect object results") {
+				assert.Equal(c, v1alpha1.ObjectResult{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "cm1", Action: applyActionConfigured}, run.Status.Objects[1], "incorrect object result")
+				assert.Equal(c, v1alpha1.ObjectResult{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "cm2", Action: applyActionUnchanged}, run.Status.Objects[2], "incorrect object result")
+			}
+		}
+		var cm corev1.ConfigMap
+		if assert.NoErrorf(c, k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "cm1"}, &cm), "config map lookup failed") {
+			assert.Equal(c, "value2", cm.Data["key"], "incorrect config map data")
+		}
+	}, 15*time.Second, 1*time.Second, "bundle changes not applied correctly")
+}
+
+func TestKubectlBundleApplyFailure(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("objects.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\n---\napiVersion: example.com/v1\nkind: Unknown\nmetadata:\n  name: u1\n"), "failed to commit file")
+	sha, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	bundle := createKubectlBundleWithRepository(t, k8sClient, repository, false, "objects.yaml")
+
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if run := findKubectlBundleRun(c, k8sClient, bundle, sha); run != nil {
+			assert.Equal(c, 1, run.Status.ExitCode, "incorrect exit code")
+			assert.Equal(c, "failed applying 1 of 2 objects", run.Status.Error, "incorrect error")
+			if assert.Len(c, run.Status.Objects, 2, "incorrect object results") {
+				assert.NotEqual(c, applyActionFailed, run.Status.Objects[0].Action, "incorrect action")
+				assert.Equal(c, applyActionFailed, run.Status.Objects[1].Action, "incorrect action")
+				assert.NotEmpty(c, run.Status.Objects[1].Error, "missing error")
+			}
+		}
+	}, 15*time.Second, 1*time.Second, "bundle failure not recorded correctly")
+}
+
+func TestKubectlBundlePrune(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("cm1.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\n"), "failed to commit file")
+	require.NoErrorf(t, repository.CommitFile("cm2.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm2\n"), "failed to commit file")
+	require.NoErrorf(t, repository.CommitFile("cm3.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm3\n  annotations:\n    "+annotationPrune+": "+annotationPruneDisabled+"\n"), "failed to commit file")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	bundle := createKubectlBundleWithRepository(t, k8sClient, repository, true, "*.yaml")
+	lookupKey := types.NamespacedName{Name: bundle.Name, Namespace: bundle.Namespace}
+
+	ctx := context.Background()
+	configMapExists := func(c assert.TestingT, name string) bool {
+		var cm corev1.ConfigMap
+		err := k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: name}, &cm)
+		assert.NoErrorf(c, client.IgnoreNotFound(err), "config map lookup failed")
+		return err == nil
+	}
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &b), "bundle lookup failed") {
+			assert.Equal(c, []v1alpha1.InventoryEntry{
+				{Version: "v1", Kind: "ConfigMap", Namespace: "default", Name: "cm1"},
+				{Version: "v1", Kind: "ConfigMap", Namespace: "default", Name: "cm2"},
+				{Version: "v1", Kind: "ConfigMap", Namespace: "default", Name: "cm3"},
+			}, b.Status.Inventory, "incorrect inventory")
+		}
+	}, 15*time.Second, 1*time.Second, "bundle inventory not recorded correctly")
+
+	// Removing objects from the bundle prunes them, unless annotated otherwise
+	require.NoErrorf(t, repository.RemoveFile("cm2.yaml"), "failed to remove file")
+	require.NoErrorf(t, repository.RemoveFile("cm3.yaml"), "failed to remove file")
+	sha, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if run := findKubectlBundleRun(c, k8sClient, bundle, sha); run != nil {
+			assert.Equal(c, []v1alpha1.ObjectResult{
+				{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "cm1", Action: applyActionUnchanged},
+				{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "cm2", Action: applyActionPruned},
+			}, run.Status.Objects, "incorrect object results")
+		}
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &b), "bundle lookup failed") {
+			assert.Equal(c, []v1alpha1.InventoryEntry{
+				{Version: "v1", Kind: "ConfigMap", Namespace: "default", Name: "cm1"},
+			}, b.Status.Inventory, "incorrect inventory")
+		}
+		assert.True(c, configMapExists(c, "cm1"), "config map cm1 should exist")
+		assert.False(c, configMapExists(c, "cm2"), "config map cm2 should have been pruned")
+		assert.True(c, configMapExists(c, "cm3"), "config map cm3 should not have been pruned")
+	}, 15*time.Second, 1*time.Second, "removed objects not pruned correctly")
+
+	// Deleting the bundle deletes all its objects
+	require.NoErrorf(t, k8sClient.Delete(ctx, bundle), "bundle deletion failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.KubectlBundle
+		assert.Truef(c, apierrors.IsNotFound(k8sClient.Get(ctx, lookupKey, &b)), "bundle not deleted")
+		assert.False(c, configMapExists(c, "cm1"), "config map cm1 should have been pruned")
+		assert.True(c, configMapExists(c, "cm3"), "config map cm3 should not have been pruned")
+	}, 15*time.Second, 1*time.Second, "bundle objects not pruned on deletion")
+}
+
+func TestKubectlBundleDriftDetection(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	for _, correctDrift := range []bool{false, true} {
+		correctDrift := correctDrift
+		t.Run(fmt.Sprintf("correctDrift=%v", correctDrift), func(t *testing.T) {
+			repository, err := gittest.NewGitRepository(strings.ReplaceAll(t.Name(), "/", "_"))
+			require.NoErrorf(t, err, "failed to create repository")
+			defer os.RemoveAll(repository.Dir)
+			require.NoErrorf(t, repository.CommitFile("cm1.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\ndata:\n  key: value1\n"), "failed to commit file")
+
+			k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+			createBundleServiceAccount(t, k8sClient, "default")
+			bundle := createKubectlBundleWithRepository(t, k8sClient, repository, false, "*.yaml")
+			lookupKey := types.NamespacedName{Name: bundle.Name, Namespace: bundle.Namespace}
+			cmKey := types.NamespacedName{Namespace: "default", Name: "cm1"}
+
+			ctx := context.Background()
+			assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+				var b v1alpha1.KubectlBundle
+				if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &b), "bundle lookup failed") {
+					assert.True(c, meta.IsStatusConditionFalse(b.Status.Conditions, typeDriftedKubectlBundle), "bundle should not be drifted")
+				}
+			}, 15*time.Second, 1*time.Second, "bundle not applied correctly")
+
+			// Enable drift correction & poll frequently
+			var b v1alpha1.KubectlBundle
+			require.NoErrorf(t, k8sClient.Get(ctx, lookupKey, &b), "bundle lookup failed")
+			b.Spec.DriftDetectionInterval = "1s"
+			b.Spec.CorrectDrift = correctDrift
+			require.NoErrorf(t, k8sClient.Update(ctx, &b), "bundle update failed")
+
+			// Edit the object in the cluster
+			var cm corev1.ConfigMap
+			require.NoErrorf(t, k8sClient.Get(ctx, cmKey, &cm), "config map lookup failed")
+			cm.Data["key"] = "edited"
+			require.NoErrorf(t, k8sClient.Update(ctx, &cm), "config map update failed")
+
+			if correctDrift {
+				assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+					var cm corev1.ConfigMap
+					if assert.NoErrorf(c, k8sClient.Get(ctx, cmKey, &cm), "config map lookup failed") {
+						assert.Equal(c, "value1", cm.Data["key"], "drift not corrected")
+					}
+					var b v1alpha1.KubectlBundle
+					if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &b), "bundle lookup failed") {
+						assert.True(c, meta.IsStatusConditionFalse(b.Status.Conditions, typeDriftedKubectlBundle), "bundle should not be drifted")
+						assert.Empty(c, b.Status.DriftedObjects, "incorrect drifted objects")
+					}
+				}, 15*time.Second, 1*time.Second, "drift not corrected")
+			} else {
+				assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+					var b v1alpha1.KubectlBundle
+					if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &b), "bundle lookup failed") {
+						cDrifted := meta.FindStatusCondition(b.Status.Conditions, typeDriftedKubectlBundle)
+						if assert.NotNil(c, cDrifted, "drifted condition not found") {
+							assert.Equal(c, metav1.ConditionTrue, cDrifted.Status, "incorrect status")
+							assert.Equal(c, "Drifted", cDrifted.Reason, "incorrect reason")
+						}
+						assert.Equal(c, []v1alpha1.InventoryEntry{
+							{Version: "v1", Kind: "ConfigMap", Namespace: "default", Name: "cm1"},
+						}, b.Status.DriftedObjects, "incorrect drifted objects")
+					}
+				}, 15*time.Second, 1*time.Second, "drift not detected")
+
+				var cm corev1.ConfigMap
+				require.NoErrorf(t, k8sClient.Get(ctx, cmKey, &cm), "config map lookup failed")
+				assert.Equal(t, "edited", cm.Data["key"], "drift should not have been corrected")
+			}
+		})
+	}
+}
+
+func TestKubectlBundleTimeout(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("cm1.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\n"), "failed to commit file")
+	sha, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	ctx := context.Background()
+	repo := createGitRepository(t, k8sClient, repository)
+	bundle := &v1alpha1.KubectlBundle{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.KubectlBundle{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bundle1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.KubectlBundleSpec{
+			DriftDetectionInterval: "1h",
+			SourceRepository:       repo.Namespace + "/" + repo.Name,
+			Files:                  []string{"*.yaml"},
+			Timeout:                "1ns",
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, bundle), "bundle creation failed")
+
+	// Runs exceeding the timeout should be terminated & marked as timed out
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if run := findKubectlBundleRun(c, k8sClient, bundle, sha); run != nil {
+			assert.Equal(c, 1, run.Status.ExitCode, "incorrect exit code")
+			assert.Equal(c, "timed out after 1ns", run.Status.Error, "incorrect error")
+			cFailed := meta.FindStatusCondition(run.Status.Conditions, typeFailedCommandRun)
+			if assert.NotNil(c, cFailed, "failed condition not found") {
+				assert.Equal(c, metav1.ConditionTrue, cFailed.Status, "incorrect status")
+				assert.Equal(c, reasonTimedOutCommandRun, cFailed.Reason, "incorrect reason")
+			}
+		}
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			cUpToDate := meta.FindStatusCondition(b.Status.Conditions, typeUpToDateKubectlBundle)
+			if assert.NotNil(c, cUpToDate, "uptodate condition not found") {
+				assert.Equal(c, metav1.ConditionFalse, cUpToDate.Status, "incorrect status")
+				assert.Equal(c, "Failed", cUpToDate.Reason, "incorrect reason")
+			}
+		}
+	}, 15*time.Second, 1*time.Second, "timeout not enforced correctly")
+}
+
+func TestKubectlBundleDependencies(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("base/kustomization.yaml", "resources:\n  - cm0.yaml\n"), "failed to commit file")
+	require.NoErrorf(t, repository.CommitFile("base/cm0.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm0\n"), "failed to commit file")
+	require.NoErrorf(t, repository.CommitFile("app/cm1.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\n"), "failed to commit file")
+	sha, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount}, &KustomizeBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	ctx := context.Background()
+	repo := createGitRepository(t, k8sClient, repository)
+	bundle := &v1alpha1.KubectlBundle{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.KubectlBundle{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bundle1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.KubectlBundleSpec{
+			DriftDetectionInterval: "1h",
+			SourceRepository:       repo.Namespace + "/" + repo.Name,
+			Files:                  []string{"app"},
+			DependsOn:              []v1alpha1.BundleReference{{Kind: "KustomizeBundle", Name: "default/base"}},
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, bundle), "bundle creation failed")
+
+	// The bundle should wait for its missing dependency
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			cUpToDate := meta.FindStatusCondition(b.Status.Conditions, typeUpToDateKubectlBundle)
+			if assert.NotNil(c, cUpToDate, "uptodate condition not found") {
+				assert.Equal(c, metav1.ConditionFalse, cUpToDate.Status, "incorrect status")
+				assert.Equal(c, reasonDependencyNotReady, cUpToDate.Reason, "incorrect reason")
+				assert.Equal(c, "Dependency 'KustomizeBundle/default/base' not found", cUpToDate.Message, "incorrect message")
+			}
+		}
+	}, 15*time.Second, 1*time.Second, "bundle not waiting for its dependency")
+	var cm corev1.ConfigMap
+	assert.True(t, apierrors.IsNotFound(k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "cm1"}, &cm)), "config map should not be applied before its dependency")
+
+	// Once the dependency is up-to-date, the bundle should be applied
+	base := &v1alpha1.KustomizeBundle{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.KustomizeBundle{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "base",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.KustomizeBundleSpec{
+			SourceRepository: bundle.Spec.SourceRepository,
+			Files:            []string{"base"},
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, base), "dependency creation failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			assert.True(c, meta.IsStatusConditionTrue(b.Status.Conditions, typeUpToDateKubectlBundle), "bundle not up to date")
+			assert.Equal(c, sha, b.Status.LastAppliedSHA, "incorrect last applied SHA")
+		}
+		for _, name := range []string{"cm0", "cm1"} {
+			var cm corev1.ConfigMap
+			assert.NoErrorf(c, k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: name}, &cm), "config map '%s' lookup failed", name)
+		}
+	}, 15*time.Second, 1*time.Second, "bundle not applied after its dependency")
+}
+
+func TestKubectlBundleDependencyCycle(t *testing.T) {
+	k8sClient, _, _ := harness.SetupTestEnv(t, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+
+	ctx := context.Background()
+	for name, dependency := range map[string]string{"bundle-a": "default/bundle-b", "bundle-b": "default/bundle-a"} {
+		bundle := &v1alpha1.KubectlBundle{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: v1alpha1.GroupVersion.String(),
+				Kind:       reflect.TypeOf(v1alpha1.KubectlBundle{}).Name(),
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+			},
+			Spec: v1alpha1.KubectlBundleSpec{
+				DriftDetectionInterval: "1h",
+				SourceRepository:       "default/repo1",
+				Files:                  []string{"*.yaml"},
+				DependsOn:              []v1alpha1.BundleReference{{Name: dependency}},
+			},
+		}
+		require.NoErrorf(t, k8sClient.Create(ctx, bundle), "bundle creation failed")
+	}
+
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "bundle-a"}, &b), "bundle lookup failed") {
+			cUpToDate := meta.FindStatusCondition(b.Status.Conditions, typeUpToDateKubectlBundle)
+			if assert.NotNil(c, cUpToDate, "uptodate condition not found") {
+				assert.Equal(c, metav1.ConditionFalse, cUpToDate.Status, "incorrect status")
+				assert.Equal(c, reasonDependencyCycle, cUpToDate.Reason, "incorrect reason")
+				assert.Equal(c, "Dependency cycle detected: KubectlBundle/default/bundle-a -> KubectlBundle/default/bundle-b -> KubectlBundle/default/bundle-a", cUpToDate.Message, "incorrect message")
+			}
+		}
+	}, 15*time.Second, 1*time.Second, "dependency cycle not detected")
+}
+
+func TestKubectlBundleImpersonation(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("cm1.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\ndata:\n  key: value1\n"), "failed to commit file")
+	sha1, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	ctx := context.Background()
+	repo := createGitRepository(t, k8sClient, repository)
+	bundle := &v1alpha1.KubectlBundle{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.KubectlBundle{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bundle1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.KubectlBundleSpec{
+			DriftDetectionInterval: "1h",
+			SourceRepository:       repo.Namespace + "/" + repo.Name,
+			Files:                  []string{"*.yaml"},
+			ServiceAccountName:     "deployer",
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, bundle), "bundle creation failed")
+
+	// A missing service account cannot be impersonated
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			cUpToDate := meta.FindStatusCondition(b.Status.Conditions, typeUpToDateKubectlBundle)
+			if assert.NotNil(c, cUpToDate, "uptodate condition not found") {
+				assert.Equal(c, metav1.ConditionFalse, cUpToDate.Status, "incorrect status")
+				assert.Equal(c, reasonImpersonationFailed, cUpToDate.Reason, "incorrect reason")
+				assert.Equal(c, "service account not found: 'default/deployer'", cUpToDate.Message, "incorrect message")
+			}
+		}
+	}, 15*time.Second, 1*time.Second, "missing service account not reported correctly")
+
+	// Objects are applied with the service account's permissions, which initially do not allow anything; request a
+	// reconciliation once the service account exists, rather than waiting for the failure backoff to elapse
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "deployer"}}
+	require.NoErrorf(t, k8sClient.Create(ctx, sa), "service account creation failed")
+	patch := client.MergeFrom(bundle.DeepCopy())
+	bundle.Annotations = map[string]string{annotationReconcileRequestedAt: "2022-09-01T10:00:00Z"}
+	require.NoErrorf(t, k8sClient.Patch(ctx, bundle, patch), "bundle update failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if run := findKubectlBundleRun(c, k8sClient, bundle, sha1); run != nil {
+			assert.Equal(c, 1, run.Status.ExitCode, "incorrect exit code")
+			if assert.Len(c, run.Status.Objects, 1, "incorrect object results") {
+				assert.Equal(c, applyActionFailed, run.Status.Objects[0].Action, "incorrect action")
+				assert.Contains(c, run.Status.Objects[0].Error, "system:serviceaccount:default:deployer", "incorrect error")
+			}
+		}
+	}, 15*time.Second, 1*time.Second, "objects not applied as the service account")
+	var cm corev1.ConfigMap
+	assert.True(t, apierrors.IsNotFound(k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "cm1"}, &cm)), "config map should not be applied without permissions")
+
+	// Once permitted, a new commit should be applied successfully
+	role := &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "deployer"},
+		Rules: []rbacv1.PolicyRule{{
+			APIGroups: []string{""},
+			Resources: []string{"configmaps"},
+			Verbs:     []string{"get", "list", "watch", "create", "patch"},
+		}},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, role), "role creation failed")
+	binding := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "deployer"},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: role.Name},
+		Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Namespace: sa.Namespace, Name: sa.Name}},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, binding), "role binding creation failed")
+	require.NoErrorf(t, repository.CommitFile("cm1.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\ndata:\n  key: value2\n"), "failed to commit file")
+	sha2, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if run := findKubectlBundleRun(c, k8sClient, bundle, sha2); run != nil {
+			assert.Equal(c, 0, run.Status.ExitCode, "incorrect exit code")
+		}
+		var cm corev1.ConfigMap
+		if assert.NoErrorf(c, k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "cm1"}, &cm), "config map lookup failed") {
+			assert.Equal(c, "value2", cm.Data["key"], "incorrect config map data")
+		}
+	}, 15*time.Second, 1*time.Second, "objects not applied once permitted")
+}
+
+func TestKubectlBundleDefaultServiceAccount(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("cm1.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\ndata:\n  key: value1\n"), "failed to commit file")
+	sha, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KubectlBundleReconciler{DefaultServiceAccount: "tenant"})
+	ctx := context.Background()
+	bundle := createKubectlBundleWithRepository(t, k8sClient, repository, false, "*.yaml")
+
+	// Bundles without a service account impersonate the default one, rather than acting as the controller itself
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			cUpToDate := meta.FindStatusCondition(b.Status.Conditions, typeUpToDateKubectlBundle)
+			if assert.NotNil(c, cUpToDate, "uptodate condition not found") {
+				assert.Equal(c, metav1.ConditionFalse, cUpToDate.Status, "incorrect status")
+				assert.Equal(c, reasonImpersonationFailed, cUpToDate.Reason, "incorrect reason")
+				assert.Equal(c, "service account not found: 'default/tenant'", cUpToDate.Message, "incorrect message")
+			}
+		}
+	}, 15*time.Second, 1*time.Second, "missing default service account not reported correctly")
+
+	// Request a reconciliation once the service account exists, rather than waiting for the failure backoff to elapse
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "tenant"}}
+	require.NoErrorf(t, k8sClient.Create(ctx, sa), "service account creation failed")
+	patch := client.MergeFrom(bundle.DeepCopy())
+	bundle.Annotations = map[string]string{annotationReconcileRequestedAt: "2022-09-01T10:00:00Z"}
+	require.NoErrorf(t, k8sClient.Patch(ctx, bundle, patch), "bundle update failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if run := findKubectlBundleRun(c, k8sClient, bundle, sha); run != nil {
+			assert.Equal(c, 1, run.Status.ExitCode, "incorrect exit code")
+			if assert.Len(c, run.Status.Objects, 1, "incorrect object results") {
+				assert.Equal(c, applyActionFailed, run.Status.Objects[0].Action, "incorrect action")
+				assert.Contains(c, run.Status.Objects[0].Error, "system:serviceaccount:default:tenant", "incorrect error")
+			}
+		}
+	}, 15*time.Second, 1*time.Second, "objects not applied as the default service account")
+	var cm corev1.ConfigMap
+	assert.True(t, apierrors.IsNotFound(k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "cm1"}, &cm)), "config map should not be applied without permissions")
+}
+
+func kubeConfigFor(t *testing.T, config *rest.Config) []byte {
+	kubeConfig := clientcmdapi.NewConfig()
+	kubeConfig.Clusters["remote"] = &clientcmdapi.Cluster{Server: config.Host, CertificateAuthorityData: config.CAData}
+	kubeConfig.AuthInfos["remote"] = &clientcmdapi.AuthInfo{ClientCertificateData: config.CertData, ClientKeyData: config.KeyData, Token: config.BearerToken}
+	kubeConfig.Contexts["remote"] = &clientcmdapi.Context{Cluster: "remote", AuthInfo: "remote"}
+	kubeConfig.CurrentContext = "remote"
+	data, err := clientcmd.Write(*kubeConfig)
+	require.NoErrorf(t, err, "failed to write kubeconfig")
+	return data
+}
+
+func TestKubectlBundleRemoteCluster(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("cm1.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\ndata:\n  key: value1\n"), "failed to commit file")
+	sha, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	remoteConfig, _, _ := harness.SetupServer(t)
+	remoteClient, err := client.New(remoteConfig, client.Options{})
+	require.NoErrorf(t, err, "failed to create remote client")
+	ctx := context.Background()
+	repo := createGitRepository(t, k8sClient, repository)
+	bundle := &v1alpha1.KubectlBundle{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.KubectlBundle{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bundle1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.KubectlBundleSpec{
+			DriftDetectionInterval: "1h",
+			SourceRepository:       repo.Namespace + "/" + repo.Name,
+			Files:                  []string{"*.yaml"},
+			KubeConfig:             &v1alpha1.KubeConfigReference{SecretRef: corev1.LocalObjectReference{Name: "remote"}},
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, bundle), "bundle creation failed")
+	assertTargetUnreachable := func(message string) {
+		assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+			var b v1alpha1.KubectlBundle
+			if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+				cUpToDate := meta.FindStatusCondition(b.Status.Conditions, typeUpToDateKubectlBundle)
+				if assert.NotNil(c, cUpToDate, "uptodate condition not found") {
+					assert.Equal(c, metav1.ConditionFalse, cUpToDate.Status, "incorrect status")
+					assert.Equal(c, reasonTargetUnreachable, cUpToDate.Reason, "incorrect reason")
+					assert.Contains(c, cUpToDate.Message, message, "incorrect message")
+				}
+			}
+		}, 15*time.Second, 1*time.Second, "unreachable target not reported correctly")
+	}
+
+	// A missing kubeconfig makes the target unreachable
+	assertTargetUnreachable("kubeconfig not found: 'default/remote'")
+
+	// So does a kubeconfig of a cluster that is down
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "remote"},
+		Data:       map[string][]byte{"value": kubeConfigFor(t, &rest.Config{Host: "https://127.0.0.1:1"})},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, secret), "secret creation failed")
+	assertTargetUnreachable("failed to reach cluster at 'https://127.0.0.1:1'")
+
+	// Once the kubeconfig points to a live cluster, objects should be applied to it, rather than to the local cluster
+	secret.Data["value"] = kubeConfigFor(t, remoteConfig)
+	require.NoErrorf(t, k8sClient.Update(ctx, secret), "secret update failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if run := findKubectlBundleRun(c, k8sClient, bundle, sha); run != nil {
+			assert.Equal(c, 0, run.Status.ExitCode, "incorrect exit code")
+		}
+		var cm corev1.ConfigMap
+		if assert.NoErrorf(c, remoteClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "cm1"}, &cm), "remote config map lookup failed") {
+			assert.Equal(c, "value1", cm.Data["key"], "incorrect config map data")
+		}
+	}, 15*time.Second, 1*time.Second, "objects not applied to remote cluster")
+	var cm corev1.ConfigMap
+	assert.True(t, apierrors.IsNotFound(k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "cm1"}, &cm)), "config map should not be applied to the local cluster")
+}
+
+func TestKubectlBundleSymlinkOutsideRepository(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	// Place a manifest next to the repository's work directory, and link to it from the repository
+	workDir := t.TempDir()
+	require.NoErrorf(t, os.WriteFile(filepath.Join(workDir, "outside.yaml"), []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: outside\n"), 0600), "failed to write file")
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, os.Symlink("../outside.yaml", filepath.Join(repository.Dir, "cm.yaml")), "failed to create symlink")
+	require.NoErrorf(t, repository.RunGit("add", "cm.yaml"), "failed to add symlink")
+	require.NoErrorf(t, repository.RunGit("commit", "-m", "Adding cm.yaml"), "failed to commit symlink")
+	sha, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: workDir}, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	ctx := context.Background()
+	repo := createGitRepository(t, k8sClient, repository)
+	bundle := &v1alpha1.KubectlBundle{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.KubectlBundle{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bundle1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.KubectlBundleSpec{
+			DriftDetectionInterval: "1h",
+			SourceRepository:       repo.Namespace + "/" + repo.Name,
+			Files:                  []string{"*.yaml"},
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, bundle), "bundle creation failed")
+
+	// Symlinks leading outside the repository should not be followed
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if run := findKubectlBundleRun(c, k8sClient, bundle, sha); run != nil {
+			assert.Equal(c, 1, run.Status.ExitCode, "incorrect exit code")
+			assert.Contains(c, run.Status.Error, "is outside the repository", "incorrect error")
+		}
+	}, 15*time.Second, 1*time.Second, "symlink outside the repository not rejected")
+	var cm corev1.ConfigMap
+	assert.True(t, apierrors.IsNotFound(k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "outside"}, &cm)), "config map outside the repository should not be applied")
+}
+
+func TestKubectlBundleSubstitution(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("cm.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: ${NAME}\ndata:\n  key: ${VALUE}\n  region: ${REGION:=us-east1}\n  literal: $${NAME}\n"), "failed to commit file")
+	sha, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	ctx := context.Background()
+	vars := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "vars"},
+		Data:       map[string]string{"NAME": "overridden", "VALUE": "value1"},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, vars), "variables config map creation failed")
+	repo := createGitRepository(t, k8sClient, repository)
+	bundle := &v1alpha1.KubectlBundle{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.KubectlBundle{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bundle1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.KubectlBundleSpec{
+			DriftDetectionInterval: "1h",
+			SourceRepository:       repo.Namespace + "/" + repo.Name,
+			Files:                  []string{"*.yaml"},
+			Substitute:             map[string]string{"NAME": "cm1"},
+			SubstituteFrom: []v1alpha1.SubstituteReference{
+				{Kind: "ConfigMap", Name: vars.Name},
+				{Kind: "Secret", Name: "missing", Optional: true},
+			},
+			StrictSubstitution: true,
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, bundle), "bundle creation failed")
+
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if run := findKubectlBundleRun(c, k8sClient, bundle, sha); run != nil {
+			assert.Equal(c, 0, run.Status.ExitCode, "incorrect exit code")
+			assert.Equal(c, []string{"NAME", "VALUE"}, run.Status.Variables, "incorrect variables")
+		}
+		var cm corev1.ConfigMap
+		if assert.NoErrorf(c, k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "cm1"}, &cm), "config map lookup failed") {
+			assert.Equal(c, map[string]string{"key": "value1", "region": "us-east1", "literal": "${NAME}"}, cm.Data, "incorrect config map data")
+		}
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			cDrifted := meta.FindStatusCondition(b.Status.Conditions, typeDriftedKubectlBundle)
+			if assert.NotNil(c, cDrifted, "drifted condition not found") {
+				assert.Equal(c, metav1.ConditionFalse, cDrifted.Status, "substituted objects should not be reported as drifted")
+			}
+		}
+	}, 15*time.Second, 1*time.Second, "variables not substituted")
+
+	// In strict mode, a reference to an undefined variable fails the run
+	require.NoErrorf(t, repository.CommitFile("cm.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: ${NAME}\ndata:\n  key: ${UNDEFINED}\n"), "failed to commit file")
+	sha2, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if run := findKubectlBundleRun(c, k8sClient, bundle, sha2); run != nil {
+			assert.Equal(c, 1, run.Status.ExitCode, "incorrect exit code")
+			assert.Contains(c, run.Status.Error, "undefined variables: UNDEFINED", "incorrect error")
+		}
+	}, 15*time.Second, 1*time.Second, "undefined variable not reported")
+}
+
+func TestKubectlBundleDecryption(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	identity, err := age.GenerateX25519Identity()
+	require.NoErrorf(t, err, "failed to generate age identity")
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("secret.yaml", sopsEncrypt(t, "apiVersion: v1\nkind: Secret\nmetadata:\n  name: secret1\nstringData:\n  password: s3cr3t\n", identity.Recipient().String())), "failed to commit file")
+	sha1, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	ctx := context.Background()
+	keys := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "sops-keys"},
+		Data:       map[string][]byte{"identity.agekey": []byte(identity.String())},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, keys), "keys secret creation failed")
+	repo := createGitRepository(t, k8sClient, repository)
+	bundle := &v1alpha1.KubectlBundle{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.KubectlBundle{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bundle1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.KubectlBundleSpec{
+			DriftDetectionInterval: "1h",
+			SourceRepository:       repo.Namespace + "/" + repo.Name,
+			Files:                  []string{"*.yaml"},
+			Decryption:             &v1alpha1.Decryption{SecretRef: corev1.LocalObjectReference{Name: keys.Name}},
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, bundle), "bundle creation failed")
+
+	// Encrypted files should be applied decrypted
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if run := findKubectlBundleRun(c, k8sClient, bundle, sha1); run != nil {
+			assert.Equal(c, 0, run.Status.ExitCode, "incorrect exit code")
+			assert.NotContains(c, run.Status.Output, "s3cr3t", "output should not contain decrypted values")
+		}
+		var secret corev1.Secret
+		if assert.NoErrorf(c, k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "secret1"}, &secret), "secret lookup failed") {
+			assert.Equal(c, "s3cr3t", string(secret.Data["password"]), "incorrect secret data")
+		}
+	}, 15*time.Second, 1*time.Second, "encrypted file not applied")
+
+	// Errors of decrypted objects should be redacted
+	require.NoErrorf(t, repository.CommitFile("secret.yaml", sopsEncrypt(t, "apiVersion: v1\nkind: Secret\nmetadata:\n  name: secret1\ndata:\n  password: s3cr3t!\n", identity.Recipient().String())), "failed to commit file")
+	sha2, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if run := findKubectlBundleRun(c, k8sClient, bundle, sha2); run != nil {
+			assert.Equal(c, 1, run.Status.ExitCode, "incorrect exit code")
+			if assert.Len(c, run.Status.Objects, 1, "incorrect object results") {
+				assert.Equal(c, redactedError, run.Status.Objects[0].Error, "error should be redacted")
+			}
+			assert.NotContains(c, run.Status.Output, "s3cr3t", "output should not contain decrypted values")
+		}
+	}, 15*time.Second, 1*time.Second, "error of decrypted object not redacted")
+}
+
+func TestKubectlBundleDiff(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("cm1.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\ndata:\n  key: value1\n  other: same\n"), "failed to commit file")
+	require.NoErrorf(t, repository.CommitFile("cm2.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm2\ndata:\n  key: value1\n"), "failed to commit file")
+	require.NoErrorf(t, repository.CommitFile("secret.yaml", "apiVersion: v1\nkind: Secret\nmetadata:\n  name: secret1\nstringData:\n  password: s3cr3t\n"), "failed to commit file")
+	sha, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	ctx := context.Background()
+	cm1 := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "cm1"},
+		Data:       map[string]string{"key": "value0", "other": "same"},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, cm1), "config map creation failed")
+	repo := createGitRepository(t, k8sClient, repository)
+	bundle := &v1alpha1.KubectlBundle{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.KubectlBundle{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bundle1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.KubectlBundleSpec{
+			DriftDetectionInterval: "1h",
+			SourceRepository:       repo.Namespace + "/" + repo.Name,
+			Files:                  []string{"*.yaml"},
+			Prune:                  true,
+			Mode:                   applyModeDiff,
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, bundle), "bundle creation failed")
+
+	configMapValue := func(c assert.TestingT, name string) string {
+		var cm corev1.ConfigMap
+		err := k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: name}, &cm)
+		assert.NoErrorf(c, client.IgnoreNotFound(err), "config map lookup failed")
+		return cm.Data["key"]
+	}
+
+	// Diff mode records the changes to each object, without changing the cluster
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if run := findKubectlBundleRun(c, k8sClient, bundle, sha); run != nil {
+			assert.Equal(c, 0, run.Status.ExitCode, "incorrect exit code")
+			assert.Equal(c, kubectlBundleCommands[applyModeDiff], run.Spec.Command, "incorrect command")
+			if assert.Len(c, run.Status.Objects, 3, "incorrect object results") {
+				assert.Equal(c, v1alpha1.ObjectResult{
+					APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "cm1", Action: applyActionConfigured,
+					Diff: []v1alpha1.FieldDiff{{Path: ".data.key", Live: `"value0"`, Desired: `"value1"`}},
+				}, run.Status.Objects[0], "incorrect object result")
+				assert.Equal(c, applyActionCreated, run.Status.Objects[1].Action, "incorrect action")
+				assert.Contains(c, run.Status.Objects[1].Diff, v1alpha1.FieldDiff{Path: ".data", Desired: `{"key":"value1"}`}, "incorrect diff")
+				assert.Equal(c, applyActionCreated, run.Status.Objects[2].Action, "incorrect action")
+				assert.Contains(c, run.Status.Objects[2].Diff, v1alpha1.FieldDiff{Path: ".data", Desired: `{"password":"***"}`}, "secret data should be masked")
+			}
+			assert.Contains(c, run.Status.Output, "configmap default/cm1 configured (server dry run)\n  .data.key: \"value0\" -> \"value1\"\n", "incorrect output")
+			assert.NotContains(c, run.Status.Output, "s3cr3t", "output should not contain secret data")
+		}
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			cUpToDate := meta.FindStatusCondition(b.Status.Conditions, typeUpToDateKubectlBundle)
+			if assert.NotNil(c, cUpToDate, "up-to-date condition not found") {
+				assert.Equal(c, metav1.ConditionFalse, cUpToDate.Status, "previewed bundle should not be up-to-date")
+				assert.Equal(c, applyModeDiff, cUpToDate.Reason, "incorrect reason")
+			}
+			assert.Empty(c, b.Status.Inventory, "previewed objects should not be added to the inventory")
+			assert.Empty(c, b.Status.LastAppliedSHA, "previewed commit should not be recorded as applied")
+		}
+	}, 15*time.Second, 1*time.Second, "bundle diff not recorded correctly")
+	assert.Equal(t, "value0", configMapValue(t, "cm1"), "config map cm1 should not have been changed")
+	assert.Empty(t, configMapValue(t, "cm2"), "config map cm2 should not have been created")
+
+	// Promoting the bundle to "Apply" mode applies it
+	patch := client.MergeFrom(bundle.DeepCopy())
+	bundle.Spec.Mode = applyModeApply
+	require.NoErrorf(t, k8sClient.Patch(ctx, bundle, patch), "bundle update failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		assert.Equal(c, "value1", configMapValue(c, "cm1"), "config map cm1 not applied")
+		assert.Equal(c, "value1", configMapValue(c, "cm2"), "config map cm2 not applied")
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			assert.Equal(c, sha, b.Status.LastAppliedSHA, "incorrect last applied SHA")
+			assert.Len(c, b.Status.Inventory, 3, "incorrect inventory")
+		}
+	}, 15*time.Second, 1*time.Second, "promoted bundle not applied")
+}
+
+func TestKubectlBundleDiffSecretSubstitution(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("cm.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\ndata:\n  password: ${PASSWORD}\n  region: ${REGION}\n"), "failed to commit file")
+	sha, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	ctx := context.Background()
+	vars := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "vars"},
+		Data:       map[string][]byte{"PASSWORD": []byte("s3cr3t")},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, vars), "variables secret creation failed")
+	repo := createGitRepository(t, k8sClient, repository)
+	bundle := &v1alpha1.KubectlBundle{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.KubectlBundle{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bundle1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.KubectlBundleSpec{
+			DriftDetectionInterval: "1h",
+			SourceRepository:       repo.Namespace + "/" + repo.Name,
+			Files:                  []string{"*.yaml"},
+			Substitute:             map[string]string{"REGION": "us-east1"},
+			SubstituteFrom:         []v1alpha1.SubstituteReference{{Kind: "Secret", Name: vars.Name}},
+			Mode:                   applyModeDiff,
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, bundle), "bundle creation failed")
+
+	// Diffs disclosing values substituted from Secrets should be masked
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if run := findKubectlBundleRun(c, k8sClient, bundle, sha); run != nil {
+			assert.Equal(c, 0, run.Status.ExitCode, "incorrect exit code")
+			assert.Equal(c, []string{"PASSWORD", "REGION"}, run.Status.Variables, "incorrect variables")
+			if assert.Len(c, run.Status.Objects, 1, "incorrect object results") {
+				assert.Equal(c, applyActionCreated, run.Status.Objects[0].Action, "incorrect action")
+				assert.Contains(c, run.Status.Objects[0].Diff, v1alpha1.FieldDiff{Path: ".data", Desired: `"***"`}, "diff of secret variable should be masked")
+			}
+			assert.NotContains(c, run.Status.Output, "s3cr3t", "output should not contain secret variables")
+		}
+	}, 15*time.Second, 1*time.Second, "diff of secret variable not masked")
+}
+
+func TestKubectlBundleHealthChecks(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("cm1.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\n"), "failed to commit file")
+	require.NoErrorf(t, repository.CommitFile("job1.yaml", "apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: job1\nspec:\n  template:\n    spec:\n      restartPolicy: Never\n      containers:\n        - name: main\n          image: busybox\n"), "failed to commit file")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	ctx := context.Background()
+	job2 := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "job2"},
+		Spec: batchv1.JobSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers:    []corev1.Container{{Name: "main", Image: "busybox"}},
+				},
+			},
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, job2), "job creation failed")
+	repo := createGitRepository(t, k8sClient, repository)
+	bundle := &v1alpha1.KubectlBundle{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.KubectlBundle{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bundle1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.KubectlBundleSpec{
+			DriftDetectionInterval: "1s",
+			SourceRepository:       repo.Namespace + "/" + repo.Name,
+			Files:                  []string{"*.yaml"},
+			Wait:                   true,
+			HealthChecks:           []v1alpha1.HealthCheck{{APIVersion: "batch/v1", Kind: "Job", Name: job2.Name}},
+			HealthCheckTimeout:     "1h",
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, bundle), "bundle creation failed")
+
+	healthyCondition := func(c assert.TestingT) *metav1.Condition {
+		var b v1alpha1.KubectlBundle
+		if !assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			return nil
+		}
+		cHealthy := meta.FindStatusCondition(b.Status.Conditions, typeHealthyKubectlBundle)
+		assert.NotNil(c, cHealthy, "healthy condition not found")
+		return cHealthy
+	}
+	setJobStatus := func(name string, status batchv1.JobStatus) {
+		require.NoErrorf(t, retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+			var j batchv1.Job
+			if err := k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: name}, &j); err != nil {
+				return err
+			}
+			j.Status = status
+			return k8sClient.Status().Update(ctx, &j)
+		}), "job status update failed")
+	}
+
+	// Jobs that have not started are waited for
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if cHealthy := healthyCondition(c); cHealthy != nil {
+			assert.Equal(c, metav1.ConditionUnknown, cHealthy.Status, "incorrect status")
+			assert.Equal(c, reasonProgressing, cHealthy.Reason, "incorrect reason")
+			assert.Equal(c, "Waiting for 2 objects to become ready: Job default/job1: Job not started; Job default/job2: Job not started", cHealthy.Message, "incorrect message")
+		}
+	}, 15*time.Second, 1*time.Second, "bundle not waiting for its objects")
+
+	// Once all objects are ready, the bundle is healthy
+	now := metav1.Now()
+	setJobStatus("job1", batchv1.JobStatus{StartTime: &now, CompletionTime: &now, Succeeded: 1, Conditions: []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}})
+	setJobStatus("job2", batchv1.JobStatus{StartTime: &now, Active: 1})
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if cHealthy := healthyCondition(c); cHealthy != nil {
+			assert.Equal(c, metav1.ConditionTrue, cHealthy.Status, "incorrect status")
+			assert.Equal(c, reasonHealthy, cHealthy.Reason, "incorrect reason")
+			assert.Equal(c, "All 3 objects are ready", cHealthy.Message, "incorrect message")
+		}
+	}, 15*time.Second, 1*time.Second, "bundle not reported as healthy")
+
+	// Failed objects make the bundle unhealthy
+	setJobStatus("job2", batchv1.JobStatus{StartTime: &now, Failed: 1, Conditions: []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}}})
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if cHealthy := healthyCondition(c); cHealthy != nil {
+			assert.Equal(c, metav1.ConditionFalse, cHealthy.Status, "incorrect status")
+			assert.Equal(c, reasonUnhealthy, cHealthy.Reason, "incorrect reason")
+			assert.Equal(c, "1 objects failed: Job default/job2: Job Failed. failed: 1/1", cHealthy.Message, "incorrect message")
+		}
+	}, 15*time.Second, 1*time.Second, "bundle not reported as unhealthy")
+}
+
+func TestKubectlBundleSuspend(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("cm1.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\n"), "failed to commit file")
+	sha, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	ctx := context.Background()
+	repo := createGitRepository(t, k8sClient, repository)
+	bundle := &v1alpha1.KubectlBundle{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.KubectlBundle{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bundle1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.KubectlBundleSpec{
+			DriftDetectionInterval: "1h",
+			SourceRepository:       repo.Namespace + "/" + repo.Name,
+			Files:                  []string{"*.yaml"},
+			Suspend:                true,
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, bundle), "bundle creation failed")
+
+	// Suspended bundles are not applied
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			cSuspended := meta.FindStatusCondition(b.Status.Conditions, typeSuspendedKubectlBundle)
+			if assert.NotNil(c, cSuspended, "suspended condition not found") {
+				assert.Equal(c, metav1.ConditionTrue, cSuspended.Status, "incorrect status")
+				assert.Equal(c, "Suspended", cSuspended.Reason, "incorrect reason")
+			}
+		}
+		var r v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(repo), &r), "repository lookup failed") {
+			assert.Equal(c, sha, r.Status.LastPulledSHA, "repository not pulled")
+		}
+	}, 15*time.Second, 1*time.Second, "bundle not suspended")
+	time.Sleep(3 * time.Second)
+	runs := &v1alpha1.CommandRunList{}
+	require.NoErrorf(t, k8sClient.List(ctx, runs, client.InNamespace("default")), "runs lookup failed")
+	assert.Empty(t, runs.Items, "suspended bundle should not have been run")
+
+	// Once resumed, the bundle is applied
+	patch := client.MergeFrom(bundle.DeepCopy())
+	bundle.Spec.Suspend = false
+	require.NoErrorf(t, k8sClient.Patch(ctx, bundle, patch), "bundle update failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if run := findKubectlBundleRun(c, k8sClient, bundle, sha); run != nil {
+			assert.Equal(c, 0, run.Status.ExitCode, "incorrect exit code")
+		}
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			cSuspended := meta.FindStatusCondition(b.Status.Conditions, typeSuspendedKubectlBundle)
+			if assert.NotNil(c, cSuspended, "suspended condition not found") {
+				assert.Equal(c, metav1.ConditionFalse, cSuspended.Status, "incorrect status")
+			}
+		}
+	}, 15*time.Second, 1*time.Second, "bundle not resumed")
+}
+
+func TestKubectlBundleReconcileRequest(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("cm1.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\n"), "failed to commit file")
+	sha, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	ctx := context.Background()
+	repo := createGitRepository(t, k8sClient, repository)
+	bundle := &v1alpha1.KubectlBundle{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.KubectlBundle{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bundle1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.KubectlBundleSpec{
+			DriftDetectionInterval: "1h",
+			SourceRepository:       repo.Namespace + "/" + repo.Name,
+			Files:                  []string{"*.yaml"},
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, bundle), "bundle creation failed")
+	countRuns := func(c *assert.CollectT) int {
+		runs := &v1alpha1.CommandRunList{}
+		if !assert.NoErrorf(c, k8sClient.List(ctx, runs, client.InNamespace(bundle.Namespace), client.MatchingLabels{ownerUIDKubectlBundle: string(bundle.UID)}), "runs lookup failed") {
+			return 0
+		}
+		return len(runs.Items)
+	}
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			assert.Equal(c, sha, b.Status.LastAppliedSHA, "incorrect last applied SHA")
+			assert.True(c, meta.IsStatusConditionTrue(b.Status.Conditions, typeUpToDateKubectlBundle), "bundle not up-to-date")
+		}
+		assert.Equal(c, 1, countRuns(c), "incorrect number of runs")
+	}, 15*time.Second, 1*time.Second, "bundle not applied")
+
+	// Requesting a reconciliation re-applies the bundle, even though the last run matches the repository SHA
+	patch := client.MergeFrom(bundle.DeepCopy())
+	bundle.Annotations = map[string]string{annotationReconcileRequestedAt: "2022-09-01T10:00:00Z"}
+	require.NoErrorf(t, k8sClient.Patch(ctx, bundle, patch), "bundle update failed")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			assert.Equal(c, "2022-09-01T10:00:00Z", b.Status.LastHandledReconcileAt, "incorrect handled reconcile request")
+			assert.True(c, meta.IsStatusConditionTrue(b.Status.Conditions, typeUpToDateKubectlBundle), "bundle not up-to-date")
+		}
+		assert.Equal(c, 2, countRuns(c), "incorrect number of runs")
+	}, 15*time.Second, 1*time.Second, "reconcile request not handled")
+
+	// Handled requests are not repeated
+	time.Sleep(3 * time.Second)
+	runs := &v1alpha1.CommandRunList{}
+	require.NoErrorf(t, k8sClient.List(ctx, runs, client.InNamespace(bundle.Namespace), client.MatchingLabels{ownerUIDKubectlBundle: string(bundle.UID)}), "runs lookup failed")
+	assert.Len(t, runs.Items, 2, "handled reconcile request should not have been re-applied")
+}
+
+func TestKubectlBundleRetries(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("objects.yaml", "apiVersion: example.com/v1\nkind: Unknown\nmetadata:\n  name: u1\n"), "failed to commit file")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	ctx := context.Background()
+	repo := createGitRepository(t, k8sClient, repository)
+	bundle := &v1alpha1.KubectlBundle{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.KubectlBundle{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bundle1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.KubectlBundleSpec{
+			DriftDetectionInterval: "1h",
+			SourceRepository:       repo.Namespace + "/" + repo.Name,
+			Files:                  []string{"objects.yaml"},
+			RunsHistoryLimit:       10,
+			Retry:                  &v1alpha1.RetryPolicy{InitialDelay: "1s", MaxDelay: "2s", MaxAttempts: 3},
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, bundle), "bundle creation failed")
+	listRuns := func(c *assert.CollectT) []v1alpha1.CommandRun {
+		runs := &v1alpha1.CommandRunList{}
+		if !assert.NoErrorf(c, k8sClient.List(ctx, runs, client.InNamespace(bundle.Namespace), client.MatchingLabels{ownerUIDKubectlBundle: string(bundle.UID)}), "runs lookup failed") {
+			return nil
+		}
+		return runs.Items
+	}
+
+	// Failed runs are retried with backoff, until the attempts are exhausted
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			assert.Equal(c, 3, b.Status.Attempts, "incorrect attempts")
+			cUpToDate := meta.FindStatusCondition(b.Status.Conditions, typeUpToDateKubectlBundle)
+			if assert.NotNil(c, cUpToDate, "up-to-date condition not found") {
+				assert.Equal(c, metav1.ConditionFalse, cUpToDate.Status, "incorrect status")
+				assert.Equal(c, "RetriesExhausted", cUpToDate.Reason, "incorrect reason")
+			}
+		}
+		runs := listRuns(c)
+		if assert.Len(c, runs, 3, "incorrect number of runs") {
+			sort.Slice(runs, func(i, j int) bool { return runs[i].CreationTimestamp.Before(&runs[j].CreationTimestamp) })
+			for i := 1; i < len(runs); i++ {
+				if assert.NotNil(c, runs[i-1].Status.CompletionTime, "run not finished") {
+					assert.GreaterOrEqual(c, runs[i].CreationTimestamp.Sub(runs[i-1].Status.CompletionTime.Time), time.Duration(i-1)*time.Second, "retried without backing off")
+				}
+			}
+		}
+	}, 20*time.Second, 1*time.Second, "retries not exhausted")
+	time.Sleep(3 * time.Second)
+	runs := &v1alpha1.CommandRunList{}
+	require.NoErrorf(t, k8sClient.List(ctx, runs, client.InNamespace(bundle.Namespace), client.MatchingLabels{ownerUIDKubectlBundle: string(bundle.UID)}), "runs lookup failed")
+	assert.Len(t, runs.Items, 3, "exhausted retries should not have been retried")
+
+	// A new commit starts over
+	require.NoErrorf(t, repository.CommitFile("objects.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\n"), "failed to commit file")
+	sha, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			assert.Equal(c, sha, b.Status.LastAppliedSHA, "incorrect last applied SHA")
+			assert.Equal(c, 1, b.Status.Attempts, "incorrect attempts")
+			assert.True(c, meta.IsStatusConditionTrue(b.Status.Conditions, typeUpToDateKubectlBundle), "bundle not up-to-date")
+		}
+	}, 20*time.Second, 1*time.Second, "new commit not applied")
+}
+
+func TestKubectlBundleSkipsUnchangedFiles(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("app/cm1.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\ndata:\n  key: value1\n"), "failed to commit file")
+	sha1, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	ctx := context.Background()
+	repo := createGitRepository(t, k8sClient, repository)
+	bundle := &v1alpha1.KubectlBundle{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.KubectlBundle{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bundle1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.KubectlBundleSpec{
+			DriftDetectionInterval: "1h",
+			SourceRepository:       repo.Namespace + "/" + repo.Name,
+			Files:                  []string{"app"},
+			RunsHistoryLimit:       10,
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, bundle), "bundle creation failed")
+	countRuns := func(c *assert.CollectT) int {
+		runs := &v1alpha1.CommandRunList{}
+		if !assert.NoErrorf(c, k8sClient.List(ctx, runs, client.InNamespace(bundle.Namespace), client.MatchingLabels{ownerUIDKubectlBundle: string(bundle.UID)}), "runs lookup failed") {
+			return 0
+		}
+		return len(runs.Items)
+	}
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if run := findKubectlBundleRun(c, k8sClient, bundle, sha1); run != nil {
+			assert.NotEmpty(c, run.Spec.FilesDigest, "missing files digest")
+		}
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			assert.Equal(c, sha1, b.Status.LastAppliedSHA, "incorrect last applied SHA")
+		}
+	}, 15*time.Second, 1*time.Second, "bundle not applied")
+
+	// Commits not changing the bundle's files are recorded as applied, without running the bundle again
+	require.NoErrorf(t, repository.CommitFile("docs/README.md", "# Docs\n"), "failed to commit file")
+	sha2, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			assert.Equal(c, sha2, b.Status.LastAppliedSHA, "incorrect last applied SHA")
+			assert.True(c, meta.IsStatusConditionTrue(b.Status.Conditions, typeUpToDateKubectlBundle), "bundle not up-to-date")
+		}
+		assert.Equal(c, 1, countRuns(c), "incorrect number of runs")
+	}, 15*time.Second, 1*time.Second, "unrelated commit not recorded as applied")
+
+	// Commits changing the bundle's files run the bundle again
+	require.NoErrorf(t, repository.CommitFile("app/cm1.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\ndata:\n  key: value2\n"), "failed to commit file")
+	sha3, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if run := findKubectlBundleRun(c, k8sClient, bundle, sha3); run != nil {
+			assert.Equal(c, 0, run.Status.ExitCode, "incorrect exit code")
+		}
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			assert.Equal(c, sha3, b.Status.LastAppliedSHA, "incorrect last applied SHA")
+		}
+		assert.Equal(c, 2, countRuns(c), "incorrect number of runs")
+		var cm corev1.ConfigMap
+		if assert.NoErrorf(c, k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "cm1"}, &cm), "config map lookup failed") {
+			assert.Equal(c, "value2", cm.Data["key"], "incorrect config map data")
+		}
+	}, 15*time.Second, 1*time.Second, "changed files not applied")
+}
+
+func TestKubectlBundleRetriesFailedFilesOnNewCommit(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("app/objects.yaml", "apiVersion: example.com/v1\nkind: Unknown\nmetadata:\n  name: u1\n"), "failed to commit file")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KubectlBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	ctx := context.Background()
+	repo := createGitRepository(t, k8sClient, repository)
+	bundle := &v1alpha1.KubectlBundle{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.KubectlBundle{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bundle1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.KubectlBundleSpec{
+			DriftDetectionInterval: "1h",
+			SourceRepository:       repo.Namespace + "/" + repo.Name,
+			Files:                  []string{"app"},
+			RunsHistoryLimit:       10,
+			Retry:                  &v1alpha1.RetryPolicy{InitialDelay: "1s", MaxDelay: "1s", MaxAttempts: 2},
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, bundle), "bundle creation failed")
+	countRuns := func(c *assert.CollectT) int {
+		runs := &v1alpha1.CommandRunList{}
+		if !assert.NoErrorf(c, k8sClient.List(ctx, runs, client.InNamespace(bundle.Namespace), client.MatchingLabels{ownerUIDKubectlBundle: string(bundle.UID)}), "runs lookup failed") {
+			return 0
+		}
+		return len(runs.Items)
+	}
+	assertRetriesExhausted := func(c *assert.CollectT) {
+		var b v1alpha1.KubectlBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, client.ObjectKeyFromObject(bundle), &b), "bundle lookup failed") {
+			assert.Equal(c, 2, b.Status.Attempts, "incorrect attempts")
+			cUpToDate := meta.FindStatusCondition(b.Status.Conditions, typeUpToDateKubectlBundle)
+			if assert.NotNil(c, cUpToDate, "up-to-date condition not found") {
+				assert.Equal(c, "RetriesExhausted", cUpToDate.Reason, "incorrect reason")
+			}
+		}
+	}
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		assertRetriesExhausted(c)
+		assert.Equal(c, 2, countRuns(c), "incorrect number of runs")
+	}, 20*time.Second, 1*time.Second, "retries not exhausted")
+
+	// Commits not changing the failed files still run them again, starting over the attempts
+	require.NoErrorf(t, repository.CommitFile("docs/README.md", "# Docs\n"), "failed to commit file")
+	sha2, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		if run := findKubectlBundleRun(c, k8sClient, bundle, sha2); run != nil {
+			assert.NotEqual(c, 0, run.Status.ExitCode, "incorrect exit code")
+		}
+		assertRetriesExhausted(c)
+		assert.Equal(c, 4, countRuns(c), "incorrect number of runs")
+	}, 20*time.Second, 1*time.Second, "failed files not retried on new commit")
+}
@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+const (
+	kudePipelineFileName = "kude.yaml" // Name of the pipeline manifest file when a directory is given
+	kudePipelineKind     = "Pipeline"  // Kind of pipeline manifests
+)
+
+// kudePipeline is a kude pipeline manifest, declaring the resources to load and the steps transforming them.
+type kudePipeline struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Resources  []string   `json:"resources,omitempty"` // Resource files, directories or glob patterns, relative to the manifest
+	Steps      []kudeStep `json:"steps,omitempty"`     // Transformation steps, run in order
+}
+
+// kudeStep is a single transformation step in a kude pipeline.
+type kudeStep struct {
+	Name     string          `json:"name,omitempty"`   // Optional name of the step, used in error messages
+	Function string          `json:"function"`         // Name of the builtin function to run
+	Config   json.RawMessage `json:"config,omitempty"` // Function-specific configuration
+}
+
+// kudeFunction transforms the given objects according to the given configuration. The REST mapper is used to resolve
+// the scope of object types.
+type kudeFunction func(mapper meta.RESTMapper, config json.RawMessage, objects []*unstructured.Unstructured) ([]*unstructured.Unstructured, error)
+
+// kudeFunctions is the registry of builtin pipeline functions.
+var kudeFunctions = map[string]kudeFunction{
+	"annotate":         kudeAnnotate,
+	"label":            kudeLabel,
+	"set-namespace":    kudeSetNamespace,
+	"create-namespace": kudeCreateNamespace,
+	"create-configmap": kudeCreateConfigMap,
+}
+
+// runKudePipeline loads the pipeline manifest at the given path (relative to the given repository directory), loads its
+// resources, and runs its steps over them in order, returning the resulting objects.
+func runKudePipeline(mapper meta.RESTMapper, dir, path string) ([]*unstructured.Unstructured, error) {
+	manifest := filepath.Join(dir, path)
+	if rel, err := filepath.Rel(dir, manifest); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("pipeline '%s' is outside the repository", path)
+	} else if info, err := os.Stat(manifest); err != nil {
+		return nil, fmt.Errorf("failed to stat pipeline '%s': %w", path, err)
+	} else if info.IsDir() {
+		manifest = filepath.Join(manifest, kudePipelineFileName)
+	}
+
+	// Resolve symlinks before verifying that the manifest is inside the repository, so they cannot lead outside it
+	if root, err := filepath.EvalSymlinks(dir); err != nil {
+		return nil, fmt.Errorf("failed to resolve directory '%s': %w", dir, err)
+	} else if resolved, err := filepath.EvalSymlinks(manifest); err != nil {
+		return nil, fmt.Errorf("failed to resolve pipeline '%s': %w", path, err)
+	} else if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("pipeline '%s' is outside the repository", path)
+	}
+
+	data, err := os.ReadFile(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pipeline '%s': %w", path, err)
+	}
+	var pipeline kudePipeline
+	if err := yaml.UnmarshalStrict(data, &pipeline); err != nil {
+		return nil, fmt.Errorf("failed to parse pipeline '%s': %w", path, err)
+	} else if pipeline.APIVersion != v1alpha1.GroupVersion.String() || pipeline.Kind != kudePipelineKind {
+		return nil, fmt.Errorf("pipeline '%s' must be of kind '%s/%s'", path, v1alpha1.GroupVersion.String(), kudePipelineKind)
+	}
+
+	// Load resources; patterns are relative to the pipeline manifest, but must stay within the repository
+	manifestDir, err := filepath.Rel(dir, filepath.Dir(manifest))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve pipeline '%s' directory: %w", path, err)
+	}
+	patterns := make([]string, len(pipeline.Resources))
+	for i, resource := range pipeline.Resources {
+		patterns[i] = filepath.Join(manifestDir, resource)
+	}
+	loaded, err := readManifests(dir, patterns, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pipeline '%s' resources: %w", path, err)
+	}
+	var objects []*unstructured.Unstructured
+	for _, obj := range loaded {
+		// Skip pipeline manifests picked up from resource directories
+		if obj.GetAPIVersion() != v1alpha1.GroupVersion.String() || obj.GetKind() != kudePipelineKind {
+			objects = append(objects, obj)
+		}
+	}
+
+	// Run steps
+	for i, step := range pipeline.Steps {
+		name := step.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		function, ok := kudeFunctions[step.Function]
+		if !ok {
+			return nil, fmt.Errorf("pipeline '%s' step '%s' failed: unknown function '%s'", path, name, step.Function)
+		}
+		objects, err = function(mapper, step.Config, objects)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline '%s' step '%s' (%s) failed: %w", path, name, step.Function, err)
+		}
+	}
+	return objects, nil
+}
+
+// decodeKudeConfig strictly decodes the given function configuration into the given target.
+func decodeKudeConfig(config json.RawMessage, target interface{}) error {
+	if len(config) == 0 {
+		config = []byte("{}")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(config))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(target); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	return nil
+}
+
+// kudeAnnotate adds the configured annotations to all objects.
+func kudeAnnotate(_ meta.RESTMapper, config json.RawMessage, objects []*unstructured.Unstructured) ([]*unstructured.Unstructured, error) {
+	var cfg struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := decodeKudeConfig(config, &cfg); err != nil {
+		return nil, err
+	} else if len(cfg.Annotations) == 0 {
+		return nil, fmt.Errorf("no annotations specified")
+	}
+	for _, obj := range objects {
+		annotations := obj.GetAnnotations()
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		for k, v := range cfg.Annotations {
+			annotations[k] = v
+		}
+		obj.SetAnnotations(annotations)
+	}
+	return objects, nil
+}
+
+// kudeLabel adds the configured labels to all objects.
+func kudeLabel(_ meta.RESTMapper, config json.RawMessage, objects []*unstructured.Unstructured) ([]*unstructured.Unstructured, error) {
+	var cfg struct {
+		Labels map[string]string `json:"labels"`
+	}
+	if err := decodeKudeConfig(config, &cfg); err != nil {
+		return nil, err
+	} else if len(cfg.Labels) == 0 {
+		return nil, fmt.Errorf("no labels specified")
+	}
+	for _, obj := range objects {
+		labels := obj.GetLabels()
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		for k, v := range cfg.Labels {
+			labels[k] = v
+		}
+		obj.SetLabels(labels)
+	}
+	return objects, nil
+}
+
+// kudeSetNamespace sets the configured namespace on all namespaced objects. Objects of unknown types (e.g. custom
+// resources whose definitions are part of the same pipeline) are assumed to be namespaced.
+func kudeSetNamespace(mapper meta.RESTMapper, config json.RawMessage, objects []*unstructured.Unstructured) ([]*unstructured.Unstructured, error) {
+	var cfg struct {
+		Namespace string `json:"namespace"`
+	}
+	if err := decodeKudeConfig(config, &cfg); err != nil {
+		return nil, err
+	} else if cfg.Namespace == "" {
+		return nil, fmt.Errorf("no namespace specified")
+	}
+	for _, obj := range objects {
+		gvk := obj.GroupVersionKind()
+		if mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version); err != nil && !meta.IsNoMatchError(err) {
+			return nil, fmt.Errorf("failed to resolve resource type of %s '%s': %w", gvk.Kind, obj.GetName(), err)
+		} else if err != nil || mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			obj.SetNamespace(cfg.Namespace)
+		}
+	}
+	return objects, nil
+}
+
+// kudeCreateNamespace adds a Namespace object with the configured name, unless it already exists in the pipeline.
+func kudeCreateNamespace(_ meta.RESTMapper, config json.RawMessage, objects []*unstructured.Unstructured) ([]*unstructured.Unstructured, error) {
+	var cfg struct {
+		Name string `json:"name"`
+	}
+	if err := decodeKudeConfig(config, &cfg); err != nil {
+		return nil, err
+	} else if cfg.Name == "" {
+		return nil, fmt.Errorf("no namespace name specified")
+	}
+	for _, obj := range objects {
+		if obj.GetAPIVersion() == "v1" && obj.GetKind() == "Namespace" && obj.GetName() == cfg.Name {
+			return objects, nil
+		}
+	}
+	ns := &unstructured.Unstructured{}
+	ns.SetAPIVersion("v1")
+	ns.SetKind("Namespace")
+	ns.SetName(cfg.Name)
+	return append(objects, ns), nil
+}
+
+// kudeCreateConfigMap adds a ConfigMap object with the configured name, namespace & data.
+func kudeCreateConfigMap(_ meta.RESTMapper, config json.RawMessage, objects []*unstructured.Unstructured) ([]*unstructured.Unstructured, error) {
+	var cfg struct {
+		Name      string            `json:"name"`
+		Namespace string            `json:"namespace"`
+		Data      map[string]string `json:"data"`
+	}
+	if err := decodeKudeConfig(config, &cfg); err != nil {
+		return nil, err
+	} else if cfg.Name == "" {
+		return nil, fmt.Errorf("no config map name specified")
+	}
+	cm := &unstructured.Unstructured{}
+	cm.SetAPIVersion("v1")
+	cm.SetKind("ConfigMap")
+	cm.SetName(cfg.Name)
+	cm.SetNamespace(cfg.Namespace)
+	if len(cfg.Data) > 0 {
+		if err := unstructured.SetNestedStringMap(cm.Object, cfg.Data, "data"); err != nil {
+			return nil, fmt.Errorf("failed to set config map data: %w", err)
+		}
+	}
+	return append(objects, cm), nil
+}
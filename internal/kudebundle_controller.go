@@ -0,0 +1,273 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	kstrings "k8s.io/utils/strings"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"strings"
+)
+
+const (
+	finalizerKudeBundle     = "kudebundles.kude.kfirs.com/finalizer"
+	typeUpToDateKudeBundle  = "UpToDate"  // Is the KudeBundle up to date?
+	typeDegradedKudeBundle  = "Degraded"  // When the KudeBundle is deleted, but finalizer not applied yet
+	typeSuspendedKudeBundle = "Suspended" // Is reconciliation of the KudeBundle suspended?
+)
+
+// KudeBundleReconciler reconciles a KudeBundle object
+type KudeBundleReconciler struct {
+	Client                client.Client        // Kubernetes API client
+	Recorder              record.EventRecorder // Kubernetes event recorder
+	Scheme                *runtime.Scheme      // Scheme registry
+	Config                *rest.Config         // REST config of the cluster the controller runs in; defaults to the manager's config
+	DefaultServiceAccount string               // Service account to impersonate for local bundles not specifying one
+	targets               *targetClusters      // Clients of remote clusters that bundles are applied to
+}
+
+//+kubebuilder:rbac:groups=kude.kfirs.com,resources=kudebundles,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=kude.kfirs.com,resources=kudebundles/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=kude.kfirs.com,resources=kudebundles/finalizers,verbs=update
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=get;list;watch;impersonate
+//+kubebuilder:rbac:groups=core,resources=groups,verbs=impersonate
+
+// Reconcile continuously aims to move the current state of [KudeBundle] objects closer to their desired state.
+func (r *KudeBundleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var o v1alpha1.KudeBundle
+	if err := r.Client.Get(ctx, req.NamespacedName, &o); err != nil {
+		// we'll ignore not-found errors, since they can't be fixed by an immediate
+		// requeue (we'll need to wait for a new notification), and we can get them
+		// on deleted requests.
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// Ensure statuses have the "Unknown" value when they are missing
+	if meta.FindStatusCondition(o.Status.Conditions, typeUpToDateKudeBundle) == nil {
+		if res, err := r.setCondition(ctx, &o, typeUpToDateKudeBundle, metav1.ConditionUnknown, "Reconciling", "Initial value"); res.Requeue || err != nil {
+			return res, err
+		}
+	}
+	if meta.FindStatusCondition(o.Status.Conditions, typeDegradedKudeBundle) == nil {
+		if res, err := r.setCondition(ctx, &o, typeDegradedKudeBundle, metav1.ConditionFalse, "Reconciling", "Initial value"); res.Requeue || err != nil {
+			return res, err
+		}
+	}
+
+	// Add our finalizer
+	if controllerutil.AddFinalizer(&o, finalizerKudeBundle) {
+		if err := r.Client.Update(ctx, &o); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to update KudeBundle with finalizer: %w", err)
+		} else {
+			return ctrl.Result{Requeue: true}, nil
+		}
+	}
+
+	// If marked for deletion, perform actual deletion & remove finalizer
+	if o.DeletionTimestamp != nil {
+		if res, err := r.setCondition(ctx, &o, typeDegradedKudeBundle, metav1.ConditionTrue, "Deleted", "Deleting resource"); res.Requeue || err != nil {
+			return res, err
+		}
+		if res, err := r.setCondition(ctx, &o, typeUpToDateKudeBundle, metav1.ConditionUnknown, "Deleted", "Deleting resource"); res.Requeue || err != nil {
+			return res, err
+		}
+		if controllerutil.RemoveFinalizer(&o, finalizerKudeBundle) {
+			if err := r.Client.Update(ctx, &o); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		return ctrl.Result{}, nil
+	}
+
+	// Skip all work while suspended; we'll be notified when resumed
+	if o.Spec.Suspend {
+		if !meta.IsStatusConditionTrue(o.Status.Conditions, typeSuspendedKudeBundle) {
+			r.Recorder.Event(&o, v1.EventTypeNormal, "Suspended", "Reconciliation suspended")
+		}
+		return r.setCondition(ctx, &o, typeSuspendedKudeBundle, metav1.ConditionTrue, "Suspended", "Reconciliation is suspended")
+	} else if meta.IsStatusConditionTrue(o.Status.Conditions, typeSuspendedKudeBundle) {
+		r.Recorder.Event(&o, v1.EventTypeNormal, "Resumed", "Reconciliation resumed")
+	}
+	if res, err := r.setCondition(ctx, &o, typeSuspendedKudeBundle, metav1.ConditionFalse, "NotSuspended", ""); res.Requeue || err != nil {
+		return res, err
+	}
+
+	// Wait for dependencies to be up-to-date with their current commit; we'll be notified when they change
+	if reason, message, err := checkDependencies(ctx, r.Client, "KudeBundle", &o); err != nil {
+		return ctrl.Result{}, err
+	} else if reason != "" {
+		return r.setCondition(ctx, &o, typeUpToDateKudeBundle, metav1.ConditionFalse, reason, message)
+	}
+
+	// Fetch source GitRepository
+	var repo v1alpha1.GitRepository
+	gitRepoNamespace, gitRepoName := kstrings.SplitQualifiedName(o.Spec.SourceRepository)
+	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: gitRepoNamespace, Name: gitRepoName}, &repo); err != nil {
+		return r.setCondition(ctx, &o, typeUpToDateKudeBundle, metav1.ConditionUnknown, "GitRepositoryNotFound", err.Error())
+	}
+
+	// Ensure GitRepository is ready to be used
+	if !meta.IsStatusConditionTrue(repo.Status.Conditions, typeAvailableGitRepository) {
+		return r.setCondition(ctx, &o, typeUpToDateKudeBundle, metav1.ConditionUnknown, "GitRepositoryNotAvailable", "")
+	}
+
+	// We're up-to-date if the last successfully applied SHA matches the latest repository commit SHA, and no
+	// reconciliation was requested since the last apply
+	requested := reconcileRequestedAt(&o)
+	if o.Status.LastAppliedSHA == repo.Status.LastPulledSHA && o.Status.LastHandledReconcileAt == requested {
+		return r.setCondition(ctx, &o, typeUpToDateKudeBundle, metav1.ConditionTrue, "UpToDate", "Last applied SHA matches current repository SHA")
+	}
+
+	// Connect to the bundle's target cluster, impersonating the bundle's service account, if any
+	_, applier, reason, err := r.targets.connect(ctx, r.Client, r.Config, o.Namespace, o.Spec.KubeConfig, o.Spec.ServiceAccountName)
+	if err != nil {
+		r.Recorder.Eventf(&o, v1.EventTypeWarning, reason, err.Error())
+		if res, err := r.setCondition(ctx, &o, typeUpToDateKudeBundle, metav1.ConditionFalse, reason, err.Error()); err != nil {
+			return res, err
+		}
+		// Return an error, so the request is retried with backoff
+		return ctrl.Result{}, err
+	}
+
+	// Run the pipelines & apply the resulting resources
+	objects, errs := r.run(applier.RESTMapper(), repo.Status.WorkDirectory, o.Spec.Files)
+	if len(errs) == 0 {
+		for _, result := range applyObjects(ctx, applier, o.Namespace, objects, applyModeApply) {
+			if result.Action == applyActionFailed {
+				errs = append(errs, formatObjectResult(result))
+			}
+		}
+	}
+
+	// Update status
+	o.Status.Errors = errs
+	if len(errs) == 0 {
+		o.Status.LastAppliedSHA = repo.Status.LastPulledSHA
+		o.Status.LastHandledReconcileAt = requested
+	}
+	if err := r.Client.Status().Update(ctx, &o); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to update KudeBundle status: %w", err)
+	}
+	if len(errs) > 0 {
+		r.Recorder.Eventf(&o, v1.EventTypeWarning, "ApplyFailed", "Failed applying pipelines:\n%s", strings.Join(errs, "\n"))
+		if res, err := r.setCondition(ctx, &o, typeUpToDateKudeBundle, metav1.ConditionFalse, "Failed", "Failed applying pipelines"); err != nil {
+			return res, err
+		}
+		// Return an error, so the request is retried with backoff
+		return ctrl.Result{}, fmt.Errorf("failed applying pipelines at commit '%s'", repo.Status.LastPulledSHA)
+	}
+	r.Recorder.Eventf(&o, v1.EventTypeNormal, "Applied", "Applied %d objects at commit '%s'", len(objects), repo.Status.LastPulledSHA)
+	return r.setCondition(ctx, &o, typeUpToDateKudeBundle, metav1.ConditionTrue, "UpToDate", "Last applied SHA matches current repository SHA")
+}
+
+// run runs the kude pipelines at the given paths (relative to the given directory), using the given REST mapper of the
+// target cluster, and returns the resulting objects along with the errors of failed pipelines.
+func (r *KudeBundleReconciler) run(mapper meta.RESTMapper, dir string, paths []string) ([]*unstructured.Unstructured, []string) {
+	var objects []*unstructured.Unstructured
+	var errs []string
+	for _, path := range paths {
+		pathObjects, err := runKudePipeline(mapper, dir, path)
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			objects = append(objects, pathObjects...)
+		}
+	}
+	return objects, errs
+}
+
+func (r *KudeBundleReconciler) findObjectsForGitRepository(gr client.Object) []reconcile.Request {
+	grKey := gr.GetNamespace() + "/" + gr.GetName()
+
+	bundles := &v1alpha1.KudeBundleList{}
+	listOps := &client.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector(".spec.sourceRepository", grKey),
+	}
+	err := r.Client.List(context.TODO(), bundles, listOps)
+	if err != nil {
+		ctrl.Log.Error(err, "Failed listing Kude bundles for GitRepository", "gitRepository", grKey)
+		return []reconcile.Request{}
+	}
+
+	requests := make([]reconcile.Request, len(bundles.Items))
+	for i, b := range bundles.Items {
+		requests[i] = reconcile.Request{
+			NamespacedName: types.NamespacedName{
+				Name:      b.GetName(),
+				Namespace: b.GetNamespace(),
+			},
+		}
+	}
+	return requests
+}
+
+func (r *KudeBundleReconciler) setCondition(ctx context.Context, o *v1alpha1.KudeBundle, conditionType string, status metav1.ConditionStatus, reason, message string) (ctrl.Result, error) {
+	if c := meta.FindStatusCondition(o.Status.Conditions, conditionType); c == nil || c.Status != status || c.Reason != reason || c.Message != message {
+		meta.SetStatusCondition(&o.Status.Conditions, metav1.Condition{
+			Type:    conditionType,
+			Status:  status,
+			Reason:  reason,
+			Message: message,
+		})
+		if err := r.Client.Status().Update(ctx, o); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to set condition '%s' to '%s' with reason '%s': %w", conditionType, status, reason, err)
+		} else {
+			return ctrl.Result{Requeue: true}, nil
+		}
+	} else {
+		return ctrl.Result{}, nil
+	}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *KudeBundleReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.Client = mgr.GetClient()
+	r.Scheme = mgr.GetScheme()
+	r.Recorder = mgr.GetEventRecorderFor("kudebundle")
+	if r.Config == nil {
+		r.Config = mgr.GetConfig()
+	}
+	r.targets = newTargetClusters(r.DefaultServiceAccount)
+
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &v1alpha1.KudeBundle{}, ".spec.sourceRepository", func(rawObj client.Object) []string {
+		bundle := rawObj.(*v1alpha1.KudeBundle)
+		if bundle.Spec.SourceRepository == "" {
+			return nil
+		}
+		return []string{bundle.Spec.SourceRepository}
+	}); err != nil {
+		return fmt.Errorf("failed to create index for source-repository: %w", err)
+	}
+
+	if err := indexDependencies(mgr, "KudeBundle"); err != nil {
+		return err
+	}
+
+	if err := indexKubeConfigs(mgr, "KudeBundle"); err != nil {
+		return err
+	}
+
+	b := ctrl.NewControllerManagedBy(mgr).
+		For(&v1alpha1.KudeBundle{}).
+		Watches(
+			&source.Kind{Type: &v1alpha1.GitRepository{}},
+			handler.EnqueueRequestsFromMapFunc(r.findObjectsForGitRepository),
+		)
+	b = watchDependencies(b, r.Client, &v1alpha1.KudeBundleList{})
+	return watchKubeConfigs(b, r.Client, &v1alpha1.KudeBundleList{}).Complete(r)
+}
@@ -0,0 +1,222 @@
+package internal
+
+import (
+	"context"
+	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+	"github.com/arikkfir/kude-controller/test/gittest"
+	"github.com/arikkfir/kude-controller/test/harness"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
+	"path/filepath"
+	"reflect"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"testing"
+	"time"
+)
+
+func TestIgnoreMissingKudeBundleResource(t *testing.T) {
+	reconciler := &KudeBundleReconciler{}
+	_, _, _ = harness.SetupTestEnv(t, reconciler)
+
+	time.Sleep(5 * time.Second) // Give manager and cache time to start; needed since we're directly invoking controller
+	res, err := reconciler.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: types.NamespacedName{
+			Namespace: "ns1",
+			Name:      "r1",
+		},
+	})
+	assert.NoErrorf(t, err, "expected reconciliation for missing resource NOT to fail")
+	assert.Falsef(t, res.Requeue, "expected reconciliation for missing resource NOT to request requeuing, got: %+v", res)
+}
+
+// createKudeBundleWithRepository creates a GitRepository for the given local repository, and a KudeBundle that runs
+// the given pipelines from it.
+func createKudeBundleWithRepository(t *testing.T, k8sClient client.Client, repository *gittest.GitRepository, paths ...string) *v1alpha1.KudeBundle {
+	ctx := context.Background()
+	repo := &v1alpha1.GitRepository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.GitRepository{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "repo1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.GitRepositorySpec{
+			URL:             repository.URL.String(),
+			Ref:             "refs/heads/main",
+			PollingInterval: "1s",
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, repo), "repository creation failed")
+
+	bundle := &v1alpha1.KudeBundle{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.KudeBundle{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bundle1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.KudeBundleSpec{
+			SourceRepository: repo.Namespace + "/" + repo.Name,
+			Files:            paths,
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, bundle), "bundle creation failed")
+	return bundle
+}
+
+func TestKudeBundleApply(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("app/resources/configmap.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\ndata:\n  key: value1\n"), "failed to commit file")
+	require.NoErrorf(t, repository.CommitFile("app/kude.yaml", `apiVersion: kude.kfirs.com/v1alpha1
+kind: Pipeline
+resources:
+  - resources
+steps:
+  - function: create-namespace
+    config:
+      name: kude-ns
+  - name: generate
+    function: create-configmap
+    config:
+      name: cm2
+      data:
+        key: value2
+  - function: set-namespace
+    config:
+      namespace: kude-ns
+  - function: label
+    config:
+      labels:
+        app: app1
+`), "failed to commit file")
+	sha1, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KudeBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	bundle := createKudeBundleWithRepository(t, k8sClient, repository, "app")
+	lookupKey := types.NamespacedName{Name: bundle.Name, Namespace: bundle.Namespace}
+
+	ctx := context.Background()
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.KudeBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &b), "bundle lookup failed") {
+			assert.Contains(c, b.Finalizers, finalizerKudeBundle, "finalizer not found")
+			assert.Equal(c, sha1, b.Status.LastAppliedSHA, "incorrect last applied SHA")
+			assert.Empty(c, b.Status.Errors, "unexpected errors")
+			assert.True(c, meta.IsStatusConditionTrue(b.Status.Conditions, typeUpToDateKudeBundle), "bundle not up to date")
+		}
+		var ns corev1.Namespace
+		if assert.NoErrorf(c, k8sClient.Get(ctx, types.NamespacedName{Name: "kude-ns"}, &ns), "namespace lookup failed") {
+			assert.Equal(c, "app1", ns.Labels["app"], "incorrect namespace label")
+		}
+		for name, value := range map[string]string{"cm1": "value1", "cm2": "value2"} {
+			var cm corev1.ConfigMap
+			if assert.NoErrorf(c, k8sClient.Get(ctx, types.NamespacedName{Namespace: "kude-ns", Name: name}, &cm), "config map '%s' lookup failed", name) {
+				assert.Equal(c, value, cm.Data["key"], "incorrect config map '%s' data", name)
+				assert.Equal(c, "app1", cm.Labels["app"], "incorrect config map '%s' label", name)
+			}
+		}
+	}, 15*time.Second, 1*time.Second, "pipeline not applied correctly")
+
+	// A new commit should be applied as well
+	require.NoErrorf(t, repository.CommitFile("app/resources/configmap.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\ndata:\n  key: value3\n"), "failed to commit file")
+	sha2, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.KudeBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &b), "bundle lookup failed") {
+			assert.Equal(c, sha2, b.Status.LastAppliedSHA, "incorrect last applied SHA")
+		}
+		var cm corev1.ConfigMap
+		if assert.NoErrorf(c, k8sClient.Get(ctx, types.NamespacedName{Namespace: "kude-ns", Name: "cm1"}, &cm), "config map lookup failed") {
+			assert.Equal(c, "value3", cm.Data["key"], "incorrect config map data")
+		}
+	}, 15*time.Second, 1*time.Second, "new commit not applied correctly")
+}
+
+func TestKudeBundleStepFailure(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("kude.yaml", `apiVersion: kude.kfirs.com/v1alpha1
+kind: Pipeline
+steps:
+  - name: bad-label
+    function: label
+    config:
+      unknown: value
+`), "failed to commit file")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KudeBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	bundle := createKudeBundleWithRepository(t, k8sClient, repository, ".")
+	lookupKey := types.NamespacedName{Name: bundle.Name, Namespace: bundle.Namespace}
+
+	ctx := context.Background()
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.KudeBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &b), "bundle lookup failed") {
+			assert.Empty(c, b.Status.LastAppliedSHA, "unexpected last applied SHA")
+			if assert.Len(c, b.Status.Errors, 1, "incorrect errors") {
+				assert.Contains(c, b.Status.Errors[0], "pipeline '.' step 'bad-label' (label) failed", "incorrect error")
+			}
+			cUpToDate := meta.FindStatusCondition(b.Status.Conditions, typeUpToDateKudeBundle)
+			if assert.NotNil(c, cUpToDate, "uptodate condition not found") {
+				assert.Equal(c, metav1.ConditionFalse, cUpToDate.Status, "incorrect status")
+				assert.Equal(c, "Failed", cUpToDate.Reason, "incorrect reason")
+			}
+		}
+	}, 15*time.Second, 1*time.Second, "step failure not recorded correctly")
+}
+
+func TestKudeBundleSymlinkOutsideRepository(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+
+	// Place a pipeline next to the repository's work directory, and link to it from the repository
+	workDir := t.TempDir()
+	require.NoErrorf(t, os.WriteFile(filepath.Join(workDir, "outside.yaml"), []byte("apiVersion: kude.kfirs.com/v1alpha1\nkind: Pipeline\n"), 0600), "failed to write file")
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, os.Symlink("../outside.yaml", filepath.Join(repository.Dir, "kude.yaml")), "failed to create symlink")
+	require.NoErrorf(t, repository.RunGit("add", "kude.yaml"), "failed to add symlink")
+	require.NoErrorf(t, repository.RunGit("commit", "-m", "Adding kude.yaml"), "failed to commit symlink")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: workDir}, &KudeBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	bundle := createKudeBundleWithRepository(t, k8sClient, repository, ".")
+	lookupKey := types.NamespacedName{Name: bundle.Name, Namespace: bundle.Namespace}
+
+	// Symlinks leading outside the repository should not be followed
+	ctx := context.Background()
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.KudeBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &b), "bundle lookup failed") {
+			assert.Empty(c, b.Status.LastAppliedSHA, "unexpected last applied SHA")
+			if assert.Len(c, b.Status.Errors, 1, "incorrect errors") {
+				assert.Contains(c, b.Status.Errors[0], "pipeline '.' is outside the repository", "incorrect error")
+			}
+		}
+	}, 15*time.Second, 1*time.Second, "symlink outside the repository not rejected")
+}
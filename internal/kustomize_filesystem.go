@@ -0,0 +1,217 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sigs.k8s.io/kustomize/api/konfig"
+	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"strings"
+)
+
+// errReadOnlyFileSystem is returned when writing to a confined file system.
+var errReadOnlyFileSystem = errors.New("file system is read-only")
+
+// remoteReferencePrefixes are the prefixes of kustomization references that kustomize fetches remotely (from git
+// repositories or over HTTP) rather than from the file system.
+var remoteReferencePrefixes = []string{"git::", "gh:", "ssh://", "https://", "http://", "git@", "github.com"}
+
+// confinedFileSystem is a read-only kustomize file system on disk, confined to a root directory: paths outside it
+// (including paths leading outside it through symlinks) cannot be accessed, and kustomizations referring to remote
+// resources or bases cannot be read, since kustomize would otherwise fetch them. Since kustomize does not always report
+// the errors of the file system, the first violation is recorded so that it can be reported instead.
+type confinedFileSystem struct {
+	filesys.FileSystem        // File system on disk
+	root               string // Directory that paths are confined to, with symlinks resolved
+	violation          error  // First access violation, if any
+}
+
+// newConfinedFileSystem creates a file system confined to the given directory.
+func newConfinedFileSystem(root string) (*confinedFileSystem, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve directory '%s': %w", root, err)
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve directory '%s': %w", root, err)
+	}
+	return &confinedFileSystem{FileSystem: filesys.MakeFsOnDisk(), root: root}, nil
+}
+
+// confine verifies that the given path, with symlinks resolved, is inside the root directory. Symlinks are resolved up
+// to the longest existing prefix of the path, so missing paths are confined as well.
+func (c *confinedFileSystem) confine(path string) error {
+	resolved, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve path '%s': %w", path, err)
+	}
+	var missing []string
+	for {
+		if target, err := filepath.EvalSymlinks(resolved); err == nil {
+			resolved = filepath.Join(append([]string{target}, missing...)...)
+			break
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to resolve path '%s': %w", path, err)
+		} else if parent := filepath.Dir(resolved); parent == resolved {
+			break
+		} else {
+			missing = append([]string{filepath.Base(resolved)}, missing...)
+			resolved = parent
+		}
+	}
+	if rel, err := filepath.Rel(c.root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return c.violate(fmt.Errorf("path '%s' is outside the repository", path))
+	}
+	return nil
+}
+
+// violate records the given access violation, if it's the first one, and returns it.
+func (c *confinedFileSystem) violate(err error) error {
+	if c.violation == nil {
+		c.violation = err
+	}
+	return err
+}
+
+// Create fails, since the file system is read-only.
+func (c *confinedFileSystem) Create(string) (filesys.File, error) {
+	return nil, errReadOnlyFileSystem
+}
+
+// Mkdir fails, since the file system is read-only.
+func (c *confinedFileSystem) Mkdir(string) error {
+	return errReadOnlyFileSystem
+}
+
+// MkdirAll fails, since the file system is read-only.
+func (c *confinedFileSystem) MkdirAll(string) error {
+	return errReadOnlyFileSystem
+}
+
+// RemoveAll fails, since the file system is read-only.
+func (c *confinedFileSystem) RemoveAll(string) error {
+	return errReadOnlyFileSystem
+}
+
+// WriteFile fails, since the file system is read-only.
+func (c *confinedFileSystem) WriteFile(string, []byte) error {
+	return errReadOnlyFileSystem
+}
+
+// Open opens the given file, if it's inside the root directory.
+func (c *confinedFileSystem) Open(path string) (filesys.File, error) {
+	if err := c.confine(path); err != nil {
+		return nil, err
+	}
+	return c.FileSystem.Open(path)
+}
+
+// IsDir checks whether the given path is a directory inside the root directory.
+func (c *confinedFileSystem) IsDir(path string) bool {
+	return c.confine(path) == nil && c.FileSystem.IsDir(path)
+}
+
+// ReadDir returns the names of the files in the given directory, if it's inside the root directory.
+func (c *confinedFileSystem) ReadDir(path string) ([]string, error) {
+	if err := c.confine(path); err != nil {
+		return nil, err
+	}
+	return c.FileSystem.ReadDir(path)
+}
+
+// CleanedAbs splits the given path into its confirmed directory & file name, if it's inside the root directory.
+func (c *confinedFileSystem) CleanedAbs(path string) (filesys.ConfirmedDir, string, error) {
+	dir, file, err := c.FileSystem.CleanedAbs(path)
+	if err != nil {
+		return "", "", err
+	} else if err := c.confine(dir.Join(file)); err != nil {
+		return "", "", err
+	}
+	return dir, file, nil
+}
+
+// Exists checks whether the given path exists inside the root directory.
+func (c *confinedFileSystem) Exists(path string) bool {
+	return c.confine(path) == nil && c.FileSystem.Exists(path)
+}
+
+// Glob returns the paths matching the given pattern, failing if any of them is outside the root directory.
+func (c *confinedFileSystem) Glob(pattern string) ([]string, error) {
+	matches, err := c.FileSystem.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	for _, match := range matches {
+		if err := c.confine(match); err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}
+
+// Walk walks the file tree of the given directory, if it's inside the root directory. Symlinks are not followed.
+func (c *confinedFileSystem) Walk(path string, walkFn filepath.WalkFunc) error {
+	if err := c.confine(path); err != nil {
+		return err
+	}
+	return c.FileSystem.Walk(path, walkFn)
+}
+
+// ReadFile returns the contents of the given file, if it's inside the root directory. Kustomizations referring to
+// remote resources fail to be read.
+func (c *confinedFileSystem) ReadFile(path string) ([]byte, error) {
+	if err := c.confine(path); err != nil {
+		return nil, err
+	}
+	data, err := c.FileSystem.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range konfig.RecognizedKustomizationFileNames() {
+		if filepath.Base(path) == name {
+			if ref := findRemoteReference(data); ref != "" {
+				return nil, c.violate(fmt.Errorf("kustomization '%s' refers to remote resource '%s', which is not supported", path, ref))
+			}
+		}
+	}
+	return data, nil
+}
+
+// findRemoteReference returns the first remote file, resource or base referenced by the given kustomization, if any.
+// Kustomizations that cannot be parsed are left for kustomize to report.
+func findRemoteReference(data []byte) string {
+	var k types.Kustomization
+	if err := k.Unmarshal(data); err != nil {
+		return ""
+	}
+
+	refs := append([]string{}, k.Resources...)
+	refs = append(refs, k.Bases...)
+	refs = append(refs, k.Components...)
+	refs = append(refs, k.Crds...)
+	refs = append(refs, k.Configurations...)
+	refs = append(refs, k.Generators...)
+	refs = append(refs, k.Transformers...)
+	refs = append(refs, k.Validators...)
+	for _, patch := range k.PatchesStrategicMerge {
+		refs = append(refs, string(patch))
+	}
+	for _, patch := range append(k.Patches, k.PatchesJson6902...) {
+		refs = append(refs, patch.Path)
+	}
+	for _, ref := range refs {
+		lower := strings.ToLower(ref)
+		if strings.Contains(lower, "_git/") || strings.Contains(lower, "://") {
+			return ref
+		}
+		for _, prefix := range remoteReferencePrefixes {
+			if strings.HasPrefix(lower, prefix) {
+				return ref
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"context"
+	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+	"github.com/arikkfir/kude-controller/test/gittest"
+	"github.com/arikkfir/kude-controller/test/harness"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
+	"path/filepath"
+	"reflect"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"testing"
+	"time"
+)
+
+func TestIgnoreMissingKustomizeBundleResource(t *testing.T) {
+	reconciler := &KustomizeBundleReconciler{}
+	_, _, _ = harness.SetupTestEnv(t, reconciler)
+
+	time.Sleep(5 * time.Second) // Give manager and cache time to start; needed since we're directly invoking controller
+	res, err := reconciler.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: types.NamespacedName{
+			Namespace: "ns1",
+			Name:      "r1",
+		},
+	})
+	assert.NoErrorf(t, err, "expected reconciliation for missing resource NOT to fail")
+	assert.Falsef(t, res.Requeue, "expected reconciliation for missing resource NOT to request requeuing, got: %+v", res)
+}
+
+// createKustomizeBundleWithRepository creates a GitRepository for the given local repository, and a KustomizeBundle
+// that builds the given paths from it.
+func createKustomizeBundleWithRepository(t *testing.T, k8sClient client.Client, repository *gittest.GitRepository, paths ...string) *v1alpha1.KustomizeBundle {
+	ctx := context.Background()
+	repo := &v1alpha1.GitRepository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.GitRepository{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "repo1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.GitRepositorySpec{
+			URL:             repository.URL.String(),
+			Ref:             "refs/heads/main",
+			PollingInterval: "1s",
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, repo), "repository creation failed")
+
+	bundle := &v1alpha1.KustomizeBundle{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       reflect.TypeOf(v1alpha1.KustomizeBundle{}).Name(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bundle1",
+			Namespace: "default",
+		},
+		Spec: v1alpha1.KustomizeBundleSpec{
+			SourceRepository: repo.Namespace + "/" + repo.Name,
+			Files:            paths,
+		},
+	}
+	require.NoErrorf(t, k8sClient.Create(ctx, bundle), "bundle creation failed")
+	return bundle
+}
+
+func TestKustomizeBundleApply(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("configmap.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\ndata:\n  key: value1\n"), "failed to commit file")
+	require.NoErrorf(t, repository.CommitFile("kustomization.yaml", "namePrefix: prefix-\nresources:\n  - configmap.yaml\n"), "failed to commit file")
+	sha1, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KustomizeBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	bundle := createKustomizeBundleWithRepository(t, k8sClient, repository, ".")
+	lookupKey := types.NamespacedName{Name: bundle.Name, Namespace: bundle.Namespace}
+
+	ctx := context.Background()
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.KustomizeBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &b), "bundle lookup failed") {
+			assert.Contains(c, b.Finalizers, finalizerKustomizeBundle, "finalizer not found")
+			assert.Equal(c, sha1, b.Status.LastAppliedSHA, "incorrect last applied SHA")
+			assert.Empty(c, b.Status.Errors, "unexpected errors")
+			assert.True(c, meta.IsStatusConditionTrue(b.Status.Conditions, typeUpToDateKustomizeBundle), "bundle not up to date")
+		}
+		var cm corev1.ConfigMap
+		if assert.NoErrorf(c, k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "prefix-cm1"}, &cm), "config map lookup failed") {
+			assert.Equal(c, "value1", cm.Data["key"], "incorrect config map data")
+		}
+	}, 15*time.Second, 1*time.Second, "kustomization not applied correctly")
+
+	// A new commit should be applied as well
+	require.NoErrorf(t, repository.CommitFile("configmap.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm1\ndata:\n  key: value2\n"), "failed to commit file")
+	sha2, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.KustomizeBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &b), "bundle lookup failed") {
+			assert.Equal(c, sha2, b.Status.LastAppliedSHA, "incorrect last applied SHA")
+		}
+		var cm corev1.ConfigMap
+		if assert.NoErrorf(c, k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "prefix-cm1"}, &cm), "config map lookup failed") {
+			assert.Equal(c, "value2", cm.Data["key"], "incorrect config map data")
+		}
+	}, 15*time.Second, 1*time.Second, "new commit not applied correctly")
+}
+
+func TestKustomizeBundleBuildFailure(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("kustomization.yaml", "resources:\n  - missing.yaml\n"), "failed to commit file")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: t.TempDir()}, &KustomizeBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	bundle := createKustomizeBundleWithRepository(t, k8sClient, repository, ".")
+	lookupKey := types.NamespacedName{Name: bundle.Name, Namespace: bundle.Namespace}
+
+	ctx := context.Background()
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.KustomizeBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &b), "bundle lookup failed") {
+			assert.Empty(c, b.Status.LastAppliedSHA, "unexpected last applied SHA")
+			if assert.Len(c, b.Status.Errors, 1, "incorrect errors") {
+				assert.Contains(c, b.Status.Errors[0], "failed to build kustomization '.'", "incorrect error")
+			}
+			cUpToDate := meta.FindStatusCondition(b.Status.Conditions, typeUpToDateKustomizeBundle)
+			if assert.NotNil(c, cUpToDate, "uptodate condition not found") {
+				assert.Equal(c, metav1.ConditionFalse, cUpToDate.Status, "incorrect status")
+				assert.Equal(c, "Failed", cUpToDate.Reason, "incorrect reason")
+			}
+		}
+	}, 15*time.Second, 1*time.Second, "build failure not recorded correctly")
+}
+
+func TestKustomizeBundleConfinement(t *testing.T) {
+	if !hasGit {
+		t.Skip("git not found, skipping")
+	}
+	repository, err := gittest.NewGitRepository(t.Name())
+	require.NoErrorf(t, err, "failed to create repository")
+	defer os.RemoveAll(repository.Dir)
+	require.NoErrorf(t, repository.CommitFile("kustomization.yaml", "resources:\n  - ../outside\n"), "failed to commit file")
+	sha1, err := repository.HeadSHA()
+	require.NoErrorf(t, err, "failed to resolve HEAD")
+
+	// Kustomizations outside the repository's work directory (e.g. of other repositories) should not be accessible
+	workDir := t.TempDir()
+	require.NoErrorf(t, os.Mkdir(filepath.Join(workDir, "outside"), 0700), "failed to create directory")
+	require.NoErrorf(t, os.WriteFile(filepath.Join(workDir, "outside", "kustomization.yaml"), []byte("resources:\n  - configmap.yaml\n"), 0600), "failed to write file")
+	require.NoErrorf(t, os.WriteFile(filepath.Join(workDir, "outside", "configmap.yaml"), []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: outside\n"), 0600), "failed to write file")
+
+	k8sClient, _, _ := harness.SetupTestEnv(t, &GitRepositoryReconciler{WorkDir: workDir}, &KustomizeBundleReconciler{DefaultServiceAccount: bundleServiceAccount})
+	createBundleServiceAccount(t, k8sClient, "default")
+	bundle := createKustomizeBundleWithRepository(t, k8sClient, repository, ".")
+	lookupKey := types.NamespacedName{Name: bundle.Name, Namespace: bundle.Namespace}
+
+	ctx := context.Background()
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var repo v1alpha1.GitRepository
+		if assert.NoErrorf(c, k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "repo1"}, &repo), "repository lookup failed") {
+			assert.Equal(c, sha1, repo.Status.LastPulledSHA, "repository not pulled")
+		}
+		var b v1alpha1.KustomizeBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &b), "bundle lookup failed") {
+			assert.Empty(c, b.Status.LastAppliedSHA, "unexpected last applied SHA")
+			if assert.Len(c, b.Status.Errors, 1, "incorrect errors") {
+				assert.Contains(c, b.Status.Errors[0], "is outside the repository", "incorrect error")
+			}
+		}
+	}, 15*time.Second, 1*time.Second, "kustomization outside the repository not rejected")
+	var cm corev1.ConfigMap
+	assert.Error(t, k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "outside"}, &cm), "config map outside the repository should not be applied")
+
+	// Remote bases should not be fetched
+	require.NoErrorf(t, repository.CommitFile("kustomization.yaml", "resources:\n  - https://github.com/kubernetes-sigs/kustomize//examples/helloWorld?ref=v3.3.1\n"), "failed to commit file")
+	assert.EventuallyWithTf(t, func(c *assert.CollectT) {
+		var b v1alpha1.KustomizeBundle
+		if assert.NoErrorf(c, k8sClient.Get(ctx, lookupKey, &b), "bundle lookup failed") {
+			if assert.Len(c, b.Status.Errors, 1, "incorrect errors") {
+				assert.Contains(c, b.Status.Errors[0], "refers to remote resource 'https://github.com/kubernetes-sigs/kustomize//examples/helloWorld?ref=v3.3.1'", "incorrect error")
+			}
+		}
+	}, 15*time.Second, 1*time.Second, "remote base not rejected")
+}
@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+)
+
+const (
+	typeReadyReceiver     = "Ready"     // Is the Receiver ready to accept webhooks
+	typeSuspendedReceiver = "Suspended" // Is accepting webhooks for the Receiver suspended?
+)
+
+// ReceiverReconciler reconciles a Receiver object, and runs the webhook server accepting payloads for receivers.
+type ReceiverReconciler struct {
+	Client   client.Client             // Kubernetes API client
+	Recorder record.EventRecorder      // Kubernetes event recorder
+	Scheme   *runtime.Scheme           // Scheme registry
+	Addr     string                    // Address for the webhook server to listen on (server is disabled if empty)
+	Events   chan<- event.GenericEvent // Channel on which GitRepository objects are enqueued for reconciliation
+}
+
+//+kubebuilder:rbac:groups=kude.kfirs.com,resources=receivers,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=kude.kfirs.com,resources=receivers/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=kude.kfirs.com,resources=gitrepositories,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+
+// Reconcile continuously aims to move the current state of [Receiver] objects closer to their desired state.
+func (r *ReceiverReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var o v1alpha1.Receiver
+	if err := r.Client.Get(ctx, req.NamespacedName, &o); err != nil {
+		// we'll ignore not-found errors, since they can't be fixed by an immediate
+		// requeue (we'll need to wait for a new notification), and we can get them
+		// on deleted requests.
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// Ensure statuses have the "Unknown" value when they are missing
+	if meta.FindStatusCondition(o.Status.Conditions, typeReadyReceiver) == nil {
+		if res, err := r.setCondition(ctx, &o, typeReadyReceiver, metav1.ConditionUnknown, "Reconciling", "Initial value"); res.Requeue || err != nil {
+			return res, err
+		}
+	}
+
+	// Suspended receivers reject webhooks, so they are not ready; we'll be notified when resumed
+	if o.Spec.Suspend {
+		if !meta.IsStatusConditionTrue(o.Status.Conditions, typeSuspendedReceiver) {
+			r.Recorder.Event(&o, v1.EventTypeNormal, "Suspended", "Accepting webhooks suspended")
+		}
+		if res, err := r.setCondition(ctx, &o, typeSuspendedReceiver, metav1.ConditionTrue, "Suspended", "Accepting webhooks is suspended"); res.Requeue || err != nil {
+			return res, err
+		}
+		return r.setCondition(ctx, &o, typeReadyReceiver, metav1.ConditionFalse, "Suspended", "Accepting webhooks is suspended")
+	} else if meta.IsStatusConditionTrue(o.Status.Conditions, typeSuspendedReceiver) {
+		r.Recorder.Event(&o, v1.EventTypeNormal, "Resumed", "Accepting webhooks resumed")
+	}
+	if res, err := r.setCondition(ctx, &o, typeSuspendedReceiver, metav1.ConditionFalse, "NotSuspended", ""); res.Requeue || err != nil {
+		return res, err
+	}
+
+	// Publish the webhook path
+	if path := receiverPathPrefix + o.Namespace + "/" + o.Name; o.Status.WebhookPath != path {
+		o.Status.WebhookPath = path
+		if err := r.Client.Status().Update(ctx, &o); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to update webhook path in Receiver status: %w", err)
+		} else {
+			return ctrl.Result{Requeue: true}, nil
+		}
+	}
+
+	// Verify the secret holds a token
+	var secret v1.Secret
+	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: o.Namespace, Name: o.Spec.SecretRef.Name}, &secret); err != nil {
+		return r.setCondition(ctx, &o, typeReadyReceiver, metav1.ConditionFalse, "SecretNotFound", err.Error())
+	} else if len(secret.Data[receiverSecretKey]) == 0 {
+		return r.setCondition(ctx, &o, typeReadyReceiver, metav1.ConditionFalse, "InvalidSecret", fmt.Sprintf("Secret '%s' has no '%s' key", secret.Name, receiverSecretKey))
+	}
+
+	return r.setCondition(ctx, &o, typeReadyReceiver, metav1.ConditionTrue, "Ready", "")
+}
+
+func (r *ReceiverReconciler) setCondition(ctx context.Context, o *v1alpha1.Receiver, conditionType string, status metav1.ConditionStatus, reason, message string) (ctrl.Result, error) {
+	if c := meta.FindStatusCondition(o.Status.Conditions, conditionType); c == nil || c.Status != status || c.Reason != reason || c.Message != message {
+		meta.SetStatusCondition(&o.Status.Conditions, metav1.Condition{
+			Type:    conditionType,
+			Status:  status,
+			Reason:  reason,
+			Message: message,
+		})
+		if err := r.Client.Status().Update(ctx, o); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to set condition '%s' to '%s' with reason '%s': %w", conditionType, status, reason, err)
+		} else {
+			return ctrl.Result{Requeue: true}, nil
+		}
+	} else {
+		return ctrl.Result{}, nil
+	}
+}
+
+func (r *ReceiverReconciler) findObjectsForSecret(secret client.Object) []reconcile.Request {
+	receivers := &v1alpha1.ReceiverList{}
+	listOps := &client.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector(".spec.secretRef.name", secret.GetName()),
+		Namespace:     secret.GetNamespace(),
+	}
+	err := r.Client.List(context.TODO(), receivers, listOps)
+	if err != nil {
+		ctrl.Log.Error(err, "Failed listing receivers for Secret", "secret", secret.GetNamespace()+"/"+secret.GetName())
+		return []reconcile.Request{}
+	}
+
+	requests := make([]reconcile.Request, len(receivers.Items))
+	for i, item := range receivers.Items {
+		requests[i] = reconcile.Request{
+			NamespacedName: types.NamespacedName{
+				Name:      item.GetName(),
+				Namespace: item.GetNamespace(),
+			},
+		}
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ReceiverReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.Client = mgr.GetClient()
+	r.Scheme = mgr.GetScheme()
+	r.Recorder = mgr.GetEventRecorderFor("receiver")
+
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &v1alpha1.Receiver{}, ".spec.secretRef.name", func(rawObj client.Object) []string {
+		receiver := rawObj.(*v1alpha1.Receiver)
+		if receiver.Spec.SecretRef.Name == "" {
+			return nil
+		}
+		return []string{receiver.Spec.SecretRef.Name}
+	}); err != nil {
+		return fmt.Errorf("failed to create index for secret-ref: %w", err)
+	}
+
+	if r.Addr != "" {
+		if err := mgr.Add(newReceiverServer(r.Addr, r.Client, r.Events)); err != nil {
+			return fmt.Errorf("failed to add webhook receiver server: %w", err)
+		}
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1alpha1.Receiver{}).
+		Watches(
+			&source.Kind{Type: &v1.Secret{}},
+			handler.EnqueueRequestsFromMapFunc(r.findObjectsForSecret),
+		).
+		Complete(r)
+}
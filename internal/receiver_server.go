@@ -0,0 +1,396 @@
+package internal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-logr/logr"
+	"hash"
+	"io"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net"
+	"net/http"
+	"net/url"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"strings"
+	"time"
+
+	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+)
+
+const (
+	receiverPathPrefix   = "/hook/"
+	receiverSecretKey    = "token"
+	receiverMaxBodyBytes = 1 << 20
+
+	receiverTypeGitHub    = "github"
+	receiverTypeGitLab    = "gitlab"
+	receiverTypeBitbucket = "bitbucket"
+	receiverTypeGeneric   = "generic"
+)
+
+var errInvalidSignature = errors.New("invalid signature")
+
+// pushEvent is the normalized form of a Git push notification.
+type pushEvent struct {
+	URLs []string // Repository URLs (clone, SSH, web...) as reported by the sender
+	Ref  string   // Full reference name that was pushed (e.g. "refs/heads/main"); empty if unknown
+}
+
+// receiverServer is an HTTP server accepting webhook payloads for Receiver objects, and triggering reconciliation of
+// matching GitRepository objects.
+type receiverServer struct {
+	Addr   string                     // Address to listen on
+	Client client.Client              // Kubernetes API client
+	Events chan<- event.GenericEvent  // Channel on which matching GitRepository objects are enqueued
+	Log    logr.Logger                // Logger
+	server *http.Server               // Underlying HTTP server
+	hooks  map[string]receiverHandler // Payload handlers by receiver type
+}
+
+// receiverHandler validates and parses a webhook request of a specific receiver type. A nil event (with no error)
+// signals a valid request that should not trigger anything (e.g. a "ping" event).
+type receiverHandler func(r *http.Request, body []byte, token []byte) (*pushEvent, error)
+
+// Start runs the HTTP server until the given context is cancelled.
+func (s *receiverServer) Start(ctx context.Context) error {
+	s.hooks = map[string]receiverHandler{
+		receiverTypeGitHub:    parseGitHubPush,
+		receiverTypeGitLab:    parseGitLabPush,
+		receiverTypeBitbucket: parseBitbucketPush,
+		receiverTypeGeneric:   parseGenericPush,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(receiverPathPrefix, s.handle)
+	s.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on '%s': %w", s.Addr, err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := s.server.Shutdown(shutdownCtx); err != nil {
+			s.Log.Error(err, "Failed shutting down webhook receiver server")
+		}
+	}()
+
+	s.Log.Info("Starting webhook receiver server", "addr", ln.Addr().String())
+	if err := s.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("webhook receiver server failed: %w", err)
+	}
+	return nil
+}
+
+func (s *receiverServer) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Resolve the receiver from the path: /hook/<namespace>/<name>
+	namespace, name, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, receiverPathPrefix), "/")
+	if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	log := s.Log.WithValues("receiver", namespace+"/"+name)
+
+	ctx := r.Context()
+	var receiver v1alpha1.Receiver
+	if err := s.Client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, &receiver); err != nil {
+		if client.IgnoreNotFound(err) == nil {
+			http.NotFound(w, r)
+		} else {
+			log.Error(err, "Failed to get receiver")
+			http.Error(w, "internal error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	hook, ok := s.hooks[receiver.Spec.Type]
+	if !ok {
+		http.Error(w, "unsupported receiver type", http.StatusBadRequest)
+		return
+	}
+
+	var secret v1.Secret
+	if err := s.Client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: receiver.Spec.SecretRef.Name}, &secret); err != nil {
+		log.Error(err, "Failed to get receiver secret")
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	token := secret.Data[receiverSecretKey]
+	if len(token) == 0 {
+		log.Info("Receiver secret has no token", "secret", secret.Name)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, receiverMaxBodyBytes))
+	if err != nil {
+		http.Error(w, "failed reading body", http.StatusBadRequest)
+		return
+	}
+
+	push, err := hook(r, body, token)
+	if errors.Is(err, errInvalidSignature) {
+		log.Info("Rejected webhook with invalid signature")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if push == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if receiver.Spec.Suspend {
+		log.Info("Rejected webhook of suspended receiver")
+		http.Error(w, "receiver is suspended", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Enqueue matching repositories
+	var repositories v1alpha1.GitRepositoryList
+	if err := s.Client.List(ctx, &repositories, client.InNamespace(namespace)); err != nil {
+		log.Error(err, "Failed to list Git repositories")
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	matched := 0
+	for i := range repositories.Items {
+		repository := &repositories.Items[i]
+		if push.matches(repository) {
+			log.Info("Triggering GitRepository reconciliation", "gitRepository", repository.Namespace+"/"+repository.Name, "ref", push.Ref)
+			select {
+			case s.Events <- event.GenericEvent{Object: repository}:
+				matched++
+			case <-ctx.Done():
+				http.Error(w, "request cancelled", http.StatusServiceUnavailable)
+				return
+			}
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = fmt.Fprintf(w, "triggered %d repositories\n", matched)
+}
+
+// matches checks whether the given GitRepository tracks the repository & reference this push event refers to.
+func (e *pushEvent) matches(repository *v1alpha1.GitRepository) bool {
+	urlMatched := false
+	repositoryURL := normalizeGitURL(repository.Spec.URL)
+	for _, u := range e.URLs {
+		if u != "" && normalizeGitURL(u) == repositoryURL {
+			urlMatched = true
+			break
+		}
+	}
+	if !urlMatched {
+		return false
+	} else if e.Ref == "" {
+		return true
+	} else if repository.Spec.Tag != "" {
+		return strings.HasPrefix(e.Ref, refTagsPrefix)
+	} else if repository.Spec.Ref == "" {
+		// Repository tracks the default branch, which push payloads do not always identify
+		return strings.HasPrefix(e.Ref, refHeadsPrefix)
+	} else {
+		return repository.Spec.Ref == e.Ref
+	}
+}
+
+// normalizeGitURL reduces the given Git URL (HTTP(S), SSH, or SCP-like) to a "host/path" form, so that different URLs
+// of the same repository compare as equal: the scheme, user info, default ports & ".git" suffix are removed, and the
+// result is lower-cased (e.g. "git@GitHub.com:org/Repo.git" and "https://github.com/org/repo" are both reduced to
+// "github.com/org/repo").
+func normalizeGitURL(rawURL string) string {
+	s := strings.TrimSpace(rawURL)
+	if !strings.Contains(s, "://") {
+		// SCP-like syntax: [user@]host:path
+		if at := strings.Index(s, "@"); at >= 0 {
+			s = s[at+1:]
+		}
+		s = "ssh://" + strings.Replace(s, ":", "/", 1)
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return strings.ToLower(strings.TrimSuffix(strings.TrimSuffix(rawURL, "/"), ".git"))
+	}
+	host := u.Hostname()
+	switch port := u.Port(); port {
+	case "", "22", "80", "443", "9418":
+	default:
+		// Non-default ports may be of different servers on the same host
+		host += ":" + port
+	}
+	path := strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), ".git")
+	return strings.ToLower(host + "/" + strings.TrimPrefix(path, "/"))
+}
+
+// verifyHMAC verifies that the given signature (in "<algorithm>=<hex digest>" format) matches the HMAC of the body.
+func verifyHMAC(signature string, body, token []byte) error {
+	algorithm, digest, ok := strings.Cut(signature, "=")
+	if !ok {
+		return errInvalidSignature
+	}
+	var h func() hash.Hash
+	switch algorithm {
+	case "sha256":
+		h = sha256.New
+	case "sha1":
+		h = sha1.New
+	default:
+		return errInvalidSignature
+	}
+	expected, err := hex.DecodeString(digest)
+	if err != nil {
+		return errInvalidSignature
+	}
+	mac := hmac.New(h, token)
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+func parseGitHubPush(r *http.Request, body, token []byte) (*pushEvent, error) {
+	signature := r.Header.Get("X-Hub-Signature-256")
+	if signature == "" {
+		signature = r.Header.Get("X-Hub-Signature")
+	}
+	if err := verifyHMAC(signature, body, token); err != nil {
+		return nil, err
+	}
+
+	switch r.Header.Get("X-GitHub-Event") {
+	case "ping":
+		return nil, nil
+	case "push":
+	default:
+		return nil, fmt.Errorf("unsupported GitHub event '%s'", r.Header.Get("X-GitHub-Event"))
+	}
+
+	var payload struct {
+		Ref        string `json:"ref"`
+		Repository struct {
+			CloneURL string `json:"clone_url"`
+			SSHURL   string `json:"ssh_url"`
+			GitURL   string `json:"git_url"`
+			HTMLURL  string `json:"html_url"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid GitHub payload: %w", err)
+	}
+	repo := payload.Repository
+	return &pushEvent{URLs: []string{repo.CloneURL, repo.SSHURL, repo.GitURL, repo.HTMLURL}, Ref: payload.Ref}, nil
+}
+
+func parseGitLabPush(r *http.Request, body, token []byte) (*pushEvent, error) {
+	// GitLab does not sign payloads; it sends the shared secret as-is
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), token) != 1 {
+		return nil, errInvalidSignature
+	}
+
+	switch r.Header.Get("X-Gitlab-Event") {
+	case "Push Hook", "Tag Push Hook":
+	default:
+		return nil, fmt.Errorf("unsupported GitLab event '%s'", r.Header.Get("X-Gitlab-Event"))
+	}
+
+	var payload struct {
+		Ref     string `json:"ref"`
+		Project struct {
+			HTTPURL string `json:"git_http_url"`
+			SSHURL  string `json:"git_ssh_url"`
+			WebURL  string `json:"web_url"`
+		} `json:"project"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid GitLab payload: %w", err)
+	}
+	project := payload.Project
+	return &pushEvent{URLs: []string{project.HTTPURL, project.SSHURL, project.WebURL}, Ref: payload.Ref}, nil
+}
+
+func parseBitbucketPush(r *http.Request, body, token []byte) (*pushEvent, error) {
+	if err := verifyHMAC(r.Header.Get("X-Hub-Signature"), body, token); err != nil {
+		return nil, err
+	}
+
+	switch r.Header.Get("X-Event-Key") {
+	case "diagnostics:ping":
+		return nil, nil
+	case "repo:refs_changed":
+	default:
+		return nil, fmt.Errorf("unsupported Bitbucket event '%s'", r.Header.Get("X-Event-Key"))
+	}
+
+	var payload struct {
+		Changes []struct {
+			Ref struct {
+				ID string `json:"id"`
+			} `json:"ref"`
+		} `json:"changes"`
+		Repository struct {
+			Links struct {
+				Clone []struct {
+					Href string `json:"href"`
+				} `json:"clone"`
+			} `json:"links"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid Bitbucket payload: %w", err)
+	}
+	e := &pushEvent{}
+	for _, link := range payload.Repository.Links.Clone {
+		e.URLs = append(e.URLs, link.Href)
+	}
+	if len(payload.Changes) == 1 {
+		// When multiple refs changed, leave the ref empty so that all refs of the repository are considered matching
+		e.Ref = payload.Changes[0].Ref.ID
+	}
+	return e, nil
+}
+
+func parseGenericPush(r *http.Request, body, token []byte) (*pushEvent, error) {
+	if err := verifyHMAC(r.Header.Get("X-Signature"), body, token); err != nil {
+		return nil, err
+	}
+
+	var payload struct {
+		URL string `json:"url"`
+		Ref string `json:"ref"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid payload: %w", err)
+	} else if payload.URL == "" {
+		return nil, errors.New("invalid payload: missing 'url'")
+	}
+	return &pushEvent{URLs: []string{payload.URL}, Ref: payload.Ref}, nil
+}
+
+// newReceiverServer creates a new webhook receiver server.
+func newReceiverServer(addr string, c client.Client, events chan<- event.GenericEvent) *receiverServer {
+	return &receiverServer{
+		Addr:   addr,
+		Client: c,
+		Events: events,
+		Log:    ctrl.Log.WithName("receiver"),
+	}
+}
@@ -0,0 +1,16 @@
+package internal
+
+import (
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	annotationReconcileRequestedAt = "kude.kfirs.com/reconcile-requested-at" // Annotation requesting an immediate reconciliation
+)
+
+// reconcileRequestedAt returns the token (typically a timestamp) of the reconciliation last requested for the given
+// object via its "kude.kfirs.com/reconcile-requested-at" annotation, or an empty string if none was requested. A token
+// that differs from the one recorded in the object's status forces an immediate fetch or re-apply.
+func reconcileRequestedAt(o client.Object) string {
+	return o.GetAnnotations()[annotationReconcileRequestedAt]
+}
@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"regexp"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
+)
+
+const (
+	reasonSubstitutionFailed  = "SubstitutionFailed"                                                  // Reason of bundles whose variables cannot be resolved
+	redactedSubstitutionError = "error redacted, since it contains a value substituted from a Secret" // Error reported instead of errors disclosing Secret variables
+)
+
+// substitutionPattern matches "${VAR}" placeholders, optionally with a default value (e.g. "${VAR:=default}"), as well
+// as escaped placeholders (e.g. "$${VAR}").
+var substitutionPattern = regexp.MustCompile(`\$(\$?)\{([A-Za-z_][A-Za-z0-9_]*)(?:(:?[=-])([^}]*))?}`)
+
+// substitution substitutes variable placeholders in manifests, recording the variables that were used.
+type substitution struct {
+	variables map[string]string // Values of variables, by name
+	secret    map[string]bool   // Variables whose values come from Secrets, which are never reported
+	strict    bool              // Fail on placeholders of undefined variables that have no default
+	used      map[string]bool   // Variables substituted so far
+}
+
+// newSubstitution creates a substitution of the given variables (of which the given secret variables come from
+// Secrets), or returns nil when no variables are given (as opposed to an empty set of variables), leaving placeholders
+// as-is.
+func newSubstitution(variables map[string]string, secret map[string]bool, strict bool) *substitution {
+	if variables == nil {
+		return nil
+	}
+	return &substitution{variables: variables, secret: secret, strict: strict, used: make(map[string]bool)}
+}
+
+// apply replaces the variable placeholders in the given data. Placeholders of undefined variables are replaced by
+// their default value if they have one, or by an empty string otherwise (or fail in strict mode). Placeholders with a
+// ":=" or ":-" default also use the default when the variable is empty.
+func (s *substitution) apply(data []byte) ([]byte, error) {
+	var missing []string
+	result := substitutionPattern.ReplaceAllFunc(data, func(match []byte) []byte {
+		groups := substitutionPattern.FindSubmatch(match)
+		if len(groups[1]) > 0 {
+			return match[1:]
+		}
+
+		name, operator, defaultValue := string(groups[2]), string(groups[3]), groups[4]
+		value, ok := s.variables[name]
+		if ok && (value != "" || !strings.HasPrefix(operator, ":")) {
+			s.used[name] = true
+			return []byte(value)
+		} else if operator != "" {
+			return defaultValue
+		} else if s.strict {
+			missing = append(missing, name)
+		}
+		return nil
+	})
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("undefined variables: %s", strings.Join(missing, ", "))
+	}
+	return result, nil
+}
+
+// usedVariables returns the names of the variables substituted so far, sorted.
+func (s *substitution) usedVariables() []string {
+	if s == nil {
+		return nil
+	}
+	var names []string
+	for name := range s.used {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// redact masks the diffed values & the errors of the given results that contain the value of a substituted secret
+// variable, since these are otherwise reported as-is.
+func (s *substitution) redact(results []v1alpha1.ObjectResult) {
+	if s == nil {
+		return
+	}
+	var values []string
+	for name := range s.used {
+		if value := s.variables[name]; s.secret[name] && value != "" {
+			// Values are reported either as-is (in errors) or JSON-encoded (in diffs)
+			encoded := jsonValue(value)
+			values = append(values, value, encoded[1:len(encoded)-1])
+		}
+	}
+	if len(values) == 0 {
+		return
+	}
+
+	discloses := func(text string) bool {
+		for _, value := range values {
+			if strings.Contains(text, value) {
+				return true
+			}
+		}
+		return false
+	}
+	for i := range results {
+		if discloses(results[i].Error) {
+			results[i].Error = redactedSubstitutionError
+		}
+		for j := range results[i].Diff {
+			if discloses(results[i].Diff[j].Live) {
+				results[i].Diff[j].Live = jsonValue(maskedValue)
+			}
+			if discloses(results[i].Diff[j].Desired) {
+				results[i].Diff[j].Desired = jsonValue(maskedValue)
+			}
+		}
+	}
+}
+
+// resolveSubstitutions returns the variables to substitute in the files of the given bundle: the data of its
+// "substituteFrom" ConfigMaps & Secrets (in order), overridden by its "substitute" variables. It also returns the
+// variables whose values come from Secrets. When the bundle does not substitute variables, nil is returned.
+func resolveSubstitutions(ctx context.Context, c client.Reader, o *v1alpha1.KubectlBundle) (map[string]string, map[string]bool, error) {
+	if o.Spec.Substitute == nil && o.Spec.SubstituteFrom == nil {
+		return nil, nil, nil
+	}
+
+	variables := make(map[string]string)
+	secret := make(map[string]bool)
+	for _, ref := range o.Spec.SubstituteFrom {
+		key := types.NamespacedName{Namespace: o.Namespace, Name: ref.Name}
+		switch ref.Kind {
+		case "ConfigMap":
+			var cm v1.ConfigMap
+			if err := c.Get(ctx, key, &cm); apierrors.IsNotFound(err) && ref.Optional {
+				continue
+			} else if err != nil {
+				return nil, nil, fmt.Errorf("failed to get config map '%s': %w", key, err)
+			}
+			for name, value := range cm.Data {
+				variables[name] = value
+				delete(secret, name)
+			}
+		case "Secret":
+			var s v1.Secret
+			if err := c.Get(ctx, key, &s); apierrors.IsNotFound(err) && ref.Optional {
+				continue
+			} else if err != nil {
+				return nil, nil, fmt.Errorf("failed to get secret '%s': %w", key, err)
+			}
+			for name, value := range s.Data {
+				variables[name] = string(value)
+				secret[name] = true
+			}
+		default:
+			return nil, nil, fmt.Errorf("unsupported substitution source kind '%s'", ref.Kind)
+		}
+	}
+	for name, value := range o.Spec.Substitute {
+		variables[name] = value
+		delete(secret, name)
+	}
+	return variables, secret, nil
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSubstitution(t *testing.T) {
+	s := newSubstitution(map[string]string{"NAME": "cm1", "EMPTY": ""}, nil, false)
+	result, err := s.apply([]byte("name: ${NAME}\nregion: ${REGION:=us-east1}\nempty: ${EMPTY:-fallback}\nkept: ${EMPTY-fallback}\nmissing: '${MISSING}'\nescaped: $${NAME}\nshell: $NAME\n"))
+	require.NoError(t, err, "substitution failed")
+	assert.Equal(t, "name: cm1\nregion: us-east1\nempty: fallback\nkept: \nmissing: ''\nescaped: ${NAME}\nshell: $NAME\n", string(result), "incorrect result")
+	assert.Equal(t, []string{"EMPTY", "NAME"}, s.usedVariables(), "incorrect used variables")
+}
+
+func TestSubstitutionStrict(t *testing.T) {
+	s := newSubstitution(map[string]string{"NAME": "cm1"}, nil, true)
+	_, err := s.apply([]byte("name: ${NAME}\nregion: ${REGION:=us-east1}\nzone: ${ZONE}\ncluster: ${CLUSTER}\n"))
+	assert.EqualError(t, err, "undefined variables: ZONE, CLUSTER", "incorrect error")
+}
+
+func TestSubstitutionDisabled(t *testing.T) {
+	s := newSubstitution(nil, nil, true)
+	assert.Nil(t, s, "substitution should be disabled without variables")
+	assert.Nil(t, s.usedVariables(), "no variables should be used")
+}
+
+func TestSubstitutionRedact(t *testing.T) {
+	s := newSubstitution(map[string]string{"NAME": "cm1", "PASSWORD": "s3cr3t\"", "UNUSED": "value1"}, map[string]bool{"PASSWORD": true, "UNUSED": true}, false)
+	_, err := s.apply([]byte("name: ${NAME}\npassword: ${PASSWORD}\n"))
+	require.NoError(t, err, "substitution failed")
+
+	results := []v1alpha1.ObjectResult{
+		{Kind: "ConfigMap", Name: "cm1", Action: applyActionFailed, Error: "invalid value: s3cr3t\""},
+		{Kind: "ConfigMap", Name: "cm2", Action: applyActionConfigured, Diff: []v1alpha1.FieldDiff{
+			{Path: ".data.password", Live: `"old"`, Desired: `"s3cr3t\""`},
+			{Path: ".data.name", Live: `"old"`, Desired: `"cm1"`},
+			{Path: ".data.other", Live: `"value0"`, Desired: `"value1"`},
+		}},
+	}
+	s.redact(results)
+	assert.Equal(t, redactedSubstitutionError, results[0].Error, "error containing a secret value should be redacted")
+	assert.Equal(t, []v1alpha1.FieldDiff{
+		{Path: ".data.password", Live: `"old"`, Desired: `"***"`},
+		{Path: ".data.name", Live: `"old"`, Desired: `"cm1"`},
+		{Path: ".data.other", Live: `"value0"`, Desired: `"value1"`},
+	}, results[1].Diff, "only values containing used secret values should be masked")
+}
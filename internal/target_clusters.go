@@ -0,0 +1,287 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/arikkfir/kude-controller/internal/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"sync"
+	"time"
+)
+
+const (
+	kubeConfigIndexKey      = ".spec.kubeConfig.secretRef" // Index of bundles by the name of their kubeconfig Secret
+	reasonTargetUnreachable = "TargetUnreachable"          // Reason of bundles whose target cluster cannot be reached
+	defaultKubeConfigKey    = "value"                      // Default key of kubeconfigs in their Secret
+	targetClusterTimeout    = 30 * time.Second             // Timeout of requests to target clusters
+)
+
+// errKubeConfigNotFound is returned when targeting a cluster whose kubeconfig Secret is missing.
+var errKubeConfigNotFound = errors.New("kubeconfig not found")
+
+// kubeConfigKey returns the key of the given kubeconfig in its Secret.
+func kubeConfigKey(ref *v1alpha1.KubeConfigReference) string {
+	if ref.Key != "" {
+		return ref.Key
+	}
+	return defaultKubeConfigKey
+}
+
+// getBundleKubeConfig returns the kubeconfig reference of the given bundle, if any.
+func getBundleKubeConfig(o client.Object) *v1alpha1.KubeConfigReference {
+	switch b := o.(type) {
+	case *v1alpha1.KubectlBundle:
+		return b.Spec.KubeConfig
+	case *v1alpha1.KustomizeBundle:
+		return b.Spec.KubeConfig
+	case *v1alpha1.HelmBundle:
+		return b.Spec.KubeConfig
+	case *v1alpha1.KudeBundle:
+		return b.Spec.KubeConfig
+	default:
+		return nil
+	}
+}
+
+// targetCluster is a remote cluster that bundles are applied to.
+type targetCluster struct {
+	checksum  string                           // Checksum of the kubeconfig the cluster's client was created from
+	config    *rest.Config                     // REST config of the cluster
+	client    client.Client                    // Client of the cluster
+	discovery discovery.ServerVersionInterface // Discovery client used for verifying that the cluster is reachable
+}
+
+// impersonation is a client of a target cluster, acting as a service account.
+type impersonation struct {
+	target *rest.Config  // REST config of the target cluster the client was created for
+	uid    types.UID     // UID of the impersonated service account
+	config *rest.Config  // REST config acting as the service account
+	client client.Client // Client acting as the service account
+}
+
+// targetClusters caches the clients of remote clusters that bundles are applied to, by the Secret holding their
+// kubeconfig, as well as the clients impersonating service accounts of these clusters (and of the local cluster).
+// Clients are re-created whenever the kubeconfig changes.
+type targetClusters struct {
+	lock                  sync.Mutex                // Guards clusters & impersonations
+	clusters              map[string]*targetCluster // Cached clusters, by kubeconfig Secret namespace, name & key
+	impersonations        map[string]*impersonation // Cached impersonating clients, by target cluster, namespace & service account
+	defaultServiceAccount string                    // Service account to impersonate for local bundles not specifying one
+}
+
+// newTargetClusters creates a new, empty, cache of target clusters, impersonating the given service account for bundles
+// applied to the local cluster without specifying one.
+func newTargetClusters(defaultServiceAccount string) *targetClusters {
+	return &targetClusters{
+		clusters:              make(map[string]*targetCluster),
+		impersonations:        make(map[string]*impersonation),
+		defaultServiceAccount: defaultServiceAccount,
+	}
+}
+
+// targetKey returns the cache key of the cluster targeted by the given kubeconfig reference (in the given namespace),
+// which is empty for the cluster the controller runs in.
+func targetKey(namespace string, ref *v1alpha1.KubeConfigReference) string {
+	if ref == nil {
+		return ""
+	}
+	return namespace + "/" + ref.SecretRef.Name + "/" + kubeConfigKey(ref)
+}
+
+// get returns the REST config & client of the remote cluster whose kubeconfig is referenced by the given reference (in
+// the given namespace), after verifying that the cluster is reachable. When no reference is given, the given config &
+// client are returned as-is, targeting the cluster the controller runs in.
+func (t *targetClusters) get(ctx context.Context, c client.Client, config *rest.Config, namespace string, ref *v1alpha1.KubeConfigReference) (*rest.Config, client.Client, error) {
+	if ref == nil {
+		return config, c, nil
+	}
+
+	key := kubeConfigKey(ref)
+	var secret v1.Secret
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: ref.SecretRef.Name}, &secret); apierrors.IsNotFound(err) {
+		return nil, nil, fmt.Errorf("%w: '%s/%s'", errKubeConfigNotFound, namespace, ref.SecretRef.Name)
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("failed to get kubeconfig secret '%s/%s': %w", namespace, ref.SecretRef.Name, err)
+	}
+	data, ok := secret.Data[key]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: key '%s' missing in secret '%s/%s'", errKubeConfigNotFound, key, namespace, ref.SecretRef.Name)
+	}
+	checksum := sha256.Sum256(data)
+
+	cluster, err := t.cluster(targetKey(namespace, ref), hex.EncodeToString(checksum[:]), data, c)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create client from kubeconfig secret '%s/%s': %w", namespace, ref.SecretRef.Name, err)
+	}
+	if _, err := cluster.discovery.ServerVersion(); err != nil {
+		return nil, nil, fmt.Errorf("failed to reach cluster at '%s': %w", cluster.config.Host, err)
+	}
+	return cluster.config, cluster.client, nil
+}
+
+// cluster returns the cached cluster with the given key, (re)creating it from the given kubeconfig if it's missing or
+// was created from a different kubeconfig.
+func (t *targetClusters) cluster(key, checksum string, kubeConfig []byte, c client.Client) (*targetCluster, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if cluster, ok := t.clusters[key]; ok && cluster.checksum == checksum {
+		return cluster, nil
+	}
+
+	config, err := clientcmd.RESTConfigFromKubeConfig(kubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse kubeconfig: %w", err)
+	}
+	if config.Timeout == 0 {
+		config.Timeout = targetClusterTimeout
+	}
+	mapper, err := apiutil.NewDynamicRESTMapper(config, apiutil.WithLazyDiscovery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create REST mapper: %w", err)
+	}
+	targetClient, err := client.New(config, client.Options{Scheme: c.Scheme(), Mapper: mapper})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create discovery client: %w", err)
+	}
+
+	cluster := &targetCluster{checksum: checksum, config: config, client: targetClient, discovery: discoveryClient}
+	t.clusters[key] = cluster
+	return cluster, nil
+}
+
+// connect returns the REST config & client for applying a bundle in the given namespace: targeting the remote cluster
+// of the given kubeconfig reference (or the cluster the controller runs in), and acting as the given service account.
+// Bundles applied to the cluster the controller runs in never act as the controller itself: when no service account is
+// given, the default service account is impersonated. Bundles applied to remote clusters act as the kubeconfig's user
+// unless a service account is given. On failure, the condition reason to report is returned as well.
+func (t *targetClusters) connect(ctx context.Context, c client.Client, config *rest.Config, namespace string, kubeConfig *v1alpha1.KubeConfigReference, serviceAccountName string) (*rest.Config, client.Client, string, error) {
+	if serviceAccountName == "" && kubeConfig == nil {
+		if t.defaultServiceAccount == "" {
+			return nil, nil, reasonImpersonationFailed, errNoServiceAccount
+		}
+		serviceAccountName = t.defaultServiceAccount
+	}
+	targetConfig, targetClient, err := t.get(ctx, c, config, namespace, kubeConfig)
+	if err != nil {
+		return nil, nil, reasonTargetUnreachable, err
+	} else if serviceAccountName == "" {
+		return targetConfig, targetClient, "", nil
+	}
+	impersonatingConfig, impersonatingClient, err := t.impersonate(ctx, targetClient, targetConfig, targetKey(namespace, kubeConfig), namespace, serviceAccountName)
+	if err != nil {
+		return nil, nil, reasonImpersonationFailed, err
+	}
+	return impersonatingConfig, impersonatingClient, "", nil
+}
+
+// impersonate returns the REST config & client acting as the given service account (in the given namespace) of the
+// given target cluster, identified by the given key, after verifying that it can be impersonated. These are cached
+// until the target cluster's config changes, or the service account is deleted (or re-created) or can no longer be
+// impersonated.
+func (t *targetClusters) impersonate(ctx context.Context, c client.Client, config *rest.Config, target, namespace, serviceAccountName string) (*rest.Config, client.Client, error) {
+	key := target + "/" + namespace + "/" + serviceAccountName
+	sa, err := getServiceAccount(ctx, c, namespace, serviceAccountName)
+	if err != nil {
+		if errors.Is(err, errServiceAccountNotFound) {
+			t.forget(key)
+		}
+		return nil, nil, err
+	}
+
+	t.lock.Lock()
+	cached, ok := t.impersonations[key]
+	t.lock.Unlock()
+	if !ok || cached.target != config || cached.uid != sa.UID {
+		impersonatingConfig, impersonatingClient, err := impersonate(c, config, namespace, serviceAccountName)
+		if err != nil {
+			return nil, nil, err
+		}
+		cached = &impersonation{target: config, uid: sa.UID, config: impersonatingConfig, client: impersonatingClient}
+		t.lock.Lock()
+		t.impersonations[key] = cached
+		t.lock.Unlock()
+	}
+
+	if err := verifyImpersonation(ctx, cached.client, namespace, serviceAccountName); err != nil {
+		t.forget(key)
+		return nil, nil, err
+	}
+	return cached.config, cached.client, nil
+}
+
+// forget removes the cached impersonating client with the given key, if any.
+func (t *targetClusters) forget(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.impersonations, key)
+}
+
+// isTargetMissing checks whether the given error of connecting to a bundle's target indicates that the target no longer
+// exists (e.g. when the bundle's namespace is being deleted), rather than being temporarily unavailable.
+func isTargetMissing(err error) bool {
+	return errors.Is(err, errKubeConfigNotFound) || errors.Is(err, errServiceAccountNotFound) || errors.Is(err, errNoServiceAccount)
+}
+
+// indexKubeConfigs indexes bundles of the given kind by the name of their kubeconfig Secret.
+func indexKubeConfigs(mgr ctrl.Manager, kind string) error {
+	o, err := newBundle(kind)
+	if err != nil {
+		return err
+	}
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), o, kubeConfigIndexKey, func(rawObj client.Object) []string {
+		if ref := getBundleKubeConfig(rawObj); ref != nil && ref.SecretRef.Name != "" {
+			return []string{ref.SecretRef.Name}
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to create index for kubeconfig secret: %w", err)
+	}
+	return nil
+}
+
+// watchKubeConfigs makes the given controller reconcile bundles (of the given list type) whenever their kubeconfig
+// Secret changes, e.g. when it's created or its credentials are rotated.
+func watchKubeConfigs(b *builder.Builder, c client.Client, list client.ObjectList) *builder.Builder {
+	return b.Watches(&source.Kind{Type: &v1.Secret{}}, handler.EnqueueRequestsFromMapFunc(func(secret client.Object) []reconcile.Request {
+		bundles := list.DeepCopyObject().(client.ObjectList)
+		if err := c.List(context.TODO(), bundles, client.InNamespace(secret.GetNamespace()), client.MatchingFields{kubeConfigIndexKey: secret.GetName()}); err != nil {
+			ctrl.Log.Error(err, "Failed listing bundles for kubeconfig Secret", "secret", secret.GetNamespace()+"/"+secret.GetName())
+			return []reconcile.Request{}
+		}
+
+		var requests []reconcile.Request
+		_ = meta.EachListItem(bundles, func(item runtime.Object) error {
+			bundle := item.(client.Object)
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{
+					Name:      bundle.GetName(),
+					Namespace: bundle.GetNamespace(),
+				},
+			})
+			return nil
+		})
+		return requests
+	}))
+}
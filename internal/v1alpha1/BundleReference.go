@@ -0,0 +1,13 @@
+package v1alpha1
+
+// BundleReference refers to a bundle of any kind (e.g. a KubectlBundle or a HelmBundle).
+type BundleReference struct {
+	// +kubebuilder:validation:Enum=KubectlBundle;KustomizeBundle;HelmBundle;KudeBundle
+	// Kind of the bundle (defaults to the kind of the referring bundle)
+	Kind string `json:"kind,omitempty"`
+
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Pattern=`^[^/]+/[^/]+$`
+	// Bundle namespace & name, in "namespace/name" format
+	Name string `json:"name"`
+}
@@ -1,9 +1,23 @@
 package v1alpha1
 
 import (
+	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// CommandRunJob configures running commands in Kubernetes Jobs instead of inside the kude-controller process.
+type CommandRunJob struct {
+	// Image providing the "kubectl" binary (defaults to "bitnami/kubectl:1.25")
+	Image string `json:"image,omitempty"`
+
+	// Service account the Job runs as; it must be allowed to apply the bundle's objects (defaults to the namespace's
+	// default service account)
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	// Compute resources of the Job's containers
+	Resources v1.ResourceRequirements `json:"resources,omitempty"`
+}
+
 // CommandRunSpec defines the specification of the run
 type CommandRunSpec struct {
 	// The commit SHA this command runs for
@@ -12,16 +26,78 @@ type CommandRunSpec struct {
 	// Local directory in the kude-controller pod where the command is executed
 	Directory string `json:"directory"`
 
-	// Executable (e.g. "kubectl")
+	// Command executed (e.g. "apply", or "dry-run" & "diff" when previewing a bundle)
 	Command string `json:"command"`
 
-	// Arguments passed to the command
+	// Arguments passed to the command (e.g. the files to apply)
 	Args []string `json:"args"`
+
+	// Digest of the contents of the files the command runs for (and of the variables substituted in them); commits
+	// whose files yield the same digest are not run again
+	FilesDigest string `json:"filesDigest,omitempty"`
+
+	// URL of the Git repository to fetch the commit from, when running in a Job
+	RepositoryURL string `json:"repositoryURL,omitempty"`
+
+	// Secret holding the Git repository credentials, when running in a Job; it must reside in the run's namespace
+	RepositorySecretRef *v1.LocalObjectReference `json:"repositorySecretRef,omitempty"`
+
+	// Kubeconfig of the remote cluster the command targets, when running in a Job; its Secret must reside in the run's
+	// namespace
+	KubeConfig *KubeConfigReference `json:"kubeConfig,omitempty"`
+
+	// Run the command in a Kubernetes Job instead of inside the kude-controller process
+	Job *CommandRunJob `json:"job,omitempty"`
+
+	// Maximum duration of the command; it's terminated & the run is marked as timed out once exceeded
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+
+	// +kubebuilder:validation:Minimum=0
+	// Delete the run this many seconds after it finished; the latest run of its owner is always retained
+	TTLSecondsAfterFinished *int32 `json:"ttlSecondsAfterFinished,omitempty"`
+}
+
+// ObjectResult describes the outcome of applying a single object to the cluster.
+type ObjectResult struct {
+	// API version of the object
+	APIVersion string `json:"apiVersion"`
+
+	// Kind of the object
+	Kind string `json:"kind"`
+
+	// Namespace of the object (empty for cluster-scoped objects)
+	Namespace string `json:"namespace,omitempty"`
+
+	// Name of the object
+	Name string `json:"name"`
+
+	// +kubebuilder:validation:Enum=created;configured;unchanged;pruned;failed
+	// Action taken for the object
+	Action string `json:"action"`
+
+	// Error message, if applying the object failed
+	Error string `json:"error,omitempty"`
+
+	// Changes to the object's fields, when previewing a bundle in "Diff" mode
+	Diff []FieldDiff `json:"diff,omitempty"`
+}
+
+// FieldDiff describes the change to a single field of an object.
+type FieldDiff struct {
+	// Path of the field (e.g. ".spec.replicas" or ".metadata.labels[\"app.kubernetes.io/name\"]")
+	Path string `json:"path"`
+
+	// JSON value of the field in the live object (empty if the field is not set)
+	Live string `json:"live,omitempty"`
+
+	// JSON value of the field in the desired object (empty if the field is removed)
+	Desired string `json:"desired,omitempty"`
 }
 
 // CommandRunStatus defines the observed state of a CommandRun.
 type CommandRunStatus struct {
-	// Exit code of the command
+	// +optional
+	// Exit code of the command (unset until the command finishes)
 	ExitCode int `json:"exitCode"`
 
 	// Combined output of stdout and stderr of the command
@@ -30,7 +106,23 @@ type CommandRunStatus struct {
 	// Optional additional error message
 	Error string `json:"error,omitempty"`
 
-	// Conditions of the command run
+	// Names of the variables substituted in the files
+	Variables []string `json:"variables,omitempty"`
+
+	// Outcome of applying each object, in application order
+	Objects []ObjectResult `json:"objects,omitempty"`
+
+	// Time the command started running
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// Time the command finished running
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// Duration of the command
+	Duration *metav1.Duration `json:"duration,omitempty"`
+
+	// Conditions of the command run, reflecting its lifecycle: "Pending", "Running", "Succeeded" or "Failed" (with the
+	// "TimedOut" reason if the command exceeded its timeout, or "Interrupted" if it was terminated before finishing)
 	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type" protobuf:"bytes,1,rep,name=conditions"`
 }
 
@@ -40,6 +132,7 @@ type CommandRunStatus struct {
 //+kubebuilder:printcolumn:name="Commit SHA",type="string",JSONPath=".spec.commitSHA"
 //+kubebuilder:printcolumn:name="Command",type="string",JSONPath=".spec.args"
 //+kubebuilder:printcolumn:name="Exit Code",type="string",JSONPath=".status.exitCode"
+//+kubebuilder:printcolumn:name="Duration",type="string",JSONPath=".status.duration"
 //+kubebuilder:printcolumn:name="Error",type="string",JSONPath=".status.error"
 
 // CommandRun defines the complete definition of a command run.
@@ -1,6 +1,7 @@
 package v1alpha1
 
 import (
+	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -10,13 +11,47 @@ type GitRepositorySpec struct {
 	// URL of the Git repository
 	URL string `json:"url"`
 
-	// +kubebuilder:validation:Required
-	// Branch of the Git repository to monitor (TODO: rename to "Ref"; let user specify "refs/heads/...", "refs/tags/..." or SHA)
-	Branch string `json:"branch"`
+	// +optional
+	// +kubebuilder:validation:Pattern=`^(refs/(heads|tags)/.+|[0-9a-f]{40})$`
+	// Git reference to monitor: a branch (e.g. "refs/heads/main"), a tag (e.g. "refs/tags/v1.0.0") or a commit SHA;
+	// when neither this nor "tag" is set, the default branch of the repository is monitored
+	Ref string `json:"ref,omitempty"`
+
+	// +optional
+	// Semantic version constraint (e.g. ">=1.2.0 <2.0.0") used to select the highest matching tag on each poll;
+	// mutually exclusive with "ref"
+	Tag string `json:"tag,omitempty"`
 
 	// +kubebuilder:validation:MinLength=1
 	// Polling interval for the Git repository
 	PollingInterval string `json:"pollingInterval"`
+
+	// +optional
+	// Reference to a Secret in the same namespace holding the credentials for accessing the Git repository. SSH
+	// authentication uses the "identity" key (PEM-encoded private key) and the required "known_hosts" key (pinning the
+	// server's host key), with an optional "passphrase" key; HTTPS authentication uses the "username" & "password" keys
+	// (a token may be provided as the password) or the "bearerToken" key, with an optional "caFile" key holding
+	// additional PEM-encoded CA certificates.
+	SecretRef *v1.LocalObjectReference `json:"secretRef,omitempty"`
+
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	// Number of commits to fetch from the tip of each branch & tag (i.e. a shallow clone); when zero or omitted, the
+	// full history is fetched. Commit SHAs given in "ref" must be within this depth.
+	Depth int `json:"depth,omitempty"`
+
+	// +optional
+	// Fetch only the branch or tag selected by "ref" rather than all branches & tags; requires "ref" to be a branch
+	// (e.g. "refs/heads/main") or a tag (e.g. "refs/tags/v1.0.0")
+	SingleBranch bool `json:"singleBranch,omitempty"`
+
+	// +optional
+	// Paths (directories or files, relative to the repository root) to check out into the work directory; when
+	// omitted, the whole repository is checked out
+	SparsePaths []string `json:"sparsePaths,omitempty"`
+
+	// Suspend polling the repository, e.g. during incidents; bundles keep using the last pulled commit until resumed
+	Suspend bool `json:"suspend,omitempty"`
 }
 
 // GitRepositoryStatus defines the observed state of GitRepository
@@ -24,9 +59,16 @@ type GitRepositoryStatus struct {
 	// SHA of the last successfully applied commit
 	LastPulledSHA string `json:"lastPulledSHA,omitempty"`
 
+	// Git reference that the spec resolved to when LastPulledSHA was pulled (e.g. "refs/tags/v1.2.3")
+	ResolvedRef string `json:"resolvedRef,omitempty"`
+
 	// Directory where the Git repository is cloned
 	WorkDirectory string `json:"workDirectory,omitempty"`
 
+	// Token of the last reconciliation requested via the "kude.kfirs.com/reconcile-requested-at" annotation that was
+	// handled (i.e. the repository was fetched after it was requested)
+	LastHandledReconcileAt string `json:"lastHandledReconcileAt,omitempty"`
+
 	// Conditions represent the latest available observations of the resource
 	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type" protobuf:"bytes,1,rep,name=conditions"`
 }
@@ -34,9 +76,12 @@ type GitRepositoryStatus struct {
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
 //+kubebuilder:printcolumn:name="URL",type="string",JSONPath=".spec.url"
-//+kubebuilder:printcolumn:name="Branch",type="string",JSONPath=".spec.branch"
+//+kubebuilder:printcolumn:name="Ref",type="string",JSONPath=".spec.ref"
+//+kubebuilder:printcolumn:name="Tag",type="string",JSONPath=".spec.tag"
 //+kubebuilder:printcolumn:name="Interval",type="string",JSONPath=".spec.pollingInterval"
+//+kubebuilder:printcolumn:name="Resolved",type="string",JSONPath=".status.resolvedRef"
 //+kubebuilder:printcolumn:name="SHA",type="string",JSONPath=".status.lastPulledSHA"
+//+kubebuilder:printcolumn:name="Suspended",type="boolean",JSONPath=".spec.suspend"
 
 // GitRepository defines a single monitored Git repository
 //go:generate go run ../../scripts/objecter/objecter.go -type=GitRepository
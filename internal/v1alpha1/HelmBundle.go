@@ -7,16 +7,58 @@ import (
 // HelmBundleSpec describes the desired state of a HelmBundle in the cluster. It provides the necessary information on
 // the Helm chart to be installed in the cluster.
 type HelmBundleSpec struct {
-	Chart      string `json:"chart,omitempty"`      // Name of the Helm chart to be installed (without the "MyRepo/" prefix)
-	Repository string `json:"repository,omitempty"` // Source repository of the Helm chart
-	Release    string `json:"release,omitempty"`    // Name of the Helm release - use this to differentiate between multiple installations of the same chart in the cluster (e.g. "db1", "db2")
-	Version    string `json:"version,omitempty"`    // Version of the Helm chart to use
-	Values     string `json:"values,omitempty"`     // Custom values to provide as parameters to the Helm chart
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	// Name of the Helm chart in the chart repository (without the "MyRepo/" prefix), or the path of the chart
+	// directory relative to the root of the source Git repository
+	Chart string `json:"chart"`
+
+	// URL of the Helm chart repository to fetch the chart from (mutually exclusive with sourceRepository)
+	Repository string `json:"repository,omitempty"`
+
+	// +kubebuilder:validation:Pattern=`^[^/]+/[^/]+$`
+	// GitRepository (in "namespace/name" format) to load the chart from (mutually exclusive with repository)
+	SourceRepository string `json:"sourceRepository,omitempty"`
+
+	Release string `json:"release,omitempty"` // Name of the Helm release - use this to differentiate between multiple installations of the same chart in the cluster (e.g. "db1", "db2"); defaults to the bundle name
+	Version string `json:"version,omitempty"` // Version (or semantic version constraint) of the Helm chart to use from the chart repository; defaults to the latest version
+	Values  string `json:"values,omitempty"`  // Custom values to provide as parameters to the Helm chart
+
+	// Interval for checking the chart repository for new chart versions (defaults to 10m)
+	Interval string `json:"interval,omitempty"`
+
+	// Bundles that must be up-to-date with their current commit (and healthy, if they check their objects' health)
+	// before this bundle is applied
+	DependsOn []BundleReference `json:"dependsOn,omitempty"`
+
+	// Service account (in the bundle's namespace) to impersonate when applying the bundle, limiting it to the service
+	// account's permissions; defaults to the kude-controller's default service account (see its
+	// "--default-service-account" flag), unless applying to a remote cluster (see "kubeConfig")
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	// Kubeconfig of a remote cluster to apply the bundle to, instead of the cluster the kude-controller runs in; the
+	// service account to impersonate (if any) must then exist in the remote cluster
+	KubeConfig *KubeConfigReference `json:"kubeConfig,omitempty"`
+
+	// Suspend reconciling the bundle, e.g. during incidents; its release is left as-is until resumed
+	Suspend bool `json:"suspend,omitempty"`
 }
 
 // HelmBundleStatus defines the observed state of a HelmBundle.
 type HelmBundleStatus struct {
-	ChartStatus string `json:"chartStatus,omitempty"` // Status of the chart in the cluster
+	ChartStatus  string `json:"chartStatus,omitempty"`  // Status of the chart in the cluster
+	ChartVersion string `json:"chartVersion,omitempty"` // Version of the installed chart
+	Revision     int    `json:"revision,omitempty"`     // Revision of the Helm release
+
+	// Commit SHA of the source repository the installed chart was loaded from
+	LastAppliedSHA string `json:"lastAppliedSHA,omitempty"`
+
+	// Generation of the bundle that was last installed
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Token of the last reconciliation requested via the "kude.kfirs.com/reconcile-requested-at" annotation that was
+	// handled (i.e. the release was upgraded after it was requested)
+	LastHandledReconcileAt string `json:"lastHandledReconcileAt,omitempty"`
 
 	// Conditions represent the latest available observations of the resource
 	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type" protobuf:"bytes,1,rep,name=conditions"`
@@ -24,6 +66,11 @@ type HelmBundleStatus struct {
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Chart",type="string",JSONPath=".spec.chart"
+//+kubebuilder:printcolumn:name="Version",type="string",JSONPath=".status.chartVersion"
+//+kubebuilder:printcolumn:name="Status",type="string",JSONPath=".status.chartStatus"
+//+kubebuilder:printcolumn:name="Revision",type="string",JSONPath=".status.revision"
+//+kubebuilder:printcolumn:name="Suspended",type="boolean",JSONPath=".spec.suspend"
 
 // HelmBundle describes a bundle that installs a Helm chart into the cluster.
 //go:generate go run ../../scripts/objecter/objecter.go -type=HelmBundle
@@ -0,0 +1,15 @@
+package v1alpha1
+
+import (
+	v1 "k8s.io/api/core/v1"
+)
+
+// KubeConfigReference refers to a kubeconfig of a remote cluster, stored in a Secret.
+type KubeConfigReference struct {
+	// +kubebuilder:validation:Required
+	// Secret in the bundle's namespace holding the kubeconfig
+	SecretRef v1.LocalObjectReference `json:"secretRef"`
+
+	// Key of the kubeconfig in the Secret (defaults to "value")
+	Key string `json:"key,omitempty"`
+}
@@ -1,18 +1,16 @@
 package v1alpha1
 
 import (
+	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // KubectlBundleSpec describes the desired state of a KubectlBundle in the cluster. It provides the necessary
 // information on the manifests to be installed in the cluster.
 type KubectlBundleSpec struct {
-	// Arguments to pass to the kubectl command
-	Args []string `json:"args,omitempty"`
-
 	// +kubebuilder:validation:Required
 	// +kubebuilder:validation:MinItems=1
-	// Files to apply
+	// Files to apply, relative to the repository root; glob patterns and directories are supported
 	Files []string `json:"files"`
 
 	// +kubebuilder:validation:Required
@@ -25,13 +23,181 @@ type KubectlBundleSpec struct {
 	// Drift verification interval
 	DriftDetectionInterval string `json:"driftDetectionInterval"`
 
+	// Maximum duration of a single run; runs exceeding it are terminated & marked as timed out (defaults to "5m")
+	Timeout string `json:"timeout,omitempty"`
+
+	// Retry policy of failed runs, backing off between consecutive failed runs of the same commit
+	Retry *RetryPolicy `json:"retry,omitempty"`
+
 	// +kubebuilder:validation:Minimum=1
 	// Runs history limit
 	RunsHistoryLimit int `json:"runsHistoryLimit,omitempty"`
+
+	// +kubebuilder:validation:Minimum=0
+	// Delete runs this many seconds after they finished; the latest run is always retained
+	RunsTTLSecondsAfterFinished *int32 `json:"runsTTLSecondsAfterFinished,omitempty"`
+
+	// Re-apply the bundle when the live state of its objects drifts from the desired state
+	CorrectDrift bool `json:"correctDrift,omitempty"`
+
+	// Delete objects that were applied by this bundle but are no longer present in its files, as well as all applied
+	// objects when the bundle is deleted. Objects annotated with "kude.kfirs.com/prune: disabled" are never deleted.
+	Prune bool `json:"prune,omitempty"`
+
+	// +kubebuilder:validation:Enum=Apply;DryRun;Diff
+	// How to run the bundle (defaults to "Apply"): "Apply" applies the files, while "DryRun" & "Diff" only preview the
+	// outcome of applying them using a server-side dry-run, leaving the cluster & the bundle's inventory as-is. "DryRun"
+	// records the action that would be taken for each object, and "Diff" records the changes to each object's fields as
+	// well. Only "Apply" is supported when running in a Job.
+	Mode string `json:"mode,omitempty"`
+
+	// Apply the files by running "kubectl" in a Kubernetes Job, using the Job's service account, instead of applying
+	// them inside the kude-controller process. Pruning is not supported in this mode.
+	Job *CommandRunJob `json:"job,omitempty"`
+
+	// Variables to substitute in the files, replacing "${VAR}" placeholders; placeholders may specify a default value
+	// with "${VAR:=default}" (or "${VAR:-default}"), and "$${VAR}" escapes a placeholder. Takes precedence over variables
+	// from "substituteFrom". Not supported when running in a Job.
+	Substitute map[string]string `json:"substitute,omitempty"`
+
+	// ConfigMaps & Secrets (in the bundle's namespace) holding variables to substitute in the files; later entries take
+	// precedence over earlier ones
+	SubstituteFrom []SubstituteReference `json:"substituteFrom,omitempty"`
+
+	// Fail when the files refer to undefined variables with no default value, instead of substituting them with empty
+	// strings
+	StrictSubstitution bool `json:"strictSubstitution,omitempty"`
+
+	// Decrypt SOPS-encrypted files before applying them; not supported when running in a Job. Only KubectlBundles
+	// support decryption: KustomizeBundles & KudeBundles apply their files as-is
+	Decryption *Decryption `json:"decryption,omitempty"`
+
+	// Wait for the applied objects to become ready after applying them, reporting the outcome in the "Healthy"
+	// condition; readiness is assessed using kstatus rules (e.g. Deployments rolled out, Jobs complete, and custom
+	// resources with a "Ready" condition). Not supported when running in a Job.
+	Wait bool `json:"wait,omitempty"`
+
+	// Objects (in addition to the applied objects, when waiting for them) whose readiness is reported in the "Healthy"
+	// condition after applying the bundle
+	HealthChecks []HealthCheck `json:"healthChecks,omitempty"`
+
+	// Maximum duration of waiting for objects to become ready after applying the bundle, before reporting them as
+	// unhealthy (defaults to "5m")
+	HealthCheckTimeout string `json:"healthCheckTimeout,omitempty"`
+
+	// Bundles that must be up-to-date with their current commit (and healthy, if they check their objects' health)
+	// before this bundle is applied
+	DependsOn []BundleReference `json:"dependsOn,omitempty"`
+
+	// Service account (in the bundle's namespace) to impersonate when applying the bundle, limiting it to the service
+	// account's permissions; defaults to the kude-controller's default service account (see its
+	// "--default-service-account" flag), unless applying to a remote cluster (see "kubeConfig"). Jobs run as this
+	// service account unless configured otherwise.
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	// Kubeconfig of a remote cluster to apply the bundle to, instead of the cluster the kude-controller runs in; the
+	// service account to impersonate (if any) must then exist in the remote cluster, and jobs apply the files
+	// using the kubeconfig
+	KubeConfig *KubeConfigReference `json:"kubeConfig,omitempty"`
+
+	// Suspend reconciling the bundle, e.g. during incidents; no new runs are started (in-flight runs still finish) and
+	// drift is neither detected nor corrected until resumed
+	Suspend bool `json:"suspend,omitempty"`
+}
+
+// Decryption configures decrypting SOPS-encrypted files.
+type Decryption struct {
+	// +kubebuilder:validation:Required
+	// Secret in the bundle's namespace holding the private keys: age identities in keys ending with ".agekey", and
+	// armored PGP private keys in keys ending with ".asc"
+	SecretRef v1.LocalObjectReference `json:"secretRef"`
+}
+
+// RetryPolicy controls how failed runs of a commit are retried.
+type RetryPolicy struct {
+	// Delay before retrying a failed run, doubled after every consecutive failed run of the same commit (defaults to
+	// the drift detection interval)
+	InitialDelay string `json:"initialDelay,omitempty"`
+
+	// Maximum delay before retrying a failed run (defaults to "1h", or to the initial delay if it's longer)
+	MaxDelay string `json:"maxDelay,omitempty"`
+
+	// +kubebuilder:validation:Minimum=0
+	// Maximum number of runs of the same commit; once exhausted, the commit is no longer retried until the commit
+	// changes or a reconciliation is requested (unlimited if zero or omitted)
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+}
+
+// HealthCheck refers to an object whose readiness is checked after applying a bundle.
+type HealthCheck struct {
+	// +kubebuilder:validation:Required
+	// API version of the object
+	APIVersion string `json:"apiVersion"`
+
+	// +kubebuilder:validation:Required
+	// Kind of the object
+	Kind string `json:"kind"`
+
+	// Namespace of the object (defaults to the bundle's namespace; ignored for cluster-scoped objects)
+	Namespace string `json:"namespace,omitempty"`
+
+	// +kubebuilder:validation:Required
+	// Name of the object
+	Name string `json:"name"`
+}
+
+// SubstituteReference refers to a ConfigMap or a Secret holding variables to substitute in a bundle's files.
+type SubstituteReference struct {
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Enum=ConfigMap;Secret
+	// Kind of the referenced object
+	Kind string `json:"kind"`
+
+	// +kubebuilder:validation:Required
+	// Name of the referenced object
+	Name string `json:"name"`
+
+	// Ignore the referenced object if it's missing, instead of failing
+	Optional bool `json:"optional,omitempty"`
+}
+
+// InventoryEntry identifies a single object applied to the cluster.
+type InventoryEntry struct {
+	// API group of the object (empty for the core group)
+	Group string `json:"group,omitempty"`
+
+	// API version of the object
+	Version string `json:"version"`
+
+	// Kind of the object
+	Kind string `json:"kind"`
+
+	// Namespace of the object (empty for cluster-scoped objects)
+	Namespace string `json:"namespace,omitempty"`
+
+	// Name of the object
+	Name string `json:"name"`
 }
 
 // KubectlBundleStatus defines the observed state of a KubectlBundle.
 type KubectlBundleStatus struct {
+	// Commit SHA of the source repository that was last applied successfully
+	LastAppliedSHA string `json:"lastAppliedSHA,omitempty"`
+
+	// Number of attempts at running the last run's commit: 1 for its first run, incremented whenever a failed run is
+	// retried, and restarted when the commit or the mode change, or when a reconciliation is requested
+	Attempts int `json:"attempts,omitempty"`
+
+	// Objects applied by this bundle
+	Inventory []InventoryEntry `json:"inventory,omitempty"`
+
+	// Objects whose live state drifted from the desired state, as of the last drift detection
+	DriftedObjects []InventoryEntry `json:"driftedObjects,omitempty"`
+
+	// Token of the last reconciliation requested via the "kude.kfirs.com/reconcile-requested-at" annotation that was
+	// handled (i.e. a run was created after it was requested)
+	LastHandledReconcileAt string `json:"lastHandledReconcileAt,omitempty"`
+
 	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type" protobuf:"bytes,1,rep,name=conditions"`
 }
 
@@ -39,8 +205,10 @@ type KubectlBundleStatus struct {
 //+kubebuilder:subresource:status
 //+kubebuilder:printcolumn:name="Files",type="string",JSONPath=".spec.files"
 //+kubebuilder:printcolumn:name="Repository",type="string",JSONPath=".spec.sourceRepository"
+//+kubebuilder:printcolumn:name="SHA",type="string",JSONPath=".status.lastAppliedSHA"
 //+kubebuilder:printcolumn:name="Interval",type="string",JSONPath=".spec.driftDetectionInterval"
 //+kubebuilder:printcolumn:name="History limit",type="string",JSONPath=".spec.runsHistoryLimit"
+//+kubebuilder:printcolumn:name="Suspended",type="boolean",JSONPath=".spec.suspend"
 
 // KubectlBundle defines a set of Kubernetes manifest YAML files to be applied in the cluster.
 //go:generate go run ../../scripts/objecter/objecter.go -type=KubectlBundle
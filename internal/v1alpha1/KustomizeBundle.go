@@ -7,22 +7,54 @@ import (
 // KustomizeBundleSpec describes the desired state of a KustomizeBundle in the cluster. It provides the necessary
 // information on the manifests to be installed in the cluster.
 type KustomizeBundleSpec struct {
-	Files []string `json:"files,omitempty"`
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinItems=1
+	// Paths of kustomization directories to build & apply, relative to the repository root
+	Files []string `json:"files"`
 
+	// +kubebuilder:validation:Required
 	// +kubebuilder:validation:Pattern=`^[^/]+/[^/]+$`
-	SourceRepository string `json:"sourceRepository,omitempty"`
+	// Source repository to pull the files from
+	SourceRepository string `json:"sourceRepository"`
+
+	// Bundles that must be up-to-date with their current commit (and healthy, if they check their objects' health)
+	// before this bundle is applied
+	DependsOn []BundleReference `json:"dependsOn,omitempty"`
+
+	// Service account (in the bundle's namespace) to impersonate when applying the bundle, limiting it to the service
+	// account's permissions; defaults to the kude-controller's default service account (see its
+	// "--default-service-account" flag), unless applying to a remote cluster (see "kubeConfig")
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	// Kubeconfig of a remote cluster to apply the bundle to, instead of the cluster the kude-controller runs in; the
+	// service account to impersonate (if any) must then exist in the remote cluster
+	KubeConfig *KubeConfigReference `json:"kubeConfig,omitempty"`
+
+	// Suspend reconciling the bundle, e.g. during incidents; its objects are left as-is until resumed
+	Suspend bool `json:"suspend,omitempty"`
 }
 
 // KustomizeBundleStatus defines the observed state of a KustomizeBundle.
 type KustomizeBundleStatus struct {
+	// Commit SHA of the source repository that was last applied successfully
+	LastAppliedSHA string `json:"lastAppliedSHA,omitempty"`
+
 	Errors []string `json:"errors,omitempty"` // List of errors encountered while applying the files
 
+	// Token of the last reconciliation requested via the "kude.kfirs.com/reconcile-requested-at" annotation that was
+	// handled (i.e. the bundle was re-applied after it was requested)
+	LastHandledReconcileAt string `json:"lastHandledReconcileAt,omitempty"`
+
 	// Conditions represent the latest available observations of the resource
 	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type" protobuf:"bytes,1,rep,name=conditions"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Files",type="string",JSONPath=".spec.files"
+//+kubebuilder:printcolumn:name="Repository",type="string",JSONPath=".spec.sourceRepository"
+//+kubebuilder:printcolumn:name="SHA",type="string",JSONPath=".status.lastAppliedSHA"
+//+kubebuilder:printcolumn:name="Suspended",type="boolean",JSONPath=".spec.suspend"
 
 // KustomizeBundle defines a set of Kubernetes manifest YAML files to be applied in the cluster.
 //go:generate go run ../../scripts/objecter/objecter.go -type=KustomizeBundle
@@ -0,0 +1,60 @@
+package v1alpha1
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ReceiverSpec describes a webhook receiver, which accepts Git push notifications and triggers immediate
+// reconciliation of matching GitRepository objects in the same namespace.
+type ReceiverSpec struct {
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Enum=github;gitlab;bitbucket;generic
+	// Type of the webhook sender, which determines how payloads are validated & parsed
+	Type string `json:"type"`
+
+	// +kubebuilder:validation:Required
+	// Reference to a Secret in the same namespace, whose "token" key holds the shared webhook secret
+	SecretRef v1.LocalObjectReference `json:"secretRef"`
+
+	// Suspend accepting webhooks, e.g. during incidents; payloads are rejected until resumed
+	Suspend bool `json:"suspend,omitempty"`
+}
+
+// ReceiverStatus defines the observed state of Receiver
+type ReceiverStatus struct {
+	// URL path (relative to the webhook server address) at which this receiver accepts payloads
+	WebhookPath string `json:"webhookPath,omitempty"`
+
+	// Conditions represent the latest available observations of the resource
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type" protobuf:"bytes,1,rep,name=conditions"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Type",type="string",JSONPath=".spec.type"
+//+kubebuilder:printcolumn:name="Path",type="string",JSONPath=".status.webhookPath"
+//+kubebuilder:printcolumn:name="Suspended",type="boolean",JSONPath=".spec.suspend"
+
+// Receiver defines a webhook endpoint for Git push notifications
+//go:generate go run ../../scripts/objecter/objecter.go -type=Receiver
+type Receiver struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ReceiverSpec   `json:"spec"`
+	Status ReceiverStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ReceiverList contains a list of Receiver
+type ReceiverList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Receiver `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Receiver{}, &ReceiverList{})
+}
@@ -0,0 +1,31 @@
+package v1alpha1
+
+import (
+	"github.com/arikkfir/kude-controller/internal/object"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func (in *Receiver) GetStatus() object.Status {
+	return &in.Status
+}
+
+func (in *ReceiverStatus) GetConditions() *[]metav1.Condition {
+	return &in.Conditions
+}
+
+func (in *ReceiverList) Len() int {
+	return len(in.Items)
+}
+
+func (in *ReceiverList) Less(i, j int) bool {
+	ii := in.Items[i]
+	sj := in.Items[j]
+	return ii.CreationTimestamp.Before(&sj.CreationTimestamp)
+}
+
+func (in *ReceiverList) Swap(i, j int) {
+	ii := in.Items[i]
+	sj := in.Items[j]
+	in.Items[i] = sj
+	in.Items[j] = ii
+}
@@ -56,7 +56,9 @@ func (r *GitRepository) RunGit(args ...string) error {
 
 func (r *GitRepository) CommitFile(file, content string) error {
 	path := filepath.Join(r.Dir, file)
-	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create directory of file '%s': %w", path, err)
+	} else if err := os.WriteFile(path, []byte(content), 0600); err != nil {
 		return fmt.Errorf("failed to write file '%s': %w", path, err)
 	} else if err := r.RunGit("add", file); err != nil {
 		return fmt.Errorf("failed to add file '%s': %w", file, err)
@@ -66,3 +68,31 @@ func (r *GitRepository) CommitFile(file, content string) error {
 		return nil
 	}
 }
+
+func (r *GitRepository) RemoveFile(file string) error {
+	if err := r.RunGit("rm", file); err != nil {
+		return fmt.Errorf("failed to remove file '%s': %w", file, err)
+	} else if err := r.RunGit("commit", "-m", "Removing "+file); err != nil {
+		return fmt.Errorf("failed to commit removal of file '%s': %w", file, err)
+	} else {
+		return nil
+	}
+}
+
+func (r *GitRepository) Tag(name string) error {
+	if err := r.RunGit("tag", name); err != nil {
+		return fmt.Errorf("failed to create tag '%s': %w", name, err)
+	} else {
+		return nil
+	}
+}
+
+func (r *GitRepository) HeadSHA() (string, error) {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = r.Dir
+	if out, err := cmd.Output(); err != nil {
+		return "", fmt.Errorf("failed to resolve HEAD in dir '%s': %w", r.Dir, err)
+	} else {
+		return strings.TrimSpace(string(out)), nil
+	}
+}
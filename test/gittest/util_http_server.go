@@ -0,0 +1,70 @@
+package gittest
+
+import (
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+)
+
+// HTTPServer serves a Git repository over HTTP(S) using "git http-backend", optionally requiring basic authentication.
+type HTTPServer struct {
+	Server     *httptest.Server
+	Repository *GitRepository
+	Username   string
+	Password   string
+}
+
+func NewHTTPServer(repository *GitRepository, useTLS bool, username, password string) (*HTTPServer, error) {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find git executable: %w", err)
+	}
+
+	s := &HTTPServer{Repository: repository, Username: username, Password: password}
+	backend := &cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + filepath.Dir(repository.Dir),
+			"GIT_HTTP_EXPORT_ALL=1",
+		},
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Username != "" || s.Password != "" {
+			if username, password, ok := r.BasicAuth(); !ok || username != s.Username || password != s.Password {
+				w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		backend.ServeHTTP(w, r)
+	})
+
+	if useTLS {
+		s.Server = httptest.NewTLSServer(handler)
+	} else {
+		s.Server = httptest.NewServer(handler)
+	}
+	return s, nil
+}
+
+// URL returns the URL of the served repository.
+func (s *HTTPServer) URL() string {
+	return s.Server.URL + "/" + filepath.Base(s.Repository.Dir)
+}
+
+// CACert returns the PEM-encoded certificate of the server, when serving over TLS.
+func (s *HTTPServer) CACert() []byte {
+	if cert := s.Server.Certificate(); cert != nil {
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return nil
+}
+
+func (s *HTTPServer) Close() {
+	s.Server.Close()
+}
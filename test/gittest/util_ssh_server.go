@@ -0,0 +1,170 @@
+package gittest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// SSHServer serves a Git repository over SSH, accepting only clients authenticating with an authorized public key.
+type SSHServer struct {
+	Repository    *GitRepository
+	HostKey       ssh.Signer
+	AuthorizedKey ssh.PublicKey
+	listener      net.Listener
+}
+
+func NewSSHServer(repository *GitRepository, authorizedKey ssh.PublicKey) (*SSHServer, error) {
+	hostPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate host key: %w", err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(hostPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create host key signer: %w", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	s := &SSHServer{Repository: repository, HostKey: hostKey, AuthorizedKey: authorizedKey, listener: listener}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), s.AuthorizedKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unauthorized public key")
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConnection(conn, config)
+		}
+	}()
+	return s, nil
+}
+
+// URL returns the SSH URL of the served repository.
+func (s *SSHServer) URL() string {
+	return "ssh://git@" + s.listener.Addr().String() + s.Repository.Dir
+}
+
+// KnownHosts returns a known_hosts line pinning the server's host key.
+func (s *SSHServer) KnownHosts() []byte {
+	return []byte(knownhosts.Line([]string{knownhosts.Normalize(s.listener.Addr().String())}, s.HostKey.PublicKey()) + "\n")
+}
+
+func (s *SSHServer) Close() {
+	_ = s.listener.Close()
+}
+
+func (s *SSHServer) handleConnection(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.handleSession(channel, channelRequests)
+	}
+}
+
+func (s *SSHServer) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		if req.Type != "exec" || len(req.Payload) < 4 {
+			_ = req.Reply(false, nil)
+			continue
+		}
+
+		// Parse commands such as: git-upload-pack '/path/to/repo'
+		command := string(req.Payload[4:])
+		service, path, _ := strings.Cut(command, " ")
+		path = strings.Trim(path, "'\"")
+		if (service != "git-upload-pack" && service != "git-receive-pack") || path != s.Repository.Dir {
+			_ = req.Reply(false, nil)
+			return
+		}
+		_ = req.Reply(true, nil)
+
+		cmd := exec.Command("git", strings.TrimPrefix(service, "git-"), path)
+		cmd.Stdout = channel
+		cmd.Stderr = channel.Stderr()
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			s.sendExitStatus(channel, 1)
+			return
+		}
+		if err := cmd.Start(); err != nil {
+			s.sendExitStatus(channel, 1)
+			return
+		}
+		go func() {
+			_, _ = io.Copy(stdin, channel)
+			_ = stdin.Close()
+		}()
+		if err := cmd.Wait(); err != nil {
+			s.sendExitStatus(channel, 1)
+		} else {
+			s.sendExitStatus(channel, 0)
+		}
+		return
+	}
+}
+
+func (s *SSHServer) sendExitStatus(channel ssh.Channel, code uint32) {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, code)
+	_, _ = channel.SendRequest("exit-status", false, payload)
+}
+
+// GenerateSSHIdentity generates a new SSH client identity, returning its PEM-encoded private key (encrypted if a
+// passphrase is provided) and its public key.
+func GenerateSSHIdentity(passphrase string) ([]byte, ssh.PublicKey, error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate private key: %w", err)
+	}
+	publicKey, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create public key: %w", err)
+	}
+
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
+	if passphrase != "" {
+		//goland:noinspection GoDeprecation
+		block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, []byte(passphrase), x509.PEMCipherAES256)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encrypt private key: %w", err)
+		}
+	}
+	return pem.EncodeToMemory(block), publicKey, nil
+}